@@ -3,20 +3,23 @@
 package main
 
 type Config struct {
-	Help         bool   `cli:"!h,help" usage:"Show help"`
-	Url          string `cli:"U,url" usage:"Server URL"`
-	Watchdog     int    `cli:"w,watchdog" usage:"WebSocket ping interval in seconds, 0 to disable, default 2." dft:"2"`
-	Reconnect    int    `cli:"r,reconnect" usage:"Reconnection interval in seconds, -1 to disable, default 3." dft:"2"`
-	Backoff      string `cli:"backoff" usage:"Backoff type, none, linear, exponential, defaults to linear" dft:"none"`
-	BackoffValue uint   `cli:"backoff-value" usage:"For linear backoff, increase reconnect interval by this amount of seconds after each iteration. For exponential backoff, multiply reconnect interval by this amount. Default 2" dft:"2"`
-	User         string `cli:"u,user" usage:"Username for authentication" dft:""`
-	Pass         string `cli:"k,pass" usage:"Password for authentication" dft:""`
-	Baud         int    `cli:"b,baudrate" usage:"(Wi-Se only) Set remote baud rate [bps]" dft:"-1"`
-	Parity       string `cli:"p,parity" usage:"(Wi-Se only) Set remote parity [odd|even|none]" dft:""`
-	Databits     int    `cli:"d,databits" usage:"(Wi-Se only) Set remote data bits [5|6|7|8]" dft:"-1"`
-	Stopbits     int    `cli:"s,stopbits" usage:"(Wi-Se only) Set remote stop bits [1|2]" dft:"-1"`
+	Help bool `cli:"!h,help" usage:"Show help"`
+	ConnectionConfig
+	SttyConfig
+	MappingConfig
+	DisplayConfig
+	LogConfig
+	TransferConfig
+	PacingConfig
+	PipeConfig
+	ExecConfig
+	ListenConfig
 	WaitDebugger bool   `cli:"D,debugger" usage:"Wait on start for a debugger connection" dft:"false"`
-	Version      bool   `cli:"!v,version" usage:"Show version"`
+	Detach       bool   `cli:"detach" usage:"Keep the session running in the background, attach to it with 'ttyc attach'" dft:"false"`
+	Session      string `cli:"session" usage:"Name of the detached session, defaults to the server host name" dft:""`
+	Scrollback   int    `cli:"scrollback" usage:"Bytes of output that a detached session replays to newly attached clients" dft:"262144"`
+	ServiceConfig
+	Version bool `cli:"!v,version" usage:"Show version"`
 }
 
 func (config *Config) GetTty() string {
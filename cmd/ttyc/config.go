@@ -0,0 +1,354 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Depau/ttyc/cmd/ttyc/handlers"
+	"github.com/Depau/ttyc/decoders"
+	"github.com/lestrrat-go/strftime"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Options for connecting to the server, shared by all commands
+type ConnectionConfig struct {
+	Url          string `cli:"U,url" usage:"Server URL"`
+	Watchdog     int    `cli:"w,watchdog" usage:"WebSocket ping interval in seconds, 0 to disable, default 2." dft:"2"`
+	Reconnect    int    `cli:"r,reconnect" usage:"Reconnection interval in seconds, -1 to disable, default 3." dft:"2"`
+	Backoff      string `cli:"backoff" usage:"Backoff type, none, linear, exponential, defaults to linear" dft:"none"`
+	BackoffValue uint   `cli:"backoff-value" usage:"For linear backoff, increase reconnect interval by this amount of seconds after each iteration. For exponential backoff, multiply reconnect interval by this amount. Default 2" dft:"2"`
+	User         string `cli:"u,user" usage:"Username for authentication" dft:""`
+	Pass         string `cli:"k,pass" usage:"Password for authentication" dft:""`
+}
+
+// Remote UART parameters, Wi-Se only
+type SttyConfig struct {
+	Baud     int    `cli:"b,baudrate" usage:"(Wi-Se only) Set remote baud rate [bps]" dft:"-1"`
+	Parity   string `cli:"p,parity" usage:"(Wi-Se only) Set remote parity [odd|even|none]" dft:""`
+	Databits int    `cli:"d,databits" usage:"(Wi-Se only) Set remote data bits [5|6|7|8]" dft:"-1"`
+	Stopbits int    `cli:"s,stopbits" usage:"(Wi-Se only) Set remote stop bits [1|2]" dft:"-1"`
+}
+
+// Character mapping of the data received and sent, applied by ttyc for any server
+type MappingConfig struct {
+	Map string `cli:"map" usage:"Map characters, comma separated: ICRNL, IGNCR, INLCR, INLCRNL (received data); OCRNL, ONLCR, ODELBS, OBSDEL (sent data)" dft:""`
+}
+
+// Initial display and input modes of the interactive terminal, which can be changed with key commands
+type DisplayConfig struct {
+	Timestamps      bool   `cli:"t,timestamps" usage:"Prefix lines with timestamps" dft:"false"`
+	TimestampFormat string `cli:"timestamp-format" usage:"Timestamp format: time, ms, iso, relative (since the session started), delta (since the previous line)" dft:"time"`
+	HexInput        bool   `cli:"hex-input" usage:"Type bytes as hex pairs, i.e. AA 55 01 FF, sent when pressing Enter" dft:"false"`
+	Frames          bool   `cli:"frames" usage:"Show the output as hex dumped frames, split when the line is idle for --frame-gap" dft:"false"`
+	FrameGap        int    `cli:"frame-gap" usage:"Idle time that separates frames, in milliseconds" dft:"20"`
+	VisibleControls bool   `cli:"visible-controls" usage:"Show control characters and invalid UTF-8 like cat -v, i.e. ^[ and ^M" dft:"false"`
+	DimControls     bool   `cli:"dim-controls" usage:"Show visible control characters in a dim color" dft:"false"`
+	Charset         string `cli:"charset" usage:"Charset of the remote device, converted to and from UTF-8 in the terminal, text logs and recordings: cp437, iso-8859-1, iso-8859-15, windows-1252" dft:"utf-8"`
+	Decoder         string `cli:"decoder" usage:"Show the output as frames of a protocol, also in text logs: cobs, modbus-rtu (frames split on --frame-gap), nmea, slip, sml" dft:""`
+	PasteGuard      bool   `cli:"paste-guard" usage:"Send pasted text paced like --send-file" dft:"false"`
+}
+
+// Session logging and recording options
+type LogConfig struct {
+	LogFile           string `cli:"L,log-file" usage:"Log the session to this file; strftime patterns such as %%Y-%%m-%%d are expanded" dft:""`
+	LogFormat         string `cli:"log-format" usage:"Log file format: text (timestamped lines without escape sequences, with connection events) or raw (bytes as received)" dft:"text"`
+	LogRotateSize     string `cli:"log-rotate-size" usage:"Start a new log file when the current one reaches this size, i.e. 10M; 0 to disable" dft:"0"`
+	LogRotateInterval string `cli:"log-rotate-interval" usage:"Start a new log file after this time, i.e. 24h; 0 to disable" dft:"0"`
+	Record            string `cli:"record" usage:"Record the session to this file in the asciinema v2 format" dft:""`
+	RecordInput       bool   `cli:"record-input" usage:"Also record the input sent to the server" dft:"false"`
+}
+
+// File transfers started as soon as the session is connected
+type TransferConfig struct {
+	Send    string `cli:"send" usage:"Send files once connected, protocol:file[,file]; protocols: xmodem, xmodem-1k, ymodem, zmodem" dft:""`
+	Receive string `cli:"receive" usage:"Receive files once connected, protocol[:path]; path is the file to write for XMODEM, the directory otherwise" dft:""`
+}
+
+// Pacing of the text files sent and of the pasted text, for slow devices
+type PacingConfig struct {
+	SendFile    string `cli:"send-file" usage:"Send a text file once connected, paced as set by the options below" dft:""`
+	CharDelay   int    `cli:"char-delay" usage:"Delay after each character of the text files sent and of the pasted text, in milliseconds" dft:"0"`
+	LineDelay   int    `cli:"line-delay" usage:"Delay after each line of the text files sent and of the pasted text, in milliseconds" dft:"0"`
+	WaitEcho    bool   `cli:"wait-echo" usage:"Wait for each line to be echoed before sending the next one" dft:"false"`
+	WaitPrompt  string `cli:"wait-prompt" usage:"Wait for the output to match this regular expression after each line, i.e. '[$#] $'" dft:""`
+	WaitTimeout int    `cli:"wait-timeout" usage:"Stop sending if the echo or the prompt isn't received within this time, in milliseconds" dft:"5000"`
+}
+
+// Non-interactive mode, for standard file descriptors that aren't a terminal
+type PipeConfig struct {
+	Pipe       bool `cli:"pipe" usage:"Don't set up the terminal and print status messages to stderr, implied when stdin or stdout isn't a terminal" dft:"false"`
+	PipeEscape bool `cli:"pipe-escape" usage:"Process the ctrl-t key commands in pipe mode" dft:"false"`
+	Drain      int  `cli:"drain" usage:"In pipe mode, keep printing the output for this time after the end of the input, in milliseconds, -1 to keep running" dft:"1000"`
+}
+
+// Exec mode, connecting a local program to the remote terminal
+type ExecConfig struct {
+	Exec    string `cli:"exec" usage:"Run this command with its standard input and output connected to the remote terminal, exit with its status" dft:""`
+	ExecPty bool   `cli:"exec-pty" usage:"Connect the command through a PTY instead of pipes (Linux only)" dft:"false"`
+}
+
+// Listen mode, serving the remote terminal to socket clients
+type ListenConfig struct {
+	Listen      string `cli:"listen" usage:"Serve the remote terminal on this address instead of the terminal: tcp://host:port (raw), telnet://host:port or rfc2217://host:port (telnet with serial port control)" dft:""`
+	ListenMulti bool   `cli:"listen-multi" usage:"Let multiple clients connect at once, sharing the terminal; otherwise clients are refused while one is connected" dft:"false"`
+}
+
+// Options for automation and for running as a service
+type ServiceConfig struct {
+	Control    string `cli:"control" usage:"Serve a JSON/HTTP API to control this session on the given Unix socket" dft:""`
+	ConfigFile string `cli:"config" usage:"JSON file with user, pass, baudrate, parity, databits and stopbits; overrides the command line and is reloaded on SIGHUP" dft:""`
+	Pidfile    string `cli:"pidfile" usage:"Write the process ID to this file" dft:""`
+	NoColor    bool   `cli:"no-color" usage:"Print status messages without colors (implied when logging to journald)" dft:"false"`
+}
+
+func (argv *ConnectionConfig) validate() error {
+	parsedUrl, err := url.Parse(argv.Url)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %v", err)
+	}
+	if parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https" {
+		return fmt.Errorf("invalid URL, must be http or https")
+	}
+	if !(argv.Backoff == "none" || argv.Backoff == "linear" || argv.Backoff == "exponential") {
+		return fmt.Errorf("invalid backoff: %s", argv.Backoff)
+	}
+	return argv.validateCredentials()
+}
+
+func (argv *ConnectionConfig) validateCredentials() error {
+	if !(argv.User != "" && argv.Pass != "") && !(argv.User == "" && argv.Pass == "") {
+		return fmt.Errorf("user and password must be both provided or not provided at all")
+	}
+	return nil
+}
+
+func (argv *DisplayConfig) validate() error {
+	if !handlers.IsValidTimestampFormat(argv.TimestampFormat) {
+		return fmt.Errorf("invalid timestamp format: %s", argv.TimestampFormat)
+	}
+	if argv.FrameGap <= 0 {
+		return fmt.Errorf("invalid frame gap: %d", argv.FrameGap)
+	}
+	if _, err := handlers.LookupCharset(argv.Charset); err != nil {
+		return err
+	}
+	if argv.Decoder != "" {
+		if _, err := decoders.New(argv.Decoder); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Applies the initial display modes to the handler, if it supports them
+func (argv *DisplayConfig) applyModes(handler handlers.TtyHandler) {
+	modeHandler, ok := handler.(handlers.ModeHandler)
+	if !ok {
+		return
+	}
+	modes := modeHandler.Modes()
+	modes.Timestamps = argv.Timestamps
+	modes.TimestampFormat = argv.TimestampFormat
+	modes.HexInput = argv.HexInput
+	modes.Frames = argv.Frames
+	modes.FrameGap = int64(argv.FrameGap)
+	modes.Decoder = argv.Decoder
+	modes.VisibleControls = argv.VisibleControls
+	modes.DimControls = argv.DimControls
+	modes.Charset = argv.Charset
+	modes.PasteGuard = argv.PasteGuard
+	modeHandler.SetModes(modes)
+}
+
+func (argv *LogConfig) validate() error {
+	if argv.LogFile != "" {
+		if _, err := strftime.New(argv.LogFile); err != nil {
+			return fmt.Errorf("invalid log file name: %v", err)
+		}
+	}
+	if argv.LogFormat != handlers.LogFormatText && argv.LogFormat != handlers.LogFormatRaw {
+		return fmt.Errorf("invalid log format: %s", argv.LogFormat)
+	}
+	if _, err := parseSize(argv.LogRotateSize); err != nil {
+		return fmt.Errorf("invalid log rotation size: %s", argv.LogRotateSize)
+	}
+	if _, err := parseInterval(argv.LogRotateInterval); err != nil {
+		return fmt.Errorf("invalid log rotation interval: %s", argv.LogRotateInterval)
+	}
+	if argv.RecordInput && argv.Record == "" {
+		return fmt.Errorf("--record-input requires --record")
+	}
+	return nil
+}
+
+func (argv *TransferConfig) validate() error {
+	if argv.Send != "" && argv.Receive != "" {
+		return fmt.Errorf("--send and --receive can't be used together")
+	}
+	_, err := argv.transferRequest()
+	return err
+}
+
+// Returns the transfer to start, or nil
+func (argv *TransferConfig) transferRequest() (*handlers.TransferRequest, error) {
+	if argv.Send != "" {
+		return handlers.ParseTransfer(argv.Send, true)
+	}
+	if argv.Receive != "" {
+		return handlers.ParseTransfer(argv.Receive, false)
+	}
+	return nil, nil
+}
+
+func (argv *PacingConfig) validate() error {
+	if argv.SendFile != "" {
+		if info, err := os.Stat(argv.SendFile); err != nil {
+			return err
+		} else if !info.Mode().IsRegular() {
+			return fmt.Errorf("not a regular file: %s", argv.SendFile)
+		}
+	}
+	if argv.CharDelay < 0 {
+		return fmt.Errorf("invalid character delay: %d", argv.CharDelay)
+	}
+	if argv.LineDelay < 0 {
+		return fmt.Errorf("invalid line delay: %d", argv.LineDelay)
+	}
+	if argv.WaitTimeout <= 0 {
+		return fmt.Errorf("invalid wait timeout: %d", argv.WaitTimeout)
+	}
+	if _, err := regexp.Compile(argv.WaitPrompt); err != nil {
+		return fmt.Errorf("invalid prompt regular expression: %v", err)
+	}
+	return nil
+}
+
+// Must be called after validate()
+func (argv *PacingConfig) pacing() handlers.Pacing {
+	pacing := handlers.Pacing{
+		CharDelay:   time.Duration(argv.CharDelay) * time.Millisecond,
+		LineDelay:   time.Duration(argv.LineDelay) * time.Millisecond,
+		WaitEcho:    argv.WaitEcho,
+		WaitTimeout: time.Duration(argv.WaitTimeout) * time.Millisecond,
+	}
+	if argv.WaitPrompt != "" {
+		pacing.Prompt = regexp.MustCompile(argv.WaitPrompt)
+	}
+	return pacing
+}
+
+func (argv *PipeConfig) validate() error {
+	if argv.Drain < -1 {
+		return fmt.Errorf("invalid drain time: %d", argv.Drain)
+	}
+	return nil
+}
+
+func (argv *PipeConfig) pipeOptions() handlers.PipeOptions {
+	return handlers.PipeOptions{
+		Escape: argv.PipeEscape,
+		Drain:  time.Duration(argv.Drain) * time.Millisecond,
+	}
+}
+
+// Returns the network address and the protocol to listen with
+func (argv *ListenConfig) listenAddress() (string, int, error) {
+	parsedUrl, err := url.Parse(argv.Listen)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid listen address: %v", err)
+	}
+	protocol := handlers.ListenRaw
+	switch parsedUrl.Scheme {
+	case "tcp":
+	case "telnet":
+		protocol = handlers.ListenTelnet
+	case "rfc2217":
+		protocol = handlers.ListenRfc2217
+	default:
+		return "", 0, fmt.Errorf("invalid listen address, must be tcp://host:port, telnet://host:port or rfc2217://host:port")
+	}
+	if parsedUrl.Port() == "" {
+		return "", 0, fmt.Errorf("invalid listen address, the port is missing")
+	}
+	return parsedUrl.Host, protocol, nil
+}
+
+func (argv *ListenConfig) validate() error {
+	if argv.Listen == "" {
+		if argv.ListenMulti {
+			return fmt.Errorf("--listen-multi requires --listen")
+		}
+		return nil
+	}
+	_, _, err := argv.listenAddress()
+	return err
+}
+
+func (argv *LogConfig) logOptions() handlers.LogOptions {
+	size, _ := parseSize(argv.LogRotateSize)
+	interval, _ := parseInterval(argv.LogRotateInterval)
+	return handlers.LogOptions{
+		Format:         argv.LogFormat,
+		RotateSize:     size,
+		RotateInterval: interval,
+	}
+}
+
+// Parses sizes in bytes with an optional K, M or G suffix
+func parseSize(size string) (int64, error) {
+	if size == "" {
+		return 0, fmt.Errorf("empty size")
+	}
+	multiplier := int64(1)
+	switch strings.ToUpper(size[len(size)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		size = size[:len(size)-1]
+	}
+	value, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size: %s", size)
+	}
+	return value * multiplier, nil
+}
+
+func parseInterval(interval string) (time.Duration, error) {
+	if interval == "0" {
+		return 0, nil
+	}
+	value, err := time.ParseDuration(interval)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid interval: %s", interval)
+	}
+	return value, nil
+}
+
+func (argv *SttyConfig) validate() error {
+	if argv.Baud != -1 && argv.Baud <= 0 {
+		return fmt.Errorf("invalid baud rate: %d", argv.Baud)
+	}
+	if !(argv.Parity == "even" || argv.Parity == "odd" || argv.Parity == "none" || argv.Parity == "") {
+		return fmt.Errorf("invalid parity: %s", argv.Parity)
+	}
+	if !(argv.Databits == -1 || (argv.Databits >= 5 && argv.Databits <= 8)) {
+		return fmt.Errorf("invalid data bits: %d", argv.Databits)
+	}
+	if !(argv.Stopbits == -1 || argv.Stopbits == 1 || argv.Stopbits == 2) {
+		return fmt.Errorf("invalid stop bits: %d", argv.Stopbits)
+	}
+	return nil
+}
+
+func (argv *MappingConfig) validate() error {
+	_, err := handlers.ParseMapping(argv.Map)
+	return err
+}
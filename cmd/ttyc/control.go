@@ -0,0 +1,432 @@
+package main
+
+// Local JSON/HTTP control API, served on a Unix socket, to automate a running ttyc session
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Depau/ttyc"
+	"github.com/Depau/ttyc/cmd/ttyc/handlers"
+	"github.com/Depau/ttyc/decoders"
+	"github.com/Depau/ttyc/utils"
+	"github.com/Depau/ttyc/ws"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Events queued for each streaming client before it is considered too slow and disconnected
+const controlStreamQueueLen = 1024
+
+type controlStatusDTO struct {
+	Url            string          `json:"url"`
+	Server         string          `json:"server"`
+	Implementation string          `json:"implementation"`
+	Connected      bool            `json:"connected"`
+	Modes          *handlers.Modes `json:"modes,omitempty"`
+	LogFile        string          `json:"logFile,omitempty"`
+	LogError       string          `json:"logError,omitempty"`
+}
+
+type controlModesDTO struct {
+	LocalEcho       *bool   `json:"localEcho"`
+	Hex             *bool   `json:"hex"`
+	Timestamps      *bool   `json:"timestamps"`
+	TimestampFormat *string `json:"timestampFormat"`
+	HexInput        *bool   `json:"hexInput"`
+	Frames          *bool   `json:"frames"`
+	FrameGap        *int64  `json:"frameGap"`
+	Decoder         *string `json:"decoder"`
+	VisibleControls *bool   `json:"visibleControls"`
+	DimControls     *bool   `json:"dimControls"`
+	Charset         *string `json:"charset"`
+	PasteGuard      *bool   `json:"pasteGuard"`
+}
+
+type controlLogDTO struct {
+	Path string `json:"path"`
+}
+
+type controlErrorDTO struct {
+	Error string `json:"error"`
+}
+
+type controlServer struct {
+	client         *ws.Client
+	handler        handlers.TtyHandler
+	hub            *handlers.EventHub
+	logger         *handlers.SessionLogger
+	implementation ttyc.Implementation
+	server         string
+	listener       net.Listener
+	httpServer     *http.Server
+
+	lock        sync.Mutex
+	credentials *url.Userinfo
+	connected   bool
+}
+
+func startControlServer(socketPath string, client *ws.Client, handler handlers.TtyHandler, hub *handlers.EventHub, logger *handlers.SessionLogger, implementation ttyc.Implementation, credentials *url.Userinfo, server string) (*controlServer, error) {
+	listener, err := utils.ListenUnixSocket(socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create control socket: %v", err)
+	}
+	c := &controlServer{
+		client:         client,
+		handler:        handler,
+		hub:            hub,
+		logger:         logger,
+		implementation: implementation,
+		server:         server,
+		listener:       listener,
+		credentials:    credentials,
+		connected:      true,
+	}
+	hub.AddListener(c.handleEvent)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", c.serveStatus)
+	mux.HandleFunc("/input", c.serveInput)
+	mux.HandleFunc("/modes", c.serveModes)
+	mux.HandleFunc("/break", c.serveBreak)
+	mux.HandleFunc("/detect-baudrate", c.serveDetectBaudrate)
+	mux.HandleFunc("/stty", c.serveStty)
+	mux.HandleFunc("/log", c.serveLog)
+	mux.HandleFunc("/events", c.serveEvents)
+	mux.HandleFunc("/output", c.serveOutput)
+	c.httpServer = &http.Server{Handler: mux}
+
+	go func() {
+		if err := c.httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			ttyc.TtycAngryPrintf("Control API stopped: %v\n", err)
+		}
+	}()
+	return c, nil
+}
+
+func (c *controlServer) Close() error {
+	return c.httpServer.Close()
+}
+
+func (c *controlServer) setCredentials(credentials *url.Userinfo) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.credentials = credentials
+}
+
+func (c *controlServer) handleEvent(event *handlers.Event) {
+	switch event.Type {
+	case handlers.EventDisconnected:
+		c.lock.Lock()
+		c.connected = false
+		c.lock.Unlock()
+	case handlers.EventReconnected:
+		c.lock.Lock()
+		c.connected = true
+		c.lock.Unlock()
+	}
+}
+
+func (c *controlServer) isConnected() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.connected
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeJSON(w, status, &controlErrorDTO{Error: fmt.Sprintf(format, args...)})
+}
+
+// Returns false and writes an error response if the request method is not among the allowed ones
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	writeJSONError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+	return false
+}
+
+// Returns false and writes an error response if the remote terminal is not connected
+func (c *controlServer) requireConnected(w http.ResponseWriter) bool {
+	if !c.isConnected() {
+		writeJSONError(w, http.StatusServiceUnavailable, "not connected to the server")
+		return false
+	}
+	return true
+}
+
+func (c *controlServer) requireWiSe(w http.ResponseWriter) bool {
+	if c.implementation != ttyc.ImplementationWiSe {
+		writeJSONError(w, http.StatusNotImplemented, "only available for Wi-Se")
+		return false
+	}
+	return true
+}
+
+func (c *controlServer) serveStatus(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	status := controlStatusDTO{
+		Url:            c.client.BaseUrl.String(),
+		Server:         c.server,
+		Implementation: "ttyd",
+		Connected:      c.isConnected(),
+		LogFile:        c.logger.Path(),
+	}
+	if err := c.logger.Err(); err != nil {
+		status.LogError = err.Error()
+	}
+	if c.implementation == ttyc.ImplementationWiSe {
+		status.Implementation = "wi-se"
+	}
+	if modeHandler, ok := c.handler.(handlers.ModeHandler); ok {
+		modes := modeHandler.Modes()
+		status.Modes = &modes
+	}
+	writeJSON(w, http.StatusOK, &status)
+}
+
+func (c *controlServer) serveInput(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	if !c.requireConnected(w) {
+		return
+	}
+	select {
+	case c.client.Input <- data:
+		w.WriteHeader(http.StatusNoContent)
+	case <-time.After(5 * time.Second):
+		writeJSONError(w, http.StatusServiceUnavailable, "timed out sending input")
+	}
+}
+
+func (c *controlServer) serveModes(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPut) {
+		return
+	}
+	modeHandler, ok := c.handler.(handlers.ModeHandler)
+	if !ok {
+		writeJSONError(w, http.StatusNotImplemented, "display modes are only available in terminal mode")
+		return
+	}
+	modes := modeHandler.Modes()
+	if r.Method == http.MethodPut {
+		dto := controlModesDTO{}
+		if err := json.NewDecoder(r.Body).Decode(&dto); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid modes: %v", err)
+			return
+		}
+		if dto.LocalEcho != nil {
+			modes.LocalEcho = *dto.LocalEcho
+		}
+		if dto.Hex != nil {
+			modes.Hex = *dto.Hex
+		}
+		if dto.Timestamps != nil {
+			modes.Timestamps = *dto.Timestamps
+		}
+		if dto.TimestampFormat != nil {
+			if !handlers.IsValidTimestampFormat(*dto.TimestampFormat) {
+				writeJSONError(w, http.StatusBadRequest, "invalid timestamp format: %s", *dto.TimestampFormat)
+				return
+			}
+			modes.TimestampFormat = *dto.TimestampFormat
+		}
+		if dto.HexInput != nil {
+			modes.HexInput = *dto.HexInput
+		}
+		if dto.Frames != nil {
+			modes.Frames = *dto.Frames
+		}
+		if dto.FrameGap != nil {
+			if *dto.FrameGap <= 0 {
+				writeJSONError(w, http.StatusBadRequest, "invalid frame gap: %d", *dto.FrameGap)
+				return
+			}
+			modes.FrameGap = *dto.FrameGap
+		}
+		if dto.Decoder != nil {
+			if *dto.Decoder != "" {
+				if _, err := decoders.New(*dto.Decoder); err != nil {
+					writeJSONError(w, http.StatusBadRequest, "%v", err)
+					return
+				}
+			}
+			modes.Decoder = *dto.Decoder
+		}
+		if dto.VisibleControls != nil {
+			modes.VisibleControls = *dto.VisibleControls
+		}
+		if dto.DimControls != nil {
+			modes.DimControls = *dto.DimControls
+		}
+		if dto.Charset != nil {
+			if _, err := handlers.LookupCharset(*dto.Charset); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "%v", err)
+				return
+			}
+			modes.Charset = *dto.Charset
+		}
+		if dto.PasteGuard != nil {
+			modes.PasteGuard = *dto.PasteGuard
+		}
+		modeHandler.SetModes(modes)
+	}
+	writeJSON(w, http.StatusOK, &modes)
+}
+
+func (c *controlServer) serveBreak(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) || !c.requireWiSe(w) || !c.requireConnected(w) {
+		return
+	}
+	c.client.SendBreak()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *controlServer) serveDetectBaudrate(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) || !c.requireWiSe(w) || !c.requireConnected(w) {
+		return
+	}
+	// The result is reported by the handler, like when requested with the key command
+	c.client.RequestBaudrateDetection()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (c *controlServer) serveStty(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost) || !c.requireWiSe(w) {
+		return
+	}
+	c.lock.Lock()
+	credentials := c.credentials
+	c.lock.Unlock()
+	sttyUrl := ttyc.GetUrlFor(ttyc.UrlForStty, c.client.BaseUrl)
+
+	var stty ttyc.SttyDTO
+	var err error
+	if r.Method == http.MethodGet {
+		stty, err = ttyc.GetStty(sttyUrl, credentials)
+	} else {
+		dto := ttyc.SttyDTO{}
+		if err = json.NewDecoder(r.Body).Decode(&dto); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid stty parameters: %v", err)
+			return
+		}
+		if dto.Parity != nil && !(*dto.Parity == "even" || *dto.Parity == "odd" || *dto.Parity == "none") {
+			writeJSONError(w, http.StatusBadRequest, "invalid parity: %s", *dto.Parity)
+			return
+		}
+		stty, err = ttyc.Stty(sttyUrl, credentials, &dto)
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &stty)
+}
+
+func (c *controlServer) serveLog(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost, http.MethodDelete) {
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		dto := controlLogDTO{}
+		if err := json.NewDecoder(r.Body).Decode(&dto); err != nil || dto.Path == "" {
+			writeJSONError(w, http.StatusBadRequest, "a log file path must be provided")
+			return
+		}
+		if err := c.logger.Start(dto.Path); err != nil {
+			writeJSONError(w, http.StatusConflict, "unable to start logging: %v", err)
+			return
+		}
+	case http.MethodDelete:
+		if err := c.logger.Stop(); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "unable to stop logging: %v", err)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, &controlLogDTO{Path: c.logger.Path()})
+}
+
+// Streams the events accepted by filter to the client until it disconnects or can't keep up
+func (c *controlServer) stream(w http.ResponseWriter, r *http.Request, filter func(event *handlers.Event) bool, write func(event *handlers.Event) error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+	queue := make(chan *handlers.Event, controlStreamQueueLen)
+	overflow := make(chan interface{})
+	var overflowOnce sync.Once
+	removeListener := c.hub.AddListener(func(event *handlers.Event) {
+		if !filter(event) {
+			return
+		}
+		select {
+		case queue <- event:
+		default:
+			overflowOnce.Do(func() { close(overflow) })
+		}
+	})
+	defer removeListener()
+
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-overflow:
+			return
+		case event := <-queue:
+			if err := write(event); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func (c *controlServer) serveEvents(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	c.stream(w, r, func(event *handlers.Event) bool {
+		return true
+	}, func(event *handlers.Event) error {
+		return encoder.Encode(event)
+	})
+}
+
+func (c *controlServer) serveOutput(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	c.stream(w, r, func(event *handlers.Event) bool {
+		return event.Type == handlers.EventOutput
+	}, func(event *handlers.Event) error {
+		_, err := w.Write(event.Data)
+		return err
+	})
+}
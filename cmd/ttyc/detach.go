@@ -0,0 +1,236 @@
+package main
+
+// Detached sessions: a background ttyc process keeps the connection to the server and serves it over a Unix socket
+// to any number of "ttyc attach" clients, like dtach/tmux do for local programs.
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/Depau/ttyc"
+	"github.com/Depau/ttyc/cmd/ttyc/handlers"
+	"github.com/Depau/ttyc/utils"
+	"github.com/Depau/ttyc/ws"
+	"github.com/mattn/go-isatty"
+	"github.com/mkideal/cli"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Set in the environment of the background process spawned by --detach
+const sessionDaemonEnv = "TTYC_SESSION_DAEMON"
+
+// File descriptor on which the background process reports that it is ready
+const sessionReadyFd = 3
+const sessionReadyMsg = "ready"
+
+var sessionNameRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+func isValidSessionName(name string) bool {
+	return sessionNameRegexp.MatchString(name) && name != "." && name != ".."
+}
+
+func sessionDir() (string, error) {
+	var dir string
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		dir = filepath.Join(runtimeDir, "ttyc")
+	} else {
+		dir = filepath.Join(os.TempDir(), fmt.Sprintf("ttyc-%d", os.Getuid()))
+	}
+	// The sockets give full access to the sessions
+	if err := utils.MkdirPrivate(dir); err != nil {
+		return "", fmt.Errorf("unable to create session directory: %v", err)
+	}
+	return dir, nil
+}
+
+func sessionPaths(name string) (socketPath string, logPath string, err error) {
+	dir, err := sessionDir()
+	if err != nil {
+		return
+	}
+	socketPath = filepath.Join(dir, name+".sock")
+	logPath = filepath.Join(dir, name+".log")
+	return
+}
+
+func sessionIsRunning(socketPath string) bool {
+	conn, err := net.DialTimeout("unix", socketPath, time.Second)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+func defaultSessionName(config *Config) string {
+	if config.Session != "" {
+		return config.Session
+	}
+	baseUrl, _ := url.Parse(config.Url)
+	return strings.ReplaceAll(baseUrl.Host, ":", "_")
+}
+
+// runDetached starts the background process when called by the user, or runs the session when called in the
+// background process itself.
+func runDetached(config *Config) error {
+	name := defaultSessionName(config)
+	if !isValidSessionName(name) {
+		return fmt.Errorf("invalid session name: %s, please provide one with --session", name)
+	}
+	socketPath, logPath, err := sessionPaths(name)
+	if err != nil {
+		return err
+	}
+
+	if os.Getenv(sessionDaemonEnv) == "" {
+		if sessionIsRunning(socketPath) {
+			return fmt.Errorf("session %s is already running", name)
+		}
+		if err := spawnSessionDaemon(logPath); err != nil {
+			return err
+		}
+		ttyc.TtycPrintf("Session %s started, attach to it with: ttyc attach %s\n", name, name)
+		return nil
+	}
+
+	// Background process from here on, output goes to the log file
+	ttyc.UseColors = false
+	listener, err := utils.ListenUnixSocket(socketPath)
+	if err != nil {
+		return err
+	}
+	ready := os.NewFile(sessionReadyFd, "ready")
+
+	runSession(config, func(client *ws.Client, _ ttyc.Implementation, credentials *url.Userinfo, server string) (handlers.TtyHandler, error) {
+		handler, err := handlers.NewDetachedHandler(client, credentials, server, listener, config.Scrollback)
+		if err != nil {
+			return nil, fmt.Errorf("unable to launch session handler: %v", err)
+		}
+		ttyc.TtycPrintf("Session %s connected, listening on %s\n", name, socketPath)
+		if ready != nil {
+			_, _ = ready.WriteString(sessionReadyMsg)
+			_ = ready.Close()
+			ready = nil
+		}
+		return handler, nil
+	})
+	return nil
+}
+
+// Waits for the background process to report that it is ready
+func waitSessionDaemon(readyPipe *os.File, logPath string) error {
+	msg, _ := ioutil.ReadAll(readyPipe)
+	_ = readyPipe.Close()
+	if string(msg) == sessionReadyMsg {
+		return nil
+	}
+	if log, err := ioutil.ReadFile(logPath); err == nil {
+		_, _ = os.Stderr.Write(log)
+	}
+	return fmt.Errorf("session failed to start, see %s", logPath)
+}
+
+type attachConfig struct {
+	Help bool `cli:"!h,help" usage:"Show help"`
+	List bool `cli:"l,list" usage:"List running sessions"`
+	Kill bool `cli:"K,kill" usage:"Stop the session instead of attaching to it"`
+}
+
+func (argv *attachConfig) AutoHelp() bool {
+	return argv.Help
+}
+
+var attachCommand = &cli.Command{
+	Name: "attach",
+	Desc: "Attach to a session started with --detach",
+	Text: "Usage: ttyc attach [options] <session>",
+	// Allows the session name as positional argument
+	CanSubRoute: true,
+	Argv:        func() interface{} { return &attachConfig{} },
+	Fn:          runAttach,
+}
+
+func listSessions() error {
+	dir, err := sessionDir()
+	if err != nil {
+		return err
+	}
+	sockets, err := filepath.Glob(filepath.Join(dir, "*.sock"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(sockets)
+	for _, socketPath := range sockets {
+		if sessionIsRunning(socketPath) {
+			fmt.Println(strings.TrimSuffix(filepath.Base(socketPath), ".sock"))
+		}
+	}
+	return nil
+}
+
+func runAttach(ctx *cli.Context) error {
+	argv := ctx.Argv().(*attachConfig)
+	if argv.List {
+		return listSessions()
+	}
+	if ctx.NArg() != 1 {
+		return fmt.Errorf("exactly one session name must be provided")
+	}
+	name := ctx.Args()[0]
+	if !isValidSessionName(name) {
+		return fmt.Errorf("invalid session name: %s", name)
+	}
+	socketPath, _, err := sessionPaths(name)
+	if err != nil {
+		return err
+	}
+	if !sessionIsRunning(socketPath) {
+		return fmt.Errorf("session %s is not running", name)
+	}
+
+	// The host name is ignored, all connections go to the session socket
+	utils.UseUnixSocket(socketPath)
+	sessionUrl := "http://" + name + "/"
+
+	if argv.Kill {
+		resp, err := http.Post(sessionUrl+"quit", "text/plain", bytes.NewBuffer(nil))
+		if err != nil {
+			return fmt.Errorf("unable to stop session: %v", err)
+		}
+		_ = resp.Body.Close()
+		return nil
+	}
+
+	if !isatty.IsTerminal(os.Stdout.Fd()) || !isatty.IsTerminal(os.Stdin.Fd()) {
+		return fmt.Errorf("cannot launch in terminal mode when standard file descriptors aren't terminals")
+	}
+	config := &Config{
+		ConnectionConfig: ConnectionConfig{
+			Url:          sessionUrl,
+			Watchdog:     2,
+			Reconnect:    -1,
+			Backoff:      "none",
+			BackoffValue: 2,
+		},
+		SttyConfig: SttyConfig{
+			Baud:     -1,
+			Databits: -1,
+			Stopbits: -1,
+		},
+		DisplayConfig: DisplayConfig{
+			TimestampFormat: handlers.TimestampTime,
+			FrameGap:        int(handlers.DefaultFrameGap / time.Millisecond),
+		},
+	}
+	ttyc.TtycPrintf("Attaching to session %s\n", name)
+	runSession(config, newStdFdsHandler)
+	return nil
+}
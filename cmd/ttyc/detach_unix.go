@@ -0,0 +1,45 @@
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// spawnSessionDaemon re-executes ttyc with the same arguments in a new session, detached from the terminal
+func spawnSessionDaemon(logPath string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("unable to find ttyc executable: %v", err)
+	}
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to create session log: %v", err)
+	}
+	defer logFile.Close()
+	readyRead, readyWrite, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	command := exec.Command(exe, os.Args[1:]...)
+	command.Env = append(os.Environ(), sessionDaemonEnv+"=1")
+	command.Stdin = nil
+	command.Stdout = logFile
+	command.Stderr = logFile
+	// Becomes fd 3 (sessionReadyFd) in the child
+	command.ExtraFiles = []*os.File{readyWrite}
+	command.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	err = command.Start()
+	_ = readyWrite.Close()
+	if err != nil {
+		_ = readyRead.Close()
+		return fmt.Errorf("unable to start session: %v", err)
+	}
+	_ = command.Process.Release()
+	return waitSessionDaemon(readyRead, logPath)
+}
@@ -0,0 +1,9 @@
+// +build windows
+
+package main
+
+import "fmt"
+
+func spawnSessionDaemon(logPath string) error {
+	return fmt.Errorf("detached sessions are not available on Windows")
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"fmt"
 	"io"
 )
 
@@ -10,3 +11,68 @@ type TtyHandler interface {
 	HandleDisconnect() error
 	HandleReconnect() error
 }
+
+// ExitStatus is reported by handlers that end the session on their own, such as scripts and pipes, with the status ttyc
+// should exit with
+type ExitStatus struct {
+	Status int
+	// Why the handler failed, if it did
+	Err error
+}
+
+func (e *ExitStatus) Error() string {
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("exit status %d", e.Status)
+}
+
+// Display and input modes of the interactive terminal
+type Modes struct {
+	LocalEcho       bool   `json:"localEcho"`
+	Hex             bool   `json:"hex"`
+	Timestamps      bool   `json:"timestamps"`
+	TimestampFormat string `json:"timestampFormat"`
+	HexInput        bool   `json:"hexInput"`
+	Frames          bool   `json:"frames"`
+	// Idle gap that separates frames, in milliseconds
+	FrameGap int64 `json:"frameGap"`
+	// Protocol decoder, empty if the output is not decoded
+	Decoder string `json:"decoder"`
+	// Show control characters and invalid UTF-8 like cat -v, optionally dimmed
+	VisibleControls bool `json:"visibleControls"`
+	DimControls     bool `json:"dimControls"`
+	// Charset of the remote device, converted to and from UTF-8; empty for UTF-8
+	Charset string `json:"charset"`
+	// Send pasted text paced like the files sent
+	PasteGuard bool `json:"pasteGuard"`
+	// Why logging stopped on its own, i.e. a write error; read-only
+	LogError string `json:"logError,omitempty"`
+}
+
+// ModeHandler is implemented by handlers whose display modes can be changed at runtime
+type ModeHandler interface {
+	Modes() Modes
+	SetModes(modes Modes)
+}
+
+// LogHandler is implemented by handlers that let the user start and stop logging the session
+type LogHandler interface {
+	SetLogger(logger *SessionLogger)
+}
+
+// MappingHandler is implemented by handlers that show the character mapping applied to the session
+type MappingHandler interface {
+	SetMapping(mapping *Mapping)
+}
+
+// TransferHandler is implemented by handlers that can transfer files over the session
+type TransferHandler interface {
+	StartTransfer(request *TransferRequest) error
+}
+
+// PacingHandler is implemented by handlers that can send text files and pasted text paced for slow devices
+type PacingHandler interface {
+	SetPacing(pacing Pacing)
+	SendFile(path string) error
+}
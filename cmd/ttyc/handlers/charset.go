@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Charset is a single-byte character set whose lower half is ASCII. The display and the logs are converted from it to
+// UTF-8, and the typed text from UTF-8 to it.
+type Charset struct {
+	Name string
+	// Characters 0x80 to 0xFF
+	high    [128]rune
+	reverse map[rune]byte
+}
+
+// Characters that can't be represented in the remote charset are sent as this
+const charsetReplacement = '?'
+
+var charsets = map[string]*Charset{}
+var charsetAliases = map[string]string{}
+
+func registerCharset(name string, high []rune, aliases ...string) {
+	c := &Charset{
+		Name:    name,
+		reverse: map[rune]byte{},
+	}
+	copy(c.high[:], high)
+	for i, char := range c.high {
+		c.reverse[char] = byte(0x80 + i)
+	}
+	charsets[name] = c
+	for _, alias := range aliases {
+		charsetAliases[alias] = name
+	}
+}
+
+// Returns the Latin-1 upper half with some characters replaced
+func latin1With(replacements map[int]rune) []rune {
+	high := make([]rune, 128)
+	for i := range high {
+		high[i] = rune(0x80 + i)
+		if char, ok := replacements[0x80+i]; ok {
+			high[i] = char
+		}
+	}
+	return high
+}
+
+func init() {
+	registerCharset("cp437", []rune(
+		"ÇüéâäàåçêëèïîìÄÅ"+
+			"ÉæÆôöòûùÿÖÜ¢£¥₧ƒ"+
+			"áíóúñÑªº¿⌐¬½¼¡«»"+
+			"░▒▓│┤╡╢╖╕╣║╗╝╜╛┐"+
+			"└┴┬├─┼╞╟╚╔╩╦╠═╬╧"+
+			"╨╤╥╙╘╒╓╫╪┘┌█▄▌▐▀"+
+			"αßΓπΣσµτΦΘΩδ∞φε∩"+
+			"≡±≥≤⌠⌡÷≈°∙·√ⁿ²■\u00a0"), "ibm437")
+	registerCharset("iso-8859-1", latin1With(nil), "latin1")
+	registerCharset("iso-8859-15", latin1With(map[int]rune{
+		0xA4: '€', 0xA6: 'Š', 0xA8: 'š', 0xB4: 'Ž', 0xB8: 'ž', 0xBC: 'Œ', 0xBD: 'œ', 0xBE: 'Ÿ',
+	}), "latin9")
+	// Undefined characters are mapped to the C1 controls, like browsers do
+	registerCharset("windows-1252", latin1With(map[int]rune{
+		0x80: '€', 0x82: '‚', 0x83: 'ƒ', 0x84: '„', 0x85: '…', 0x86: '†', 0x87: '‡', 0x88: 'ˆ', 0x89: '‰', 0x8A: 'Š',
+		0x8B: '‹', 0x8C: 'Œ', 0x8E: 'Ž', 0x91: '‘', 0x92: '’', 0x93: '“', 0x94: '”', 0x95: '•', 0x96: '–', 0x97: '—',
+		0x98: '˜', 0x99: '™', 0x9A: 'š', 0x9B: '›', 0x9C: 'œ', 0x9E: 'ž', 0x9F: 'Ÿ',
+	}), "cp1252")
+}
+
+// CharsetNames returns the supported charsets, sorted
+func CharsetNames() []string {
+	names := []string{"utf-8"}
+	for name := range charsets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LookupCharset returns the charset with the given name or alias. UTF-8, which needs no conversion, and the empty
+// string return nil.
+func LookupCharset(name string) (*Charset, error) {
+	name = strings.ToLower(name)
+	if name == "" || name == "utf-8" || name == "utf8" {
+		return nil, nil
+	}
+	if alias, ok := charsetAliases[name]; ok {
+		name = alias
+	}
+	if c, ok := charsets[name]; ok {
+		return c, nil
+	}
+	return nil, fmt.Errorf("unsupported charset: %s", name)
+}
+
+// Decode converts data from the charset to UTF-8. Since every byte is a character, chunks never end in the middle of
+// one and no state needs to be kept.
+func (c *Charset) Decode(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for _, char := range data {
+		if char < 0x80 {
+			out = append(out, char)
+		} else {
+			var encoded [utf8.UTFMax]byte
+			n := utf8.EncodeRune(encoded[:], c.high[char-0x80])
+			out = append(out, encoded[:n]...)
+		}
+	}
+	return out
+}
+
+// charsetEncoder converts a UTF-8 stream to the charset, holding back the characters split across chunks
+type charsetEncoder struct {
+	charset *Charset
+	pending []byte
+}
+
+func (e *charsetEncoder) encode(data []byte) []byte {
+	var complete []byte
+	complete, e.pending = splitIncompleteRune(append(e.pending, data...))
+	out := make([]byte, 0, len(complete))
+	for len(complete) > 0 {
+		char, size := utf8.DecodeRune(complete)
+		switch {
+		case char < 0x80:
+			out = append(out, byte(char))
+		case char == utf8.RuneError && size == 1:
+			// Not UTF-8, send as it is
+			out = append(out, complete[0])
+		default:
+			if encoded, ok := e.charset.reverse[char]; ok {
+				out = append(out, encoded)
+			} else {
+				out = append(out, charsetReplacement)
+			}
+		}
+		complete = complete[size:]
+	}
+	return out
+}
@@ -0,0 +1,118 @@
+package handlers
+
+// Local commands run from the terminal, like minicom's "send via external program", whose output is sent to the remote
+// terminal
+
+import (
+	"bytes"
+	"io"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+)
+
+// Chunks of output queued for a command that is fed the output, before it's considered stuck and stopped
+const commandFeedQueueLen = 256
+
+// commandTask is a local command whose standard output is sent to the remote terminal. When the output of the remote
+// terminal is fed to it, it's not shown.
+type commandTask struct {
+	cmd        *exec.Cmd
+	stdout     io.Reader
+	feedOutput bool
+	// Only written by feedLoop, it's closed by exec when the command exits
+	stdin io.WriteCloser
+	// Output waiting to be written to stdin, so that a command that doesn't read it doesn't hold up the session
+	feedQueue  chan []byte
+	done       chan struct{}
+	canceled   int32
+	stalled    int32
+	cancelOnce sync.Once
+}
+
+// Writes to a terminal in raw mode, where line feeds don't return the carriage
+type rawTerminalWriter struct {
+	w io.Writer
+}
+
+func (r rawTerminalWriter) Write(data []byte) (int, error) {
+	if _, err := r.w.Write(bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// Starts command with the shell, showing its standard error on stderr
+func startCommandTask(command string, feedOutput bool, stderr io.Writer) (*commandTask, error) {
+	c := &commandTask{cmd: shellCommand(command), feedOutput: feedOutput, done: make(chan struct{})}
+	c.cmd.Stderr = stderr
+	setProcessGroup(c.cmd)
+	var err error
+	if feedOutput {
+		if c.stdin, err = c.cmd.StdinPipe(); err != nil {
+			return nil, err
+		}
+	}
+	if c.stdout, err = c.cmd.StdoutPipe(); err != nil {
+		return nil, err
+	}
+	if err = c.cmd.Start(); err != nil {
+		return nil, err
+	}
+	if feedOutput {
+		c.feedQueue = make(chan []byte, commandFeedQueueLen)
+		go c.feedLoop()
+	}
+	return c, nil
+}
+
+// Queues the output of the remote terminal for the command. If the command doesn't keep up, it's stopped.
+func (c *commandTask) feed(data []byte) {
+	if c.feedQueue == nil {
+		return
+	}
+	select {
+	case c.feedQueue <- data:
+	default:
+		atomic.StoreInt32(&c.stalled, 1)
+		c.cancel()
+	}
+}
+
+// Writes the queued output to the command until it exits. Once it stops reading, the output is discarded.
+func (c *commandTask) feedLoop() {
+	stdin := c.stdin
+	for {
+		select {
+		case data := <-c.feedQueue:
+			if stdin == nil {
+				continue
+			}
+			if _, err := stdin.Write(data); err != nil {
+				stdin = nil
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *commandTask) cancel() {
+	c.cancelOnce.Do(func() {
+		atomic.StoreInt32(&c.canceled, 1)
+		_ = killProcessGroup(c.cmd)
+	})
+}
+
+// Waits for the command to exit, after its standard output has been read to the end. It returns true if it was
+// canceled.
+func (c *commandTask) wait() (canceled bool, err error) {
+	err = c.cmd.Wait()
+	close(c.done)
+	return atomic.LoadInt32(&c.canceled) != 0, err
+}
+
+// Returns true if the command was stopped because it didn't read the output fed to it
+func (c *commandTask) isStalled() bool {
+	return atomic.LoadInt32(&c.stalled) != 0
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/Depau/ttyc"
+	"unicode/utf8"
+)
+
+// controlRenderer makes control characters and invalid UTF-8 visible, like cat -v: C0 controls are shown in caret
+// notation (^@, ^[, ^M), C1 controls as M-^@ to M-^_ and invalid bytes as \xNN. Line feeds, tabs and CR LF pairs are
+// kept as they are.
+type controlRenderer struct {
+	dim bool
+	// Incomplete UTF-8 sequence or CR at the end of the previous chunk
+	pending []byte
+}
+
+func (c *controlRenderer) writeVisible(out *bytes.Buffer, visible string) {
+	if c.dim {
+		out.WriteString(ttyc.PlatformGray())
+		out.WriteString(visible)
+		out.WriteString(ttyc.PlatformReset())
+	} else {
+		out.WriteString(visible)
+	}
+}
+
+// render renders a chunk, holding back the bytes that may be completed by the next one
+func (c *controlRenderer) render(data []byte) []byte {
+	data = append(c.pending, data...)
+	c.pending = nil
+	var out bytes.Buffer
+	for len(data) > 0 {
+		if data[0] == '\r' {
+			if len(data) == 1 {
+				c.pending = []byte{'\r'}
+				break
+			}
+			if data[1] == '\n' {
+				out.WriteString("\r\n")
+				data = data[2:]
+				continue
+			}
+		}
+		if !utf8.FullRune(data) {
+			c.pending = append([]byte{}, data...)
+			break
+		}
+		char, size := utf8.DecodeRune(data)
+		c.renderRune(&out, char, data[:size])
+		data = data[size:]
+	}
+	return out.Bytes()
+}
+
+func (c *controlRenderer) renderRune(out *bytes.Buffer, char rune, encoded []byte) {
+	switch {
+	case char == utf8.RuneError && len(encoded) == 1:
+		c.writeVisible(out, fmt.Sprintf("\\x%02x", encoded[0]))
+	case char == '\n' || char == '\t':
+		out.WriteRune(char)
+	case char < 0x20:
+		c.writeVisible(out, string([]rune{'^', char + 0x40}))
+	case char == 0x7f:
+		c.writeVisible(out, "^?")
+	case char >= 0x80 && char <= 0x9f:
+		c.writeVisible(out, string([]rune{'M', '-', '^', char - 0x80 + 0x40}))
+	default:
+		out.Write(encoded)
+	}
+}
+
+// flush renders the bytes held back, i.e. when the line is idle or before leaving the mode
+func (c *controlRenderer) flush() []byte {
+	var out bytes.Buffer
+	for len(c.pending) > 0 {
+		char, size := utf8.DecodeRune(c.pending)
+		c.renderRune(&out, char, c.pending[:size])
+		c.pending = c.pending[size:]
+	}
+	c.pending = nil
+	return out.Bytes()
+}
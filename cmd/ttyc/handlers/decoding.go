@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/Depau/ttyc"
+	"github.com/Depau/ttyc/decoders"
+)
+
+// Returns the decoder following the given one, or an empty string after the last one
+func nextDecoder(name string) string {
+	names := decoders.Names()
+	if name == "" {
+		return names[0]
+	}
+	for i, n := range names {
+		if n == name && i+1 < len(names) {
+			return names[i+1]
+		}
+	}
+	return ""
+}
+
+// Writes data as indented hexdump -C lines
+func writeIndentedHexDump(buf *bytes.Buffer, data []byte) {
+	for offset := 0; offset < len(data); offset += hexDumpWidth {
+		end := offset + hexDumpWidth
+		if end > len(data) {
+			end = len(data)
+		}
+		buf.WriteString("  ")
+		writeHexLine(buf, int64(offset), data[offset:end])
+		buf.WriteString("\r\n")
+	}
+}
+
+// Renders a decoded frame as a header with the decoder and the summary, followed by a hex dump of the payload
+func renderDecodedFrame(name string, frame decoders.Frame, stamp string) []byte {
+	var buf bytes.Buffer
+	_, _ = fmt.Fprintf(&buf, "%s%s: %s", stamp, name, frame.Summary)
+	if frame.Error != "" {
+		_, _ = fmt.Fprintf(&buf, " %s(%s)%s", ttyc.PlatformRed(), frame.Error, ttyc.PlatformReset())
+	}
+	buf.WriteString("\r\n")
+	writeIndentedHexDump(&buf, frame.Payload)
+	return buf.Bytes()
+}
+
+// Renders a decoded frame as a single text log line
+func logDecodedFrame(name string, frame decoders.Frame) []byte {
+	var buf bytes.Buffer
+	_, _ = fmt.Fprintf(&buf, "[%s] %s: %s", frame.Time.Format(logTimestampLayout), name, frame.Summary)
+	if len(frame.Payload) > 0 {
+		_, _ = fmt.Fprintf(&buf, " [% x]", frame.Payload)
+	}
+	if frame.Error != "" {
+		_, _ = fmt.Fprintf(&buf, " (%s)", frame.Error)
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	EventOutput       = "output"
+	EventInput        = "input"
+	EventResize       = "resize"
+	EventDisconnected = "disconnected"
+	EventReconnected  = "reconnected"
+)
+
+type Event struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Data    []byte    `json:"data,omitempty"`
+	Message string    `json:"message,omitempty"`
+	Columns int       `json:"columns,omitempty"`
+	Rows    int       `json:"rows,omitempty"`
+}
+
+// EventHub distributes the data exchanged with the remote terminal and the connection events to the listeners, such
+// as loggers and control API clients. Listeners are called synchronously and must not block.
+type EventHub struct {
+	lock      sync.RWMutex
+	listeners map[int]func(event *Event)
+	nextId    int
+}
+
+func NewEventHub() *EventHub {
+	return &EventHub{
+		listeners: map[int]func(event *Event){},
+	}
+}
+
+// AddListener registers a listener and returns a function that removes it
+func (h *EventHub) AddListener(listener func(event *Event)) (remove func()) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	id := h.nextId
+	h.nextId++
+	h.listeners[id] = listener
+	return func() {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		delete(h.listeners, id)
+	}
+}
+
+func (h *EventHub) Publish(event *Event) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	for _, listener := range h.listeners {
+		listener(event)
+	}
+}
+
+func (h *EventHub) publishData(eventType string, data []byte) {
+	h.lock.RLock()
+	empty := len(h.listeners) == 0
+	h.lock.RUnlock()
+	if empty {
+		return
+	}
+	// Buffers are reused by their owners, listeners get their own copy
+	h.Publish(&Event{
+		Type: eventType,
+		Time: time.Now(),
+		Data: append([]byte{}, data...),
+	})
+}
+
+func (h *EventHub) Output(data []byte) {
+	h.publishData(EventOutput, data)
+}
+
+func (h *EventHub) Input(data []byte) {
+	h.publishData(EventInput, data)
+}
+
+func (h *EventHub) Resize(cols int, rows int) {
+	h.Publish(&Event{
+		Type:    EventResize,
+		Time:    time.Now(),
+		Columns: cols,
+		Rows:    rows,
+	})
+}
+
+func (h *EventHub) ConnectionEvent(eventType string, message string) {
+	h.Publish(&Event{
+		Type:    eventType,
+		Time:    time.Now(),
+		Message: message,
+	})
+}
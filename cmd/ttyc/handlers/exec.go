@@ -0,0 +1,163 @@
+package handlers
+
+// Exec mode: a local program takes the place of the terminal, like socat EXEC:, so that tools that speak stdio can be
+// used with the remote terminal
+
+import (
+	"fmt"
+	"github.com/Depau/ttyc"
+	"github.com/Depau/ttyc/ws"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+	"syscall"
+)
+
+type execHandler struct {
+	client *ws.Client
+	cmd    *exec.Cmd
+	// Standard input and output of the program, the same PTY master in PTY mode
+	stdin  io.WriteCloser
+	stdout io.Reader
+	// Closed when the program exits
+	exited chan struct{}
+	mutex  sync.Mutex
+	// Set once the session is over, the exit status is not reported anymore
+	closed bool
+}
+
+// Returns a command that runs command with the shell
+func shellCommand(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command)
+	}
+	return exec.Command("/bin/sh", "-c", command)
+}
+
+// NewExecHandler runs command with the shell, with its standard input and output connected to the remote terminal
+// through pipes or, if usePty is true, through a PTY. The handler reports the exit status of the program as an
+// ExitStatus once it exits.
+func NewExecHandler(client *ws.Client, command string, usePty bool) (tty TtyHandler, err error) {
+	e := &execHandler{
+		client: client,
+		cmd:    shellCommand(command),
+		exited: make(chan struct{}),
+	}
+	if usePty {
+		var master io.ReadWriteCloser
+		if master, err = startWithPty(e.cmd); err != nil {
+			return nil, fmt.Errorf("unable to start %s: %v", command, err)
+		}
+		e.stdin, e.stdout = master, master
+		return e, nil
+	}
+
+	e.cmd.Stderr = os.Stderr
+	setProcessGroup(e.cmd)
+	if e.stdin, err = e.cmd.StdinPipe(); err != nil {
+		ttyc.Trace()
+		return nil, err
+	}
+	if e.stdout, err = e.cmd.StdoutPipe(); err != nil {
+		ttyc.Trace()
+		return nil, err
+	}
+	if err = e.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("unable to start %s: %v", command, err)
+	}
+	return e, nil
+}
+
+// Copies the output of the remote terminal to the program. Once the program stops reading, the output is discarded.
+func (e *execHandler) copyOutput() {
+	stdin := e.stdin
+	for {
+		select {
+		case <-e.client.CloseChan:
+			return
+		case <-e.exited:
+			return
+		case chunk := <-e.client.Output:
+			if stdin == nil {
+				continue
+			}
+			if _, err := stdin.Write(chunk.Data); err != nil {
+				stdin = nil
+			}
+		case <-e.client.WinTitle:
+		case <-e.client.DetectedBaudrate:
+		}
+	}
+}
+
+// Sends the output of the program to the remote terminal until it ends. While disconnected the program is blocked
+// writing, until ttyc reconnects.
+func (e *execHandler) copyInput() {
+	for {
+		buf := make([]byte, 4096)
+		bRead, err := e.stdout.Read(buf)
+		if bRead > 0 {
+			select {
+			case e.client.Input <- buf[:bRead]:
+			case <-e.client.CloseChan:
+				return
+			}
+		}
+		if err != nil {
+			// PTY masters fail with EIO once the program exits
+			return
+		}
+	}
+}
+
+func (e *execHandler) Run(errChan chan<- error) {
+	go e.copyOutput()
+	e.copyInput()
+	err := e.cmd.Wait()
+	close(e.exited)
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.closed {
+		return
+	}
+	status := 0
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		status = exitErr.ExitCode()
+		if waitStatus, ok := exitErr.Sys().(syscall.WaitStatus); ok && waitStatus.Signaled() {
+			// Like shells do
+			status = 128 + int(waitStatus.Signal())
+		}
+	} else if err != nil {
+		errChan <- &ExitStatus{Status: 1, Err: err}
+		return
+	}
+	ttyc.TtycPrintf("The command exited with status %d\n", status)
+	errChan <- &ExitStatus{Status: status}
+}
+
+func (e *execHandler) HandleDisconnect() error {
+	return nil
+}
+
+func (e *execHandler) HandleReconnect() error {
+	return nil
+}
+
+func (e *execHandler) Close() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	select {
+	case <-e.exited:
+	default:
+		// ttyc is quitting before the program
+		_ = killProcessGroup(e.cmd)
+	}
+	return e.stdin.Close()
+}
@@ -0,0 +1,45 @@
+// +build !windows
+// +build !darwin
+
+package handlers
+
+import (
+	"github.com/containerd/console"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// Starts cmd in a new session, which is also a new process group, with a PTY as its controlling terminal, and returns
+// the PTY master
+func startWithPty(cmd *exec.Cmd) (io.ReadWriteCloser, error) {
+	master, slavePath, err := console.NewPty()
+	if err != nil {
+		return nil, err
+	}
+	if err := master.Resize(console.WinSize{Width: 80, Height: 24}); err != nil {
+		_ = master.Close()
+		return nil, err
+	}
+	// The remote terminal echoes and handles line editing already, a cooked PTY would echo the output back to it
+	if err := master.SetRaw(); err != nil {
+		_ = master.Close()
+		return nil, err
+	}
+	slave, err := os.OpenFile(slavePath, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		_ = master.Close()
+		return nil, err
+	}
+	// The parent doesn't need the slave once the program has it
+	defer slave.Close()
+
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	if err := cmd.Start(); err != nil {
+		_ = master.Close()
+		return nil, err
+	}
+	return master, nil
+}
@@ -0,0 +1,13 @@
+// +build windows darwin
+
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+)
+
+func startWithPty(cmd *exec.Cmd) (io.ReadWriteCloser, error) {
+	return nil, fmt.Errorf("PTY mode is not available on this platform")
+}
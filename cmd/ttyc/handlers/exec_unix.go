@@ -0,0 +1,17 @@
+// +build !windows
+
+package handlers
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Runs the program in its own process group, so that it can be stopped together with its children
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+const DefaultFrameGap = 20 * time.Millisecond
+
+// frameSplitter groups the output into frames separated by idle gaps, like the silence between Modbus RTU frames
+type frameSplitter struct {
+	gap   time.Duration
+	data  []byte
+	start time.Time
+	last  time.Time
+}
+
+// add appends a chunk received at the given time. If the gap since the previous chunk is longer than the idle gap,
+// the previous frame is complete and it is returned.
+func (f *frameSplitter) add(data []byte, now time.Time) (frame []byte, start time.Time) {
+	if len(f.data) > 0 && now.Sub(f.last) > f.gap {
+		frame, start = f.flush()
+	}
+	if len(f.data) == 0 {
+		f.start = now
+	}
+	f.data = append(f.data, data...)
+	f.last = now
+	return
+}
+
+// flush returns the pending frame, if any
+func (f *frameSplitter) flush() (frame []byte, start time.Time) {
+	frame, start = f.data, f.start
+	f.data = nil
+	return
+}
+
+// Renders a frame as a header with the time and the length, followed by a hex dump
+func renderFrame(frame []byte, stamp string) []byte {
+	var buf bytes.Buffer
+	_, _ = fmt.Fprintf(&buf, "%s%d bytes\r\n", stamp, len(frame))
+	writeIndentedHexDump(&buf, frame)
+	return buf.Bytes()
+}
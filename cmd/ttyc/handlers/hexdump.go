@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+// Bytes per line, like hexdump -C
+const hexDumpWidth = 16
+
+const (
+	hexDirectionRx = iota
+	hexDirectionTx
+)
+
+var hexDirectionMarkers = [2]string{"RX", "TX"}
+
+// hexDumper renders a byte stream like hexdump -C, redrawing the last line as bytes arrive. Offsets are kept for
+// each direction and continue across chunks, mode changes and reconnections.
+type hexDumper struct {
+	lock    sync.Mutex
+	offsets [2]int64
+	// Current, incomplete line
+	line          []byte
+	lineOffset    int64
+	lineDirection int
+	linePrefix    string
+}
+
+// Writes a line in the hexdump -C format, with up to hexDumpWidth bytes
+func writeHexLine(buf *bytes.Buffer, offset int64, line []byte) {
+	_, _ = fmt.Fprintf(buf, "%08x  ", offset)
+	for i := 0; i < hexDumpWidth; i++ {
+		if i < len(line) {
+			_, _ = fmt.Fprintf(buf, "%02x ", line[i])
+		} else {
+			buf.WriteString("   ")
+		}
+		if i == hexDumpWidth/2-1 {
+			buf.WriteByte(' ')
+		}
+	}
+	buf.WriteString(" |")
+	for _, char := range line {
+		if char >= 32 && char <= 126 {
+			buf.WriteByte(char)
+		} else {
+			buf.WriteByte('.')
+		}
+	}
+	buf.WriteByte('|')
+}
+
+func (h *hexDumper) formatLine(markers bool) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(h.linePrefix)
+	if markers {
+		buf.WriteString(hexDirectionMarkers[h.lineDirection])
+		buf.WriteByte(' ')
+	}
+	writeHexLine(&buf, h.lineOffset, h.line)
+	return buf.Bytes()
+}
+
+// dump renders data, received or sent according to direction. prefix is called when a new line starts, i.e. to
+// add a timestamp. Direction markers are shown if markers is true.
+func (h *hexDumper) dump(direction int, data []byte, markers bool, prefix func() string) []byte {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	var out bytes.Buffer
+	for _, char := range data {
+		if len(h.line) > 0 && h.lineDirection != direction {
+			out.WriteString("\r\n")
+			h.line = h.line[:0]
+		}
+		if len(h.line) == 0 {
+			h.lineOffset = h.offsets[direction]
+			h.lineDirection = direction
+			h.linePrefix = prefix()
+		}
+		h.line = append(h.line, char)
+		h.offsets[direction]++
+		if len(h.line) == hexDumpWidth {
+			out.WriteByte('\r')
+			out.Write(h.formatLine(markers))
+			out.WriteString("\r\n")
+			h.line = h.line[:0]
+		}
+	}
+	if len(h.line) > 0 {
+		out.WriteByte('\r')
+		out.Write(h.formatLine(markers))
+	}
+	return out.Bytes()
+}
+
+// skip accounts for data that was not rendered, so that offsets keep matching the stream
+func (h *hexDumper) skip(direction int, length int) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.offsets[direction] += int64(length)
+}
+
+// finish terminates the current line, if any, i.e. before leaving hex mode
+func (h *hexDumper) finish() []byte {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if len(h.line) == 0 {
+		return nil
+	}
+	h.line = h.line[:0]
+	return []byte("\r\n")
+}
@@ -0,0 +1,268 @@
+package handlers
+
+// Listen mode: the remote terminal is served to raw TCP or telnet clients, like ser2net, so that tools that can only
+// talk to a socket can use it
+
+import (
+	"fmt"
+	"github.com/Depau/ttyc"
+	"github.com/Depau/ttyc/ws"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Chunks of output queued for each client before it is considered stuck and dropped
+const listenConnQueueLen = 256
+
+// Protocols spoken with the clients
+const (
+	ListenRaw = iota
+	ListenTelnet
+	// Telnet with the RFC 2217 com port control option
+	ListenRfc2217
+)
+
+// ListenOptions configures how clients are served
+type ListenOptions struct {
+	Protocol int
+	// Accept any number of clients, sharing the terminal. Otherwise clients are refused while one is connected.
+	Multi bool
+}
+
+type listenConn struct {
+	conn  net.Conn
+	queue chan []byte
+	// nil for raw connections
+	telnet *telnetCodec
+}
+
+type listenHandler struct {
+	client         *ws.Client
+	implementation ttyc.Implementation
+	credentials    *url.Userinfo
+	listener       net.Listener
+	options        *ListenOptions
+	mutex          sync.Mutex
+	conns          map[*listenConn]interface{}
+	closed         bool
+	quit           chan interface{}
+}
+
+// NewListenHandler serves the remote terminal to the clients connecting to listener
+func NewListenHandler(client *ws.Client, implementation ttyc.Implementation, credentials *url.Userinfo, listener net.Listener, options *ListenOptions) (tty TtyHandler, err error) {
+	return &listenHandler{
+		client:         client,
+		implementation: implementation,
+		credentials:    credentials,
+		listener:       listener,
+		options:        options,
+		conns:          map[*listenConn]interface{}{},
+		quit:           make(chan interface{}),
+	}, nil
+}
+
+func (l *listenHandler) acceptLoop(errChan chan<- error) {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			l.mutex.Lock()
+			defer l.mutex.Unlock()
+			if !l.closed {
+				errChan <- fmt.Errorf("listener error: %v", err)
+			}
+			return
+		}
+		go l.serve(conn)
+	}
+}
+
+func (l *listenHandler) serve(conn net.Conn) {
+	defer conn.Close()
+	c := &listenConn{conn: conn, queue: make(chan []byte, listenConnQueueLen)}
+	if l.options.Protocol == ListenTelnet || l.options.Protocol == ListenRfc2217 {
+		c.telnet = newTelnetCodec()
+		if l.options.Protocol == ListenRfc2217 {
+			c.telnet.remoteSupported[telnetOptComPort] = true
+		}
+		c.telnet.onCommand = func(command byte) {
+			if command == telnetBRK {
+				l.client.SendBreak()
+			}
+		}
+		c.telnet.onSubnegotiation = func(option byte, params []byte) {
+			switch {
+			case option == telnetOptNAWS && len(params) == 4:
+				cols, rows := int(params[0])<<8|int(params[1]), int(params[2])<<8|int(params[3])
+				if cols > 0 && rows > 0 {
+					l.client.ResizeTerminal(cols, rows)
+				}
+			case option == telnetOptComPort:
+				l.handleComPort(c, params)
+			}
+		}
+	}
+
+	if err := l.addConn(c); err != nil {
+		ttyc.TtycFprintf(conn, "%v\r\n", err)
+		return
+	}
+	defer l.removeConn(c)
+	ttyc.TtycPrintf("Client connected from %s\n", conn.RemoteAddr())
+	defer ttyc.TtycPrintf("Client %s disconnected\n", conn.RemoteAddr())
+
+	if c.telnet != nil {
+		c.telnet.start()
+		l.send(c, c.telnet.takeReplies())
+	}
+	go l.writeLoop(c)
+	l.readLoop(c)
+}
+
+func (l *listenHandler) readLoop(c *listenConn) {
+	for {
+		buf := make([]byte, 4096)
+		bRead, err := c.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		data := buf[:bRead]
+		if c.telnet != nil {
+			data = c.telnet.decode(data)
+			// Replies to the negotiations are queued like the output
+			if replies := c.telnet.takeReplies(); len(replies) > 0 {
+				l.send(c, replies)
+			}
+		}
+		if len(data) == 0 {
+			continue
+		}
+		// While ttyc is reconnecting, the client is blocked sending
+		select {
+		case l.client.Input <- data:
+		case <-l.quit:
+			return
+		}
+	}
+}
+
+func (l *listenHandler) writeLoop(c *listenConn) {
+	// Unblocks the read loop once the connection is dropped
+	defer c.conn.Close()
+	for data := range c.queue {
+		if _, err := c.conn.Write(data); err != nil {
+			l.removeConn(c)
+			return
+		}
+	}
+}
+
+func (l *listenHandler) addConn(c *listenConn) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return fmt.Errorf("ttyc is shutting down")
+	}
+	if !l.options.Multi && len(l.conns) > 0 {
+		return fmt.Errorf("another client is connected")
+	}
+	l.conns[c] = nil
+	return nil
+}
+
+func (l *listenHandler) removeConn(c *listenConn) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.removeConnLocked(c)
+}
+
+func (l *listenHandler) removeConnLocked(c *listenConn) {
+	if _, ok := l.conns[c]; ok {
+		delete(l.conns, c)
+		close(c.queue)
+	}
+}
+
+// Queues data, already encoded, for a client. Must be called with the mutex held.
+func (l *listenHandler) sendLocked(c *listenConn, data []byte) {
+	if _, ok := l.conns[c]; !ok {
+		return
+	}
+	select {
+	case c.queue <- data:
+	default:
+		// Client is stuck, drop it instead of stalling everyone else
+		l.removeConnLocked(c)
+	}
+}
+
+func (l *listenHandler) send(c *listenConn, data []byte) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.sendLocked(c, data)
+}
+
+func (l *listenHandler) broadcast(data []byte) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for c := range l.conns {
+		if c.telnet != nil {
+			l.sendLocked(c, telnetEscape(data))
+		} else {
+			l.sendLocked(c, data)
+		}
+	}
+}
+
+// Sends a ttyc status line to the clients
+func (l *listenHandler) status(format string, args ...interface{}) {
+	var sb strings.Builder
+	sb.WriteString("\r\n")
+	ttyc.TtycFprintf(&sb, format, args...)
+	sb.WriteString("\r\n")
+	l.broadcast([]byte(sb.String()))
+}
+
+func (l *listenHandler) Run(errChan chan<- error) {
+	go l.acceptLoop(errChan)
+	for {
+		select {
+		case <-l.client.CloseChan:
+			return
+		case <-l.quit:
+			return
+		case chunk := <-l.client.Output:
+			l.broadcast(chunk.Data)
+		case <-l.client.WinTitle:
+		case <-l.client.DetectedBaudrate:
+		}
+	}
+}
+
+func (l *listenHandler) HandleDisconnect() error {
+	l.status("Server disconnected")
+	return nil
+}
+
+func (l *listenHandler) HandleReconnect() error {
+	l.status("Reconnected")
+	return nil
+}
+
+func (l *listenHandler) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	close(l.quit)
+	for c := range l.conns {
+		l.removeConnLocked(c)
+	}
+	return l.listener.Close()
+}
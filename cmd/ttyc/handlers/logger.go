@@ -0,0 +1,359 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/Depau/ttyc"
+	"github.com/Depau/ttyc/decoders"
+	"github.com/lestrrat-go/strftime"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// Bytes exactly as received from the server
+	LogFormatRaw = "raw"
+	// Lines prefixed with the time they were received, without escape sequences, with connection events
+	LogFormatText = "text"
+)
+
+const logTimestampLayout = "2006-01-02 15:04:05.000"
+
+// File name pattern used when logging is started interactively and no pattern was provided
+const DefaultLogPattern = "ttyc_%Y-%m-%dT%H-%M-%S.log"
+
+// Highest <name>.<n> tried when renaming a log file on rotation
+const maxRotatedLogs = 10000
+
+type LogOptions struct {
+	// File name pattern used by Toggle
+	Pattern string
+	Format  string
+	// Start a new file when the current one reaches this size, 0 to disable
+	RotateSize int64
+	// Start a new file after this time, 0 to disable
+	RotateInterval time.Duration
+	// Protocol decoder whose frames replace the output lines in text logs, empty to log the output as text
+	Decoder string
+	// Idle gap that completes the frames of protocols delimited by silence
+	DecoderGap time.Duration
+	// Remote charset, converted to UTF-8 in text logs; nil for UTF-8
+	Charset *Charset
+}
+
+// SessionLogger writes the output of the remote terminal to a file while it is started. File names are strftime
+// patterns, expanded every time a file is opened.
+type SessionLogger struct {
+	lock     sync.Mutex
+	options  LogOptions
+	file     *os.File
+	pattern  string
+	path     string
+	size     int64
+	openedAt time.Time
+	text     textLogRenderer
+	decoder  *decoders.Stream
+	err      error
+}
+
+func NewSessionLogger(hub *EventHub, options LogOptions) *SessionLogger {
+	if options.Pattern == "" {
+		options.Pattern = DefaultLogPattern
+	}
+	if options.Format == "" {
+		options.Format = LogFormatText
+	}
+	l := &SessionLogger{options: options}
+	hub.AddListener(l.handleEvent)
+	return l
+}
+
+// Start logs to the file named after the given strftime pattern, appending to it if it exists
+func (l *SessionLogger) Start(pattern string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.file != nil {
+		return fmt.Errorf("already logging to %s", l.path)
+	}
+	if _, err := strftime.New(pattern); err != nil {
+		return fmt.Errorf("invalid log file name: %v", err)
+	}
+	l.pattern = pattern
+	return l.open(time.Now())
+}
+
+// Toggle stops logging if started, otherwise starts logging to the configured pattern. It returns the file that was
+// being logged to or that is now being logged to.
+func (l *SessionLogger) Toggle() (path string, started bool, err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.file != nil {
+		path = l.path
+		err = l.close()
+		return
+	}
+	l.pattern = l.options.Pattern
+	err = l.open(time.Now())
+	return l.path, err == nil, err
+}
+
+func (l *SessionLogger) Stop() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.close()
+}
+
+// Path returns the file currently being logged to, or an empty string if the logger is stopped
+func (l *SessionLogger) Path() string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.path
+}
+
+// Err returns why logging stopped on its own, i.e. because the disk is full, or nil if it didn't since it was last
+// started
+func (l *SessionLogger) Err() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.err
+}
+
+func (l *SessionLogger) open(now time.Time) error {
+	path, err := strftime.Format(l.pattern, now)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	l.file = file
+	l.path = path
+	l.err = nil
+	l.size = info.Size()
+	l.openedAt = now
+	l.text = textLogRenderer{}
+	l.decoder = nil
+	if l.options.Decoder != "" && l.options.Format == LogFormatText {
+		if l.decoder, err = decoders.NewStream(l.options.Decoder, l.options.DecoderGap); err != nil {
+			_ = file.Close()
+			l.file = nil
+			l.path = ""
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *SessionLogger) close() error {
+	if l.file == nil {
+		return nil
+	}
+	if l.decoder != nil {
+		l.writeDecoded(l.decoder.Idle())
+	} else if l.options.Format == LogFormatText {
+		l.write(l.text.flush())
+	}
+	if l.file == nil {
+		// The last write failed and stopped logging already
+		return l.err
+	}
+	err := l.file.Close()
+	l.file = nil
+	l.path = ""
+	return err
+}
+
+// Closes the current file and opens a new one. If the pattern expands to the same name, i.e. because it has no time
+// fields, the current file is renamed to the first free <name>.<n>.
+func (l *SessionLogger) rotate(now time.Time) error {
+	oldPath := l.path
+	if err := l.close(); err != nil {
+		return err
+	}
+	if newPath, err := strftime.Format(l.pattern, now); err == nil && newPath == oldPath {
+		rotated := false
+		for n := 1; n <= maxRotatedLogs && !rotated; n++ {
+			rotatedPath := fmt.Sprintf("%s.%d", oldPath, n)
+			if _, err := os.Stat(rotatedPath); os.IsNotExist(err) {
+				if err := os.Rename(oldPath, rotatedPath); err != nil {
+					return err
+				}
+				rotated = true
+			} else if err != nil {
+				return err
+			}
+		}
+		if !rotated {
+			return fmt.Errorf("unable to rotate %s, %s.1 to %s.%d already exist", oldPath, oldPath, oldPath, maxRotatedLogs)
+		}
+	}
+	return l.open(now)
+}
+
+func (l *SessionLogger) needsRotation(now time.Time) bool {
+	if l.options.RotateSize > 0 && l.size >= l.options.RotateSize {
+		return true
+	}
+	return l.options.RotateInterval > 0 && now.Sub(l.openedAt) >= l.options.RotateInterval
+}
+
+func (l *SessionLogger) write(data []byte) {
+	if l.file == nil || len(data) == 0 {
+		return
+	}
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	if err != nil {
+		l.fail(l.path, err)
+	}
+}
+
+// Stops logging after a failure that no caller is waiting for, reporting it to the user instead
+func (l *SessionLogger) fail(path string, err error) {
+	if l.file != nil {
+		_ = l.file.Close()
+	}
+	l.file = nil
+	l.path = ""
+	l.err = fmt.Errorf("logging to %s stopped: %v", path, err)
+	ttyc.TtycAngryPrintf("Logging to %s stopped: %v\r\n", path, err)
+}
+
+func (l *SessionLogger) handleEvent(event *Event) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.file == nil {
+		return
+	}
+	if l.needsRotation(event.Time) {
+		path := l.path
+		if err := l.rotate(event.Time); err != nil {
+			// Failed writes were reported already
+			if l.err == nil {
+				l.fail(path, err)
+			}
+			return
+		}
+	}
+
+	switch event.Type {
+	case EventOutput:
+		if l.options.Format == LogFormatRaw {
+			l.write(event.Data)
+		} else if l.decoder != nil {
+			// Frames delimited by silence are completed by the next chunk, since there is no timer
+			l.writeDecoded(l.decoder.Feed(event.Data, event.Time))
+		} else if l.options.Charset != nil {
+			l.write(l.text.render(event.Time, l.options.Charset.Decode(event.Data)))
+		} else {
+			l.write(l.text.render(event.Time, event.Data))
+		}
+	case EventDisconnected:
+		if l.options.Format == LogFormatText {
+			l.write(l.text.marker(event.Time, "Disconnected: "+event.Message))
+		}
+	case EventReconnected:
+		if l.options.Format == LogFormatText {
+			l.write(l.text.marker(event.Time, "Reconnected"))
+		}
+	}
+}
+
+func (l *SessionLogger) writeDecoded(frames []decoders.Frame) {
+	for _, frame := range frames {
+		l.write(logDecodedFrame(l.decoder.Name, frame))
+	}
+}
+
+// Terminal output parser states
+const (
+	textStateNormal = iota
+	textStateEscape
+	textStateCsi
+	textStateOsc
+	textStateOscEscape
+)
+
+// textLogRenderer turns terminal output into plain text lines prefixed with the time they started, dropping escape
+// sequences and carriage returns
+type textLogRenderer struct {
+	line      bytes.Buffer
+	lineStart time.Time
+	state     int
+}
+
+func (r *textLogRenderer) render(now time.Time, data []byte) []byte {
+	var out bytes.Buffer
+	for _, char := range data {
+		switch r.state {
+		case textStateEscape:
+			switch char {
+			case '[':
+				r.state = textStateCsi
+			case ']':
+				r.state = textStateOsc
+			default:
+				r.state = textStateNormal
+			}
+			continue
+		case textStateCsi:
+			// Parameters and intermediate bytes until the final byte
+			if char >= 0x40 && char <= 0x7e {
+				r.state = textStateNormal
+			}
+			continue
+		case textStateOsc:
+			if char == 0x07 {
+				r.state = textStateNormal
+			} else if char == 0x1b {
+				r.state = textStateOscEscape
+			}
+			continue
+		case textStateOscEscape:
+			r.state = textStateNormal
+			continue
+		}
+
+		switch {
+		case char == 0x1b:
+			r.state = textStateEscape
+		case char == '\n':
+			out.Write(r.flushLine(now))
+		case char == '\t' || char >= 0x20 && char != 0x7f:
+			if r.line.Len() == 0 {
+				r.lineStart = now
+			}
+			r.line.WriteByte(char)
+		}
+	}
+	return out.Bytes()
+}
+
+func (r *textLogRenderer) flushLine(now time.Time) []byte {
+	if r.line.Len() == 0 {
+		r.lineStart = now
+	}
+	line := fmt.Sprintf("[%s] %s\n", r.lineStart.Format(logTimestampLayout), r.line.String())
+	r.line.Reset()
+	return []byte(line)
+}
+
+// Terminates the pending line, if any
+func (r *textLogRenderer) flush() []byte {
+	if r.line.Len() == 0 {
+		return nil
+	}
+	return r.flushLine(time.Now())
+}
+
+func (r *textLogRenderer) marker(now time.Time, message string) []byte {
+	pending := r.flush()
+	return append(pending, []byte(fmt.Sprintf("[%s] --- %s ---\n", now.Format(logTimestampLayout), message))...)
+}
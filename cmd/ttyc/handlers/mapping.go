@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Character mapping flags, named after the tio --map flags. I flags apply to the data received from the server,
+// O flags to the data sent to it.
+const (
+	// Map CR to NL, unless IGNCR is set
+	MapICRNL = "ICRNL"
+	// Ignore CR
+	MapIGNCR = "IGNCR"
+	// Map NL to CR
+	MapINLCR = "INLCR"
+	// Map NL to CR NL
+	MapINLCRNL = "INLCRNL"
+	// Map CR to NL
+	MapOCRNL = "OCRNL"
+	// Map NL to CR NL
+	MapONLCR = "ONLCR"
+	// Map DEL to BS
+	MapODELBS = "ODELBS"
+	// Map BS to DEL; together with ODELBS, backspace and delete are swapped
+	MapOBSDEL = "OBSDEL"
+)
+
+var MapFlags = []string{MapICRNL, MapIGNCR, MapINLCR, MapINLCRNL, MapOCRNL, MapONLCR, MapODELBS, MapOBSDEL}
+
+// Mapping translates line endings and other characters in the data received from and sent to the server
+type Mapping struct {
+	flags map[string]bool
+}
+
+// ParseMapping parses a comma separated list of flags, i.e. "ICRNL,ONLCR". An empty list maps nothing.
+func ParseMapping(spec string) (*Mapping, error) {
+	m := &Mapping{flags: map[string]bool{}}
+	for _, flag := range strings.Split(spec, ",") {
+		flag = strings.ToUpper(strings.TrimSpace(flag))
+		if flag == "" {
+			continue
+		}
+		// tio name
+		if flag == "ONLCRNL" {
+			flag = MapONLCR
+		}
+		valid := false
+		for _, f := range MapFlags {
+			if f == flag {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("invalid mapping flag: %s", flag)
+		}
+		m.flags[flag] = true
+	}
+	return m, nil
+}
+
+// IsEmpty returns true if nothing is mapped
+func (m *Mapping) IsEmpty() bool {
+	return len(m.flags) == 0
+}
+
+func (m *Mapping) String() string {
+	var flags []string
+	for _, flag := range MapFlags {
+		if m.flags[flag] {
+			flags = append(flags, flag)
+		}
+	}
+	if len(flags) == 0 {
+		return "none"
+	}
+	return strings.Join(flags, ",")
+}
+
+// MapOutput maps the data received from the server. The buffer is not modified.
+func (m *Mapping) MapOutput(data []byte) []byte {
+	if !m.flags[MapICRNL] && !m.flags[MapIGNCR] && !m.flags[MapINLCR] && !m.flags[MapINLCRNL] {
+		return data
+	}
+	out := make([]byte, 0, len(data))
+	for _, char := range data {
+		switch {
+		case char == '\r' && m.flags[MapIGNCR]:
+		case char == '\r' && m.flags[MapICRNL]:
+			out = append(out, '\n')
+		case char == '\n' && m.flags[MapINLCRNL]:
+			out = append(out, '\r', '\n')
+		case char == '\n' && m.flags[MapINLCR]:
+			out = append(out, '\r')
+		default:
+			out = append(out, char)
+		}
+	}
+	return out
+}
+
+// MapInput maps the data sent to the server. The buffer is not modified.
+func (m *Mapping) MapInput(data []byte) []byte {
+	if !m.flags[MapOCRNL] && !m.flags[MapONLCR] && !m.flags[MapODELBS] && !m.flags[MapOBSDEL] {
+		return data
+	}
+	out := make([]byte, 0, len(data))
+	for _, char := range data {
+		switch {
+		case char == '\r' && m.flags[MapOCRNL]:
+			out = append(out, '\n')
+		case char == '\n' && m.flags[MapONLCR]:
+			out = append(out, '\r', '\n')
+		case char == 0x7f && m.flags[MapODELBS]:
+			out = append(out, '\b')
+		case char == '\b' && m.flags[MapOBSDEL]:
+			out = append(out, 0x7f)
+		default:
+			out = append(out, char)
+		}
+	}
+	return out
+}
@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Pacing slows down the text sent from files and, with the paste guard, pasted text, so that slow devices with small
+// receive buffers don't drop characters
+type Pacing struct {
+	CharDelay time.Duration
+	LineDelay time.Duration
+	// Wait for each line to be echoed before sending the next one
+	WaitEcho bool
+	// Wait for the output to match this after each line, if set
+	Prompt *regexp.Regexp
+	// Time after which waiting for the echo or the prompt fails
+	WaitTimeout time.Duration
+}
+
+// IsZero returns true if the text is sent as fast as possible
+func (p *Pacing) IsZero() bool {
+	return p.CharDelay == 0 && p.LineDelay == 0 && !p.WaitEcho && p.Prompt == nil
+}
+
+func (p *Pacing) String() string {
+	if p.IsZero() {
+		return "none"
+	}
+	description := fmt.Sprintf("%v per character, %v per line", p.CharDelay, p.LineDelay)
+	if p.WaitEcho {
+		description += ", waiting for the echo"
+	}
+	if p.Prompt != nil {
+		description += fmt.Sprintf(", waiting for /%s/", p.Prompt)
+	}
+	return description
+}
+
+// Output kept to look for the echo and the prompt
+const maxPacedOutput = 64 * 1024
+
+// pacedSender sends text line by line as configured, looking at the output fed to it to find the echo and the prompt
+type pacedSender struct {
+	pacing Pacing
+	send   func(data []byte) error
+	mutex  sync.Mutex
+	// Output received since the current line started being sent
+	received []byte
+	// Signaled when output is received
+	notify     chan struct{}
+	canceled   chan struct{}
+	cancelOnce sync.Once
+}
+
+func newPacedSender(pacing Pacing, send func(data []byte) error) *pacedSender {
+	return &pacedSender{
+		pacing:   pacing,
+		send:     send,
+		notify:   make(chan struct{}, 1),
+		canceled: make(chan struct{}),
+	}
+}
+
+func (p *pacedSender) observe(data []byte) {
+	p.mutex.Lock()
+	p.received = append(p.received, data...)
+	if len(p.received) > maxPacedOutput {
+		p.received = p.received[len(p.received)-maxPacedOutput:]
+	}
+	p.mutex.Unlock()
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (p *pacedSender) cancel() {
+	p.cancelOnce.Do(func() {
+		close(p.canceled)
+	})
+}
+
+// Returns false if canceled
+func (p *pacedSender) sleep(delay time.Duration) bool {
+	if delay <= 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-p.canceled:
+		return false
+	}
+}
+
+// Waits until the output received since the line started being sent satisfies done
+func (p *pacedSender) waitFor(what string, done func(received []byte) bool) error {
+	timer := time.NewTimer(p.pacing.WaitTimeout)
+	defer timer.Stop()
+	for {
+		p.mutex.Lock()
+		ok := done(p.received)
+		p.mutex.Unlock()
+		if ok {
+			return nil
+		}
+		select {
+		case <-p.notify:
+		case <-timer.C:
+			return fmt.Errorf("timed out waiting for the %s", what)
+		case <-p.canceled:
+			return errPacingCanceled
+		}
+	}
+}
+
+var errPacingCanceled = errors.New("canceled")
+
+// Sends text, which may be a whole file. Line endings are sent as CR, like the Enter key does.
+func (p *pacedSender) run(text []byte) error {
+	text = bytes.ReplaceAll(text, []byte("\r\n"), []byte("\r"))
+	text = bytes.ReplaceAll(text, []byte("\n"), []byte("\r"))
+	for len(text) > 0 {
+		line := text
+		complete := false
+		if end := bytes.IndexByte(text, '\r'); end >= 0 {
+			line = text[:end+1]
+			complete = true
+		}
+		text = text[len(line):]
+
+		p.mutex.Lock()
+		p.received = p.received[:0]
+		p.mutex.Unlock()
+		if p.pacing.CharDelay == 0 {
+			if err := p.send(line); err != nil {
+				return err
+			}
+		} else {
+			for rest := line; len(rest) > 0; {
+				_, size := utf8.DecodeRune(rest)
+				if err := p.send(rest[:size]); err != nil {
+					return err
+				}
+				rest = rest[size:]
+				if !p.sleep(p.pacing.CharDelay) {
+					return errPacingCanceled
+				}
+			}
+		}
+		if !complete {
+			break
+		}
+
+		if echo := bytes.TrimSuffix(line, []byte("\r")); p.pacing.WaitEcho {
+			err := p.waitFor("echo", func(received []byte) bool {
+				if len(echo) == 0 {
+					return len(received) > 0
+				}
+				return containsInOrder(received, echo)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if p.pacing.Prompt != nil {
+			if err := p.waitFor("prompt", p.pacing.Prompt.Match); err != nil {
+				return err
+			}
+		}
+		if !p.sleep(p.pacing.LineDelay) {
+			return errPacingCanceled
+		}
+	}
+	return nil
+}
+
+// Returns true if the bytes of echo appear in data in the same order. Other output may be mixed with the echo, such
+// as messages printed by the device or the escape sequences of shells with syntax highlighting.
+func containsInOrder(data []byte, echo []byte) bool {
+	for _, char := range data {
+		if len(echo) == 0 {
+			break
+		}
+		if char == echo[0] {
+			echo = echo[1:]
+		}
+	}
+	return len(echo) == 0
+}
@@ -19,6 +19,7 @@ type ptyHandler struct {
 	client    *ws.Client
 	pty       console.Console
 	slavePath string
+	linkPath  string
 }
 
 func NewPtyHandler(client *ws.Client, linkTo string) (tty TtyHandler, err error) {
@@ -42,9 +43,12 @@ func NewPtyHandler(client *ws.Client, linkTo string) (tty TtyHandler, err error)
 		ttyc.Trace()
 		return nil, err
 	}
+	linkPath := linkTo
 	if err = os.Symlink(slavePath, linkTo); err != nil {
 		ttyc.TtycAngryPrintf("Warning: unaable to create link to %s as requested: %v\n", linkTo, err)
 		ttyc.TtycAngryPrintf("You can still access it at %s\n", slavePath)
+		linkPath = ""
+		err = nil
 	} else {
 		ttyc.TtycPrintf("TTY connected to remote terminal, available at %s\n", linkTo)
 	}
@@ -52,14 +56,34 @@ func NewPtyHandler(client *ws.Client, linkTo string) (tty TtyHandler, err error)
 	tty = &ptyHandler{
 		client:    client,
 		slavePath: slavePath,
+		linkPath:  linkPath,
 		pty:       pty,
 	}
 
 	return
 }
 
+func (p *ptyHandler) copyOutput(errChan chan<- error) {
+	for {
+		select {
+		case <-p.client.CloseChan:
+			return
+		case chunk := <-p.client.Output:
+			written := 0
+			for written < len(chunk.Data) {
+				bWritten, err := p.pty.Write(chunk.Data[written:])
+				if err != nil {
+					errChan <- err
+					return
+				}
+				written += bWritten
+			}
+		}
+	}
+}
+
 func (p *ptyHandler) Run(errChan chan<- error) {
-	go utils.CopyChanToWriter(p.client.CloseChan, p.client.Output, p.pty, errChan)
+	go p.copyOutput(errChan)
 	go utils.CopyReaderToChan(p.client.CloseChan, p.pty, p.client.Input, errChan)
 	for {
 		select {
@@ -92,5 +116,10 @@ func (p *ptyHandler) HandleReconnect() error {
 }
 
 func (p *ptyHandler) Close() error {
+	if p.linkPath != "" {
+		// Don't leave a dangling symlink behind
+		_ = os.Remove(p.linkPath)
+		p.linkPath = ""
+	}
 	return p.pty.Close()
 }
@@ -0,0 +1,148 @@
+package handlers
+
+// Session recording in the asciinema v2 format: https://docs.asciinema.org/manual/asciicast/v2/
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+type AsciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Recorder writes the output, and optionally the input, of the remote terminal to an asciicast file, along with
+// terminal resizes and connection events as markers
+type Recorder struct {
+	lock        sync.Mutex
+	file        *os.File
+	start       time.Time
+	recordInput bool
+	// Remote charset, converted to UTF-8; nil for UTF-8
+	charset *Charset
+	// Incomplete UTF-8 sequences at the end of the last chunk, completed by the next one
+	pendingOutput  []byte
+	pendingInput   []byte
+	removeListener func()
+}
+
+// NewRecorder creates the file and writes the header; Version and Timestamp are filled in if not set
+func NewRecorder(hub *EventHub, path string, header AsciicastHeader, recordInput bool, charset *Charset) (*Recorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{
+		file:        file,
+		start:       time.Now(),
+		recordInput: recordInput,
+		charset:     charset,
+	}
+	if header.Version == 0 {
+		header.Version = 2
+	}
+	if header.Timestamp == 0 {
+		header.Timestamp = r.start.Unix()
+	}
+	if err := r.writeLine(&header); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	r.removeListener = hub.AddListener(r.handleEvent)
+	return r, nil
+}
+
+func (r *Recorder) Close() error {
+	r.removeListener()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+func (r *Recorder) writeLine(value interface{}) error {
+	line, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = r.file.Write(append(line, '\n'))
+	return err
+}
+
+func (r *Recorder) writeEvent(t time.Time, code string, data string) {
+	elapsed := float64(t.Sub(r.start).Microseconds()) / 1e6
+	if err := r.writeLine([]interface{}{elapsed, code, data}); err != nil {
+		_ = r.file.Close()
+		r.file = nil
+	}
+}
+
+// Splits off the trailing bytes of data that may be the beginning of a multi-byte character
+func splitIncompleteRune(data []byte) (complete []byte, incomplete []byte) {
+	for i := 1; i < utf8.UTFMax && i <= len(data); i++ {
+		start := len(data) - i
+		if !utf8.RuneStart(data[start]) {
+			continue
+		}
+		if !utf8.FullRune(data[start:]) {
+			return data[:start], append([]byte{}, data[start:]...)
+		}
+		break
+	}
+	return data, nil
+}
+
+func (r *Recorder) toUtf8(data []byte) []byte {
+	if r.charset == nil {
+		return data
+	}
+	return r.charset.Decode(data)
+}
+
+func (r *Recorder) handleEvent(event *Event) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file == nil {
+		return
+	}
+
+	switch event.Type {
+	case EventOutput:
+		var data []byte
+		data, r.pendingOutput = splitIncompleteRune(append(r.pendingOutput, r.toUtf8(event.Data)...))
+		if len(data) > 0 {
+			r.writeEvent(event.Time, "o", string(data))
+		}
+	case EventInput:
+		if !r.recordInput {
+			return
+		}
+		var data []byte
+		data, r.pendingInput = splitIncompleteRune(append(r.pendingInput, r.toUtf8(event.Data)...))
+		if len(data) > 0 {
+			r.writeEvent(event.Time, "i", string(data))
+		}
+	case EventResize:
+		if event.Columns <= 0 || event.Rows <= 0 {
+			return
+		}
+		r.writeEvent(event.Time, "r", fmt.Sprintf("%dx%d", event.Columns, event.Rows))
+	case EventDisconnected:
+		r.writeEvent(event.Time, "m", "Disconnected: "+event.Message)
+	case EventReconnected:
+		r.writeEvent(event.Time, "m", "Reconnected")
+	}
+}
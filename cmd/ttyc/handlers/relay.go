@@ -0,0 +1,180 @@
+package handlers
+
+// Relay handlers: keep draining the remote terminal into a scrollback buffer and serve it over the ttyd protocol to
+// any number of downstream clients. Used for detached sessions and for sharing a session with other users.
+
+import (
+	"fmt"
+	"github.com/Depau/ttyc"
+	"github.com/Depau/ttyc/utils"
+	"github.com/Depau/ttyc/ws"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// ShareOptions configures who can connect to a shared session and what they are allowed to do
+type ShareOptions struct {
+	Scrollback int
+	// Allow clients connecting to the main endpoint to type and change the UART parameters
+	ReadWrite bool
+	// Optional credentials required to connect to the main endpoint
+	ViewCredentials *url.Userinfo
+	// If set, a read-write endpoint is served under /rw/ to clients providing these credentials
+	RwCredentials *url.Userinfo
+}
+
+type relayHandler struct {
+	client      *ws.Client
+	credentials *url.Userinfo
+	listener    net.Listener
+	httpServer  *http.Server
+	server      *ws.Server
+	quit        chan interface{}
+	quitOnce    sync.Once
+}
+
+func newRelayHandler(client *ws.Client, credentials *url.Userinfo, server string, listener net.Listener, scrollback int) *relayHandler {
+	d := &relayHandler{
+		client:      client,
+		credentials: credentials,
+		listener:    listener,
+		quit:        make(chan interface{}),
+	}
+	d.server = ws.NewServer(d, server, scrollback)
+	return d
+}
+
+// NewDetachedHandler serves the session to the ttyc clients attaching to it through the listener, which is expected
+// to be only accessible by the current user.
+func NewDetachedHandler(client *ws.Client, credentials *url.Userinfo, server string, listener net.Listener, scrollback int) (tty TtyHandler, err error) {
+	d := newRelayHandler(client, credentials, server, listener, scrollback)
+	endpoint := d.newEndpoint(false)
+	endpoint.Handle("/quit", http.HandlerFunc(d.serveQuit))
+	d.httpServer = &http.Server{Handler: endpoint}
+	return d, nil
+}
+
+// NewShareHandler serves the session to any ttyd client, such as ttyc or Wi-Se web UI instances, connecting to the
+// listener.
+func NewShareHandler(client *ws.Client, credentials *url.Userinfo, server string, listener net.Listener, options *ShareOptions) (tty TtyHandler, err error) {
+	d := newRelayHandler(client, credentials, server, listener, options.Scrollback)
+	mux := http.NewServeMux()
+	mux.Handle("/", requireAuthExceptWs(d.newEndpoint(!options.ReadWrite), options.ViewCredentials))
+	if options.RwCredentials != nil {
+		mux.Handle("/rw/", http.StripPrefix("/rw", requireAuthExceptWs(d.newEndpoint(false), options.RwCredentials)))
+	}
+	d.httpServer = &http.Server{Handler: mux}
+	return d, nil
+}
+
+// The WebSocket can't be protected with basic auth since most clients don't send credentials when connecting to it.
+// It is protected anyway by the token, which is only handed out to authenticated clients.
+func requireAuthExceptWs(handler http.Handler, credentials *url.Userinfo) http.Handler {
+	protected := utils.RequireBasicAuth(handler, credentials, "ttyc")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ws" {
+			handler.ServeHTTP(w, r)
+		} else {
+			protected.ServeHTTP(w, r)
+		}
+	})
+}
+
+func (d *relayHandler) newEndpoint(readOnly bool) *ws.ServerEndpoint {
+	endpoint := d.server.NewEndpoint(readOnly)
+	endpoint.Handle("/stty", d.proxyTo(ttyc.UrlForStty, readOnly))
+	endpoint.Handle("/stats", d.proxyTo(ttyc.UrlForStats, readOnly))
+	return endpoint
+}
+
+func (d *relayHandler) proxyTo(urlFor int, readOnly bool) http.Handler {
+	upstream := ttyc.GetUrlFor(urlFor, d.client.BaseUrl)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if readOnly && r.Method != http.MethodGet {
+			http.Error(w, "read-only client", http.StatusForbidden)
+			return
+		}
+		utils.ProxyRequest(w, r, upstream, d.credentials)
+	})
+}
+
+func (d *relayHandler) serveQuit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	d.quitOnce.Do(func() { close(d.quit) })
+}
+
+// Sends a ttyc status line to the downstream clients and to the scrollback
+func (d *relayHandler) status(format string, args ...interface{}) {
+	var sb strings.Builder
+	sb.WriteString("\r\n")
+	ttyc.TtycFprintf(&sb, format, args...)
+	sb.WriteString("\r\n")
+	d.server.Output([]byte(sb.String()))
+}
+
+func (d *relayHandler) Run(errChan chan<- error) {
+	go func() {
+		if err := d.httpServer.Serve(d.listener); err != nil && err != http.ErrServerClosed {
+			errChan <- fmt.Errorf("session socket error: %v", err)
+		}
+	}()
+
+	for {
+		select {
+		case <-d.client.CloseChan:
+			return
+		case <-d.quit:
+			errChan <- fmt.Errorf("session stopped by attached client")
+			return
+		case chunk := <-d.client.Output:
+			d.server.Output(chunk.Data)
+		case <-d.client.WinTitle:
+		case baudResult := <-d.client.DetectedBaudrate:
+			d.server.DetectedBaudrate(baudResult)
+		}
+	}
+}
+
+func (d *relayHandler) HandleInput(data []byte) {
+	// Copy since the server may reuse the buffer
+	d.client.Input <- append([]byte{}, data...)
+}
+
+func (d *relayHandler) HandleResize(cols int, rows int) {
+	d.client.ResizeTerminal(cols, rows)
+}
+
+func (d *relayHandler) HandleBreak() {
+	d.client.SendBreak()
+}
+
+func (d *relayHandler) HandleDetectBaudrate() {
+	d.client.RequestBaudrateDetection()
+}
+
+func (d *relayHandler) HandleDisconnect() error {
+	select {
+	case <-d.quit:
+		d.status("Session stopped")
+	default:
+		d.status("Server disconnected")
+	}
+	return nil
+}
+
+func (d *relayHandler) HandleReconnect() error {
+	d.status("Reconnected")
+	return nil
+}
+
+func (d *relayHandler) Close() error {
+	d.server.Close()
+	return d.httpServer.Close()
+}
@@ -0,0 +1,178 @@
+package handlers
+
+// RFC 2217 (Telnet Com Port Control Option) server, so that clients such as pyserial and esptool can change the remote
+// UART parameters of a Wi-Se through the listener
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/Depau/ttyc"
+)
+
+const telnetOptComPort = 44
+
+// Commands sent by the clients. Servers reply with the same command plus comPortServerOffset.
+const (
+	comPortSignature         = 0
+	comPortSetBaudrate       = 1
+	comPortSetDatasize       = 2
+	comPortSetParity         = 3
+	comPortSetStopsize       = 4
+	comPortSetControl        = 5
+	comPortNotifyLinestate   = 6
+	comPortNotifyModemstate  = 7
+	comPortSetLinestateMask  = 10
+	comPortSetModemstateMask = 11
+	comPortPurgeData         = 12
+
+	comPortServerOffset = 100
+)
+
+// SET-PARITY values
+const (
+	comPortParityNone = 1
+	comPortParityOdd  = 2
+	comPortParityEven = 3
+)
+
+// SET-CONTROL values
+const (
+	comPortControlFlowRequest = 0
+	comPortControlNoFlow      = 1
+	comPortControlBreakOn     = 5
+)
+
+// CTS, DSR and CD. The modem lines are not available, report them as asserted so that clients waiting for them don't
+// stall.
+const comPortModemState = 0x10 | 0x20 | 0x80
+
+var comPortParities = map[byte]string{
+	comPortParityNone: "none",
+	comPortParityOdd:  "odd",
+	comPortParityEven: "even",
+}
+
+// Handles a COM-PORT-OPTION subnegotiation from a client. Changes of the UART parameters are applied through the
+// Wi-Se /stty endpoint and acknowledged with the resulting value, so clients notice the values that were not accepted.
+func (l *listenHandler) handleComPort(c *listenConn, params []byte) {
+	if len(params) == 0 {
+		return
+	}
+	command, value := params[0], params[1:]
+	var reply []byte
+	// Set for the commands that change the UART parameters. Zero values and unsupported ones only read them.
+	var dto *ttyc.SttyDTO
+
+	switch command {
+	case comPortSignature:
+		// Clients send their signature, or an empty one to ask for ours
+		if len(value) > 0 {
+			return
+		}
+		reply = []byte(fmt.Sprintf("ttyc %s", ttyc.VERSION))
+	case comPortSetBaudrate:
+		if len(value) != 4 {
+			return
+		}
+		dto = &ttyc.SttyDTO{}
+		if baudrate := uint(binary.BigEndian.Uint32(value)); baudrate != 0 {
+			dto.Baudrate = &baudrate
+		}
+	case comPortSetDatasize:
+		if len(value) != 1 {
+			return
+		}
+		dto = &ttyc.SttyDTO{}
+		if databits := value[0]; databits != 0 {
+			dto.Databits = &databits
+		}
+	case comPortSetParity:
+		if len(value) != 1 {
+			return
+		}
+		dto = &ttyc.SttyDTO{}
+		if parity, supported := comPortParities[value[0]]; supported {
+			dto.Parity = &parity
+		}
+	case comPortSetStopsize:
+		if len(value) != 1 {
+			return
+		}
+		dto = &ttyc.SttyDTO{}
+		// 3 is 1.5 stop bits, which is not supported
+		if stopbits := value[0]; stopbits == 1 || stopbits == 2 {
+			dto.Stopbits = &stopbits
+		}
+	case comPortSetControl:
+		if len(value) != 1 {
+			return
+		}
+		switch value[0] {
+		case comPortControlFlowRequest:
+			reply = []byte{comPortControlNoFlow}
+		case comPortControlBreakOn:
+			// Wi-Se sends a break of fixed length, there's nothing to do when it's turned off
+			l.client.SendBreak()
+			reply = value
+		default:
+			// DTR and RTS are not available, changes are acknowledged so that clients go on
+			reply = value
+		}
+	case comPortNotifyModemstate:
+		reply = []byte{comPortModemState}
+	case comPortNotifyLinestate:
+		reply = []byte{0}
+	case comPortSetLinestateMask, comPortSetModemstateMask, comPortPurgeData:
+		reply = value
+	default:
+		return
+	}
+
+	if dto != nil {
+		if l.implementation != ttyc.ImplementationWiSe {
+			// The UART is configured elsewhere, let the client go on
+			reply = value
+		} else if stty, err := l.comPortStty(dto); err != nil {
+			// The client reports that the change was not acknowledged
+			ttyc.TtycErrPrintf("Unable to set the UART parameters: %v\n", err)
+			return
+		} else {
+			reply = comPortSttyValue(command, &stty)
+		}
+	}
+
+	message := []byte{telnetIAC, telnetSB, telnetOptComPort, command + comPortServerOffset}
+	message = append(message, telnetEscape(reply)...)
+	message = append(message, telnetIAC, telnetSE)
+	l.send(c, message)
+}
+
+// Sets the UART parameters that are not nil in dto, or only reads them if they are all nil
+func (l *listenHandler) comPortStty(dto *ttyc.SttyDTO) (ttyc.SttyDTO, error) {
+	sttyUrl := ttyc.GetUrlFor(ttyc.UrlForStty, l.client.BaseUrl)
+	if dto.Baudrate == nil && dto.Databits == nil && dto.Stopbits == nil && dto.Parity == nil {
+		return ttyc.GetStty(sttyUrl, l.credentials)
+	}
+	return ttyc.Stty(sttyUrl, l.credentials, dto)
+}
+
+// Returns the value of the UART parameter set by command, to acknowledge it
+func comPortSttyValue(command byte, stty *ttyc.SttyDTO) []byte {
+	switch command {
+	case comPortSetBaudrate:
+		value := make([]byte, 4)
+		binary.BigEndian.PutUint32(value, uint32(*stty.Baudrate))
+		return value
+	case comPortSetDatasize:
+		return []byte{*stty.Databits}
+	case comPortSetParity:
+		for code, parity := range comPortParities {
+			if stty.Parity != nil && *stty.Parity == parity {
+				return []byte{code}
+			}
+		}
+		return []byte{comPortParityNone}
+	default:
+		return []byte{*stty.Stopbits}
+	}
+}
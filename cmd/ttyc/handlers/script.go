@@ -0,0 +1,391 @@
+package handlers
+
+// Expect-like scripts, to automate console sessions
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/Depau/ttyc"
+	"github.com/Depau/ttyc/ws"
+	"io"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Script commands
+const (
+	// send <string>...: send the strings
+	ScriptSend = "send"
+	// sendline <string>...: send the strings followed by CR, like the Enter key
+	ScriptSendLine = "sendline"
+	// expect <regexp> [timeout]: wait for the output to match, failing after the timeout
+	ScriptExpect = "expect"
+	// timeout <seconds>: set the default expect timeout
+	ScriptTimeout = "timeout"
+	// sleep <seconds>
+	ScriptSleep = "sleep"
+	// break: send a break (Wi-Se only)
+	ScriptBreak = "break"
+	// stty [baudrate] [baudrate=N] [databits=N] [stopbits=N] [parity=none|even|odd]: set the remote UART (Wi-Se only)
+	ScriptStty = "stty"
+	// log <string>...: print a message
+	ScriptLog = "log"
+	// exit [status]: end the script
+	ScriptExit = "exit"
+)
+
+// Unmatched output kept for expect
+const maxScriptBuffer = 1024 * 1024
+
+type scriptCommand struct {
+	line     int
+	name     string
+	text     string
+	pattern  *regexp.Regexp
+	duration time.Duration
+	status   int
+	stty     ttyc.SttyDTO
+}
+
+// Script is a parsed automation script
+type Script struct {
+	commands []scriptCommand
+}
+
+// Splits a script line into its words. Strings can be quoted with double quotes, with Go escape sequences such as \r,
+// \n, \x03 and \", or with backquotes to be taken literally, e.g. for regular expressions. A # starts a comment.
+func splitScriptLine(line string) ([]string, error) {
+	var words []string
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" || line[0] == '#' {
+			return words, nil
+		}
+		var end int
+		switch line[0] {
+		case '"':
+			for end = 1; end < len(line) && line[end] != '"'; end++ {
+				if line[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(line) {
+				return nil, fmt.Errorf("unterminated string: %s", line)
+			}
+			end++
+		case '`':
+			end = strings.IndexByte(line[1:], '`')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string: %s", line)
+			}
+			end += 2
+		default:
+			end = strings.IndexAny(line, " \t")
+			if end < 0 {
+				end = len(line)
+			}
+		}
+		word := line[:end]
+		if word[0] == '"' || word[0] == '`' {
+			unquoted, err := strconv.Unquote(word)
+			if err != nil {
+				return nil, fmt.Errorf("invalid string: %s", word)
+			}
+			if end < len(line) && line[end] != ' ' && line[end] != '\t' {
+				return nil, fmt.Errorf("missing space after %s", word)
+			}
+			word = unquoted
+		}
+		words = append(words, word)
+		line = line[end:]
+	}
+}
+
+func parseSeconds(value string) (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("invalid number of seconds: %s", value)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+func parseScriptStty(args []string) (ttyc.SttyDTO, error) {
+	dto := ttyc.SttyDTO{}
+	for _, arg := range args {
+		key, value := "baudrate", arg
+		if i := strings.IndexByte(arg, '='); i >= 0 {
+			key, value = arg[:i], arg[i+1:]
+		}
+		if key == "parity" {
+			if value != "none" && value != "even" && value != "odd" {
+				return dto, fmt.Errorf("invalid parity: %s", value)
+			}
+			parity := value
+			dto.Parity = &parity
+			continue
+		}
+		number, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return dto, fmt.Errorf("invalid %s: %s", key, value)
+		}
+		switch key {
+		case "baudrate", "baud":
+			baudrate := uint(number)
+			if baudrate == 0 {
+				return dto, fmt.Errorf("invalid baud rate: %s", value)
+			}
+			dto.Baudrate = &baudrate
+		case "databits":
+			if number < 5 || number > 8 {
+				return dto, fmt.Errorf("invalid data bits: %s", value)
+			}
+			databits := uint8(number)
+			dto.Databits = &databits
+		case "stopbits":
+			if number != 1 && number != 2 {
+				return dto, fmt.Errorf("invalid stop bits: %s", value)
+			}
+			stopbits := uint8(number)
+			dto.Stopbits = &stopbits
+		default:
+			return dto, fmt.Errorf("unknown parameter: %s", key)
+		}
+	}
+	return dto, nil
+}
+
+// ParseScript parses a script, one command per line
+func ParseScript(r io.Reader) (*Script, error) {
+	script := &Script{}
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		words, err := splitScriptLine(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		if len(words) == 0 {
+			continue
+		}
+		command := scriptCommand{line: lineNo, name: words[0]}
+		args := words[1:]
+		argsError := func(usage string) error {
+			return fmt.Errorf("line %d: usage: %s %s", lineNo, command.name, usage)
+		}
+
+		switch command.name {
+		case ScriptSend, ScriptSendLine, ScriptLog:
+			command.text = strings.Join(args, "")
+			if command.name == ScriptSendLine {
+				command.text += "\r"
+			}
+		case ScriptExpect:
+			if len(args) < 1 || len(args) > 2 {
+				return nil, argsError("<regexp> [timeout]")
+			}
+			if command.pattern, err = regexp.Compile(args[0]); err != nil {
+				return nil, fmt.Errorf("line %d: invalid regular expression: %v", lineNo, err)
+			}
+			command.duration = -1
+			if len(args) == 2 {
+				if command.duration, err = parseSeconds(args[1]); err != nil {
+					return nil, fmt.Errorf("line %d: %v", lineNo, err)
+				}
+			}
+		case ScriptTimeout, ScriptSleep:
+			if len(args) != 1 {
+				return nil, argsError("<seconds>")
+			}
+			if command.duration, err = parseSeconds(args[0]); err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNo, err)
+			}
+		case ScriptBreak:
+			if len(args) != 0 {
+				return nil, argsError("")
+			}
+		case ScriptStty:
+			if len(args) == 0 {
+				return nil, argsError("[baudrate] [databits=N] [stopbits=N] [parity=none|even|odd]")
+			}
+			if command.stty, err = parseScriptStty(args); err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNo, err)
+			}
+		case ScriptExit:
+			if len(args) > 1 {
+				return nil, argsError("[status]")
+			}
+			if len(args) == 1 {
+				if command.status, err = strconv.Atoi(args[0]); err != nil || command.status < 0 || command.status > 255 {
+					return nil, fmt.Errorf("line %d: invalid exit status: %s", lineNo, args[0])
+				}
+			}
+		default:
+			return nil, fmt.Errorf("line %d: unknown command: %s", lineNo, command.name)
+		}
+		script.commands = append(script.commands, command)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return script, nil
+}
+
+type scriptHandler struct {
+	client         *ws.Client
+	implementation ttyc.Implementation
+	credentials    *url.Userinfo
+	script         *Script
+	// Where the output is copied to
+	output  io.Writer
+	timeout time.Duration
+	mutex   sync.Mutex
+	// Output not matched yet
+	buf []byte
+	// Signaled when output is received
+	notify chan struct{}
+}
+
+// NewScriptHandler runs a script on the session. The output is copied to output, and the handler reports an
+// ExitStatus when the script is over. timeout is the initial expect timeout.
+func NewScriptHandler(client *ws.Client, implementation ttyc.Implementation, credentials *url.Userinfo, script *Script, output io.Writer, timeout time.Duration) (tty TtyHandler, err error) {
+	tty = &scriptHandler{
+		client:         client,
+		implementation: implementation,
+		credentials:    credentials,
+		script:         script,
+		output:         output,
+		timeout:        timeout,
+		notify:         make(chan struct{}, 1),
+	}
+	return
+}
+
+func (s *scriptHandler) readOutput(errChan chan<- error) {
+	for {
+		select {
+		case <-s.client.CloseChan:
+			return
+		case chunk, ok := <-s.client.Output:
+			if !ok {
+				return
+			}
+			if _, err := s.output.Write(chunk.Data); err != nil {
+				errChan <- err
+				return
+			}
+			s.mutex.Lock()
+			s.buf = append(s.buf, chunk.Data...)
+			if len(s.buf) > maxScriptBuffer {
+				s.buf = s.buf[len(s.buf)-maxScriptBuffer:]
+			}
+			s.mutex.Unlock()
+			select {
+			case s.notify <- struct{}{}:
+			default:
+			}
+		case <-s.client.WinTitle:
+		case <-s.client.DetectedBaudrate:
+		}
+	}
+}
+
+// Waits for the output to match, discarding the output up to the end of the match
+func (s *scriptHandler) expect(pattern *regexp.Regexp, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		s.mutex.Lock()
+		match := pattern.FindIndex(s.buf)
+		if match != nil {
+			s.buf = append(s.buf[:0], s.buf[match[1]:]...)
+		}
+		s.mutex.Unlock()
+		if match != nil {
+			return nil
+		}
+		select {
+		case <-s.notify:
+		case <-timer.C:
+			return fmt.Errorf("timed out after %v waiting for /%s/", timeout, pattern)
+		case <-s.client.CloseChan:
+			return fmt.Errorf("the session was closed")
+		}
+	}
+}
+
+func (s *scriptHandler) send(data []byte) error {
+	select {
+	case s.client.Input <- data:
+		return nil
+	case <-s.client.CloseChan:
+		return fmt.Errorf("the session was closed")
+	}
+}
+
+// Runs a command, returning whether the script should end
+func (s *scriptHandler) runCommand(command *scriptCommand) (exit bool, err error) {
+	switch command.name {
+	case ScriptSend, ScriptSendLine:
+		return false, s.send([]byte(command.text))
+	case ScriptExpect:
+		timeout := command.duration
+		if timeout < 0 {
+			timeout = s.timeout
+		}
+		return false, s.expect(command.pattern, timeout)
+	case ScriptTimeout:
+		s.timeout = command.duration
+	case ScriptSleep:
+		time.Sleep(command.duration)
+	case ScriptBreak:
+		if s.implementation != ttyc.ImplementationWiSe {
+			return false, fmt.Errorf("break is only available with Wi-Se")
+		}
+		s.client.SendBreak()
+	case ScriptStty:
+		if s.implementation != ttyc.ImplementationWiSe {
+			return false, fmt.Errorf("stty is only available with Wi-Se")
+		}
+		sttyUrl := ttyc.GetUrlFor(ttyc.UrlForStty, s.client.BaseUrl)
+		if _, err := ttyc.Stty(sttyUrl, s.credentials, &command.stty); err != nil {
+			return false, fmt.Errorf("unable to set remote UART parameters: %v", err)
+		}
+	case ScriptLog:
+		ttyc.TtycPrintf("%s\n", command.text)
+	case ScriptExit:
+		return true, nil
+	}
+	return false, nil
+}
+
+func (s *scriptHandler) Run(errChan chan<- error) {
+	go s.readOutput(errChan)
+	for i := range s.script.commands {
+		command := &s.script.commands[i]
+		exit, err := s.runCommand(command)
+		if err != nil {
+			errChan <- &ExitStatus{Status: 1, Err: fmt.Errorf("line %d: %s: %v", command.line, command.name, err)}
+			return
+		}
+		if exit {
+			errChan <- &ExitStatus{Status: command.status}
+			return
+		}
+	}
+	errChan <- &ExitStatus{Status: 0}
+}
+
+func (s *scriptHandler) HandleDisconnect() error {
+	return nil
+}
+
+func (s *scriptHandler) HandleReconnect() error {
+	return nil
+}
+
+func (s *scriptHandler) Close() error {
+	return nil
+}
@@ -0,0 +1,355 @@
+package handlers
+
+// SSH frontend: remote consoles are served to SSH clients, selected by the SSH user name or by subsystem name, so that
+// users only need an authorized key instead of the credentials of the servers
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/Depau/ttyc"
+	"github.com/Depau/ttyc/ws"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SshConsole is a remote console served over SSH
+type SshConsole struct {
+	Url         *url.URL
+	Credentials *url.Userinfo
+}
+
+// SshServer serves remote consoles to SSH clients. Every SSH session opens its own connection to the console, which
+// is closed when the session ends.
+type SshServer struct {
+	config   *ssh.ServerConfig
+	consoles map[string]*SshConsole
+	watchdog int
+	mutex    sync.Mutex
+	conns    map[*ssh.ServerConn]interface{}
+	listener net.Listener
+	closed   bool
+}
+
+// Payloads of the SSH session requests, RFC 4254
+type sshPtyRequest struct {
+	Term   string
+	Cols   uint32
+	Rows   uint32
+	Width  uint32
+	Height uint32
+	Modes  string
+}
+
+type sshWindowChange struct {
+	Cols   uint32
+	Rows   uint32
+	Width  uint32
+	Height uint32
+}
+
+type sshSubsystemRequest struct {
+	Name string
+}
+
+type sshExitStatus struct {
+	Status uint32
+}
+
+// NewSshServer creates a server for consoles, by name, that accepts the clients authenticating with one of the keys
+// returned by authorizedKeys. authorizedKeys is called for every authentication attempt, so that keys can be changed
+// while running.
+func NewSshServer(hostKey ssh.Signer, authorizedKeys func() ([]ssh.PublicKey, error), consoles map[string]*SshConsole, watchdog int) *SshServer {
+	s := &SshServer{
+		consoles: consoles,
+		watchdog: watchdog,
+		conns:    map[*ssh.ServerConn]interface{}{},
+	}
+	s.config = &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			keys, err := authorizedKeys()
+			if err != nil {
+				ttyc.TtycErrPrintf("Unable to load the authorized keys: %v\n", err)
+				return nil, fmt.Errorf("unable to load the authorized keys")
+			}
+			for _, authorized := range keys {
+				if bytes.Equal(authorized.Marshal(), key.Marshal()) {
+					return nil, nil
+				}
+			}
+			return nil, fmt.Errorf("unknown public key for %s", meta.User())
+		},
+	}
+	s.config.AddHostKey(hostKey)
+	return s
+}
+
+// Serve accepts SSH connections on listener until the server is closed
+func (s *SshServer) Serve(listener net.Listener) error {
+	s.mutex.Lock()
+	s.listener = listener
+	s.mutex.Unlock()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			if s.closed {
+				return nil
+			}
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops accepting connections and disconnects all clients
+func (s *SshServer) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+	return nil
+}
+
+func (s *SshServer) addConn(conn *ssh.ServerConn) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = nil
+	return true
+}
+
+func (s *SshServer) removeConn(conn *ssh.ServerConn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.conns, conn)
+}
+
+// Returns the names of the consoles, for error messages
+func (s *SshServer) consoleNames() string {
+	var names []string
+	for name := range s.consoles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func (s *SshServer) serveConn(conn net.Conn) {
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	defer serverConn.Close()
+	if !s.addConn(serverConn) {
+		return
+	}
+	defer s.removeConn(serverConn)
+	ttyc.TtycPrintf("%s connected from %s\n", serverConn.User(), serverConn.RemoteAddr())
+	defer ttyc.TtycPrintf("%s disconnected from %s\n", serverConn.User(), serverConn.RemoteAddr())
+
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go s.serveSession(serverConn.User(), channel, requests)
+	}
+}
+
+// sshSession bridges an SSH session channel to a console. The client is set and used by the goroutine handling the
+// session requests, the output and the input are copied by their own goroutines.
+type sshSession struct {
+	server  *SshServer
+	channel ssh.Channel
+	client  *ws.Client
+	cols    int
+	rows    int
+	// Closed when the connection to the console is lost, the client doesn't accept messages anymore
+	disconnected chan struct{}
+	// Closed when the session ends. The client is closed once copyInput returns, since closing it closes its input.
+	done      chan struct{}
+	inputDone chan struct{}
+}
+
+func (s *SshServer) serveSession(user string, channel ssh.Channel, requests <-chan *ssh.Request) {
+	session := &sshSession{
+		server:       s,
+		channel:      channel,
+		disconnected: make(chan struct{}),
+		done:         make(chan struct{}),
+		inputDone:    make(chan struct{}),
+	}
+	defer session.close()
+
+	for request := range requests {
+		ok := false
+		var err error
+		switch request.Type {
+		case "pty-req":
+			pty := sshPtyRequest{}
+			if ssh.Unmarshal(request.Payload, &pty) == nil {
+				session.resize(int(pty.Cols), int(pty.Rows))
+				ok = true
+			}
+		case "window-change":
+			window := sshWindowChange{}
+			if ssh.Unmarshal(request.Payload, &window) == nil {
+				session.resize(int(window.Cols), int(window.Rows))
+				ok = true
+			}
+		case "shell", "subsystem":
+			name := user
+			subsystem := sshSubsystemRequest{}
+			if request.Type == "subsystem" && ssh.Unmarshal(request.Payload, &subsystem) == nil {
+				name = subsystem.Name
+			}
+			// The request is accepted anyway so that clients show the error, they exit right away otherwise
+			if session.client == nil {
+				ok = true
+				err = session.start(name)
+			}
+		case "break":
+			// The break length is up to the server
+			if session.connected() {
+				session.client.SendBreak()
+				ok = true
+			}
+		}
+		if request.WantReply {
+			_ = request.Reply(ok, nil)
+		}
+		if err != nil {
+			session.fail(err)
+		}
+	}
+}
+
+func (ss *sshSession) resize(cols int, rows int) {
+	if cols <= 0 || rows <= 0 {
+		return
+	}
+	ss.cols, ss.rows = cols, rows
+	if ss.connected() {
+		ss.client.ResizeTerminal(cols, rows)
+	}
+}
+
+func (ss *sshSession) connected() bool {
+	if ss.client == nil {
+		return false
+	}
+	select {
+	case <-ss.disconnected:
+		return false
+	default:
+		return true
+	}
+}
+
+// Connects to the console and starts bridging it to the channel
+func (ss *sshSession) start(name string) error {
+	console, ok := ss.server.consoles[name]
+	if !ok {
+		return fmt.Errorf("unknown console %s, available consoles: %s", name, ss.server.consoleNames())
+	}
+	token, _, _, err := ttyc.Handshake(ttyc.GetUrlFor(ttyc.UrlForToken, console.Url), console.Credentials)
+	if err != nil {
+		return fmt.Errorf("handshake with %s failed: %v", name, err)
+	}
+	client, err := ws.DialAndAuth(console.Url, &token, ss.server.watchdog)
+	if err != nil {
+		return fmt.Errorf("unable to connect to %s: %v", name, err)
+	}
+	ss.client = client
+	go client.Run(ss.server.watchdog)
+	if ss.cols > 0 {
+		client.ResizeTerminal(ss.cols, ss.rows)
+	}
+	go ss.copyOutput(name)
+	go func() {
+		defer close(ss.inputDone)
+		ss.copyInput()
+	}()
+	return nil
+}
+
+// Ends the session with exit status 1, showing err on the standard error of the SSH client
+func (ss *sshSession) fail(err error) {
+	_, _ = fmt.Fprintf(ss.channel.Stderr(), "\r\nttyc: %v\r\n", err)
+	_, _ = ss.channel.SendRequest("exit-status", false, ssh.Marshal(&sshExitStatus{Status: 1}))
+	_ = ss.channel.Close()
+}
+
+// Sends the output of the console to the channel. If the connection to the console is lost the session ends, since
+// SSH clients can simply reconnect.
+func (ss *sshSession) copyOutput(name string) {
+	client := ss.client
+	for {
+		select {
+		case <-client.CloseChan:
+			return
+		case chunk := <-client.Output:
+			if _, err := ss.channel.Write(chunk.Data); err != nil {
+				return
+			}
+		case <-client.WinTitle:
+		case <-client.DetectedBaudrate:
+		case err := <-client.Error:
+			close(ss.disconnected)
+			ss.fail(fmt.Errorf("disconnected from %s: %v", name, err))
+			return
+		}
+	}
+}
+
+// Sends the input of the SSH client to the console. After the end of the input the session stays open, until the
+// client closes it.
+func (ss *sshSession) copyInput() {
+	client := ss.client
+	for {
+		buf := make([]byte, 4096)
+		bRead, err := ss.channel.Read(buf)
+		if bRead > 0 {
+			select {
+			case client.Input <- buf[:bRead]:
+			case <-client.CloseChan:
+				return
+			case <-ss.done:
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (ss *sshSession) close() {
+	close(ss.done)
+	_ = ss.channel.Close()
+	if ss.client != nil {
+		<-ss.inputDone
+		_ = ss.client.Close()
+	}
+}
@@ -0,0 +1,226 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"github.com/Depau/ttyc/expect"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate a key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("unable to create a signer: %v", err)
+	}
+	return signer
+}
+
+// Starts an SSH server for a fake console named "board", which accepts clientKey
+func startTestSshServer(t *testing.T, wiSe bool, clientKey ssh.Signer) (*expect.FakeServer, string) {
+	t.Helper()
+	fake := expect.NewFakeServer(wiSe)
+	t.Cleanup(fake.Close)
+	consoleUrl, _ := url.Parse(fake.URL)
+	authorizedKeys := func() ([]ssh.PublicKey, error) {
+		return []ssh.PublicKey{clientKey.PublicKey()}, nil
+	}
+	server := NewSshServer(newTestSigner(t), authorizedKeys, map[string]*SshConsole{"board": {Url: consoleUrl}}, 0)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	go server.Serve(listener)
+	t.Cleanup(func() { _ = server.Close() })
+	return fake, listener.Addr().String()
+}
+
+func dialTestSsh(address string, user string, key ssh.Signer) (*ssh.Client, error) {
+	return ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(key)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+}
+
+// Opens a session as user, failing the test if the server doesn't accept it
+func openTestSshSession(t *testing.T, address string, user string, key ssh.Signer) *ssh.Session {
+	t.Helper()
+	client, err := dialTestSsh(address, user, key)
+	if err != nil {
+		t.Fatalf("unable to connect: %v", err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("unable to open a session: %v", err)
+	}
+	return session
+}
+
+// Waits for cond to become true, failing the test after a while
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Collects what the SSH client receives
+type syncBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
+
+// Returns the input of session and a buffer filled with its output. Clients don't copy the output of subsystems to
+// Stdout, so it's read from the channel.
+func pipeTestSshSession(session *ssh.Session) (io.Writer, *syncBuffer) {
+	stdin, _ := session.StdinPipe()
+	stdoutPipe, _ := session.StdoutPipe()
+	stdout := &syncBuffer{}
+	go io.Copy(stdout, stdoutPipe)
+	return stdin, stdout
+}
+
+// Checks that data typed in the session is echoed back by the fake console
+func checkTestSshEcho(t *testing.T, fake *expect.FakeServer, stdin io.Writer, stdout *syncBuffer) {
+	t.Helper()
+	if _, err := stdin.Write([]byte("version\r")); err != nil {
+		t.Fatalf("unable to send input: %v", err)
+	}
+	waitFor(t, "the input", func() bool { return string(fake.Input()) == "version\r" })
+	waitFor(t, "the echo", func() bool { return stdout.String() == "version\r" })
+}
+
+func TestSshKeyRejection(t *testing.T) {
+	clientKey := newTestSigner(t)
+	_, address := startTestSshServer(t, false, clientKey)
+
+	if _, err := dialTestSsh(address, "board", newTestSigner(t)); err == nil {
+		t.Fatalf("unknown key accepted")
+	}
+	client, err := dialTestSsh(address, "board", clientKey)
+	if err != nil {
+		t.Fatalf("authorized key refused: %v", err)
+	}
+	_ = client.Close()
+}
+
+func TestSshConsoleByUser(t *testing.T) {
+	clientKey := newTestSigner(t)
+	fake, address := startTestSshServer(t, false, clientKey)
+	fake.Echo = true
+
+	session := openTestSshSession(t, address, "board", clientKey)
+	stdin, stdout := pipeTestSshSession(session)
+	if err := session.Shell(); err != nil {
+		t.Fatalf("shell request failed: %v", err)
+	}
+	checkTestSshEcho(t, fake, stdin, stdout)
+}
+
+func TestSshConsoleBySubsystem(t *testing.T) {
+	clientKey := newTestSigner(t)
+	fake, address := startTestSshServer(t, false, clientKey)
+	fake.Echo = true
+
+	session := openTestSshSession(t, address, "someone", clientKey)
+	stdin, stdout := pipeTestSshSession(session)
+	if err := session.RequestSubsystem("board"); err != nil {
+		t.Fatalf("subsystem request failed: %v", err)
+	}
+	checkTestSshEcho(t, fake, stdin, stdout)
+}
+
+func TestSshUnknownConsole(t *testing.T) {
+	clientKey := newTestSigner(t)
+	_, address := startTestSshServer(t, false, clientKey)
+
+	session := openTestSshSession(t, address, "nope", clientKey)
+	stderr := &syncBuffer{}
+	session.Stderr = stderr
+	if err := session.Shell(); err != nil {
+		t.Fatalf("shell request failed: %v", err)
+	}
+	err := session.Wait()
+	if exitErr, ok := err.(*ssh.ExitError); !ok || exitErr.ExitStatus() != 1 {
+		t.Fatalf("expected exit status 1, got %v", err)
+	}
+	if !strings.Contains(stderr.String(), "unknown console nope, available consoles: board") {
+		t.Fatalf("unexpected error message: %q", stderr.String())
+	}
+}
+
+func TestSshResize(t *testing.T) {
+	clientKey := newTestSigner(t)
+	fake, address := startTestSshServer(t, false, clientKey)
+
+	session := openTestSshSession(t, address, "board", clientKey)
+	if err := session.RequestPty("xterm", 40, 100, ssh.TerminalModes{}); err != nil {
+		t.Fatalf("pty request failed: %v", err)
+	}
+	if err := session.Shell(); err != nil {
+		t.Fatalf("shell request failed: %v", err)
+	}
+	waitFor(t, "the initial size", func() bool {
+		cols, rows := fake.Size()
+		return cols == 100 && rows == 40
+	})
+
+	if err := session.WindowChange(50, 120); err != nil {
+		t.Fatalf("window change failed: %v", err)
+	}
+	waitFor(t, "the new size", func() bool {
+		cols, rows := fake.Size()
+		return cols == 120 && rows == 50
+	})
+}
+
+func TestSshBreak(t *testing.T) {
+	clientKey := newTestSigner(t)
+	fake, address := startTestSshServer(t, true, clientKey)
+
+	session := openTestSshSession(t, address, "board", clientKey)
+	// RFC 4335, the length is ignored
+	breakLength := ssh.Marshal(&struct{ Length uint32 }{500})
+	if ok, _ := session.SendRequest("break", true, breakLength); ok {
+		t.Fatalf("break accepted before connecting to the console")
+	}
+	if err := session.Shell(); err != nil {
+		t.Fatalf("shell request failed: %v", err)
+	}
+	if ok, err := session.SendRequest("break", true, breakLength); !ok || err != nil {
+		t.Fatalf("break refused: %v", err)
+	}
+	waitFor(t, "the break", func() bool { return fake.Breaks() == 1 })
+}
@@ -2,22 +2,30 @@ package handlers
 
 import (
 	"bytes"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/Depau/switzerland"
 	"github.com/Depau/ttyc"
 	"github.com/Depau/ttyc/cmd/ttyc/handlers/shenanigans"
+	"github.com/Depau/ttyc/decoders"
+	"github.com/Depau/ttyc/transfer"
 	"github.com/Depau/ttyc/utils"
 	"github.com/Depau/ttyc/ws"
 	"github.com/TwinProduction/go-color"
 	"github.com/containerd/console"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	"os/exec"
 	"runtime"
 	"sort"
+	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 // Tio-style (https://tio.github.io) console handler
@@ -37,6 +45,17 @@ const (
 	LocalEchoChar  byte = 'e'
 	HexModeChar    byte = 'h'
 	TimestampsChar byte = 'T'
+	LogChar        byte = 'f'
+	HexInputChar   byte = 'i'
+	FrameModeChar  byte = 'F'
+	DecoderChar    byte = 'd'
+	ControlsChar   byte = 'V'
+	SendFilesChar  byte = 'x'
+	ReceiveChar    byte = 'r'
+	SendTextChar   byte = 'a'
+	PasteGuardChar byte = 'p'
+	CommandChar    byte = '!'
+	PipeChar       byte = '|'
 )
 
 type StatsDTO struct {
@@ -61,7 +80,18 @@ var cmdsInfo = map[byte]cmdInfo{
 	VersionChar:    {"Show version", false},
 	LocalEchoChar:  {"Toggle local echo mode", false},
 	HexModeChar:    {"Toggle hexadecimal mode", false},
-	TimestampsChar: {"Toggle timestamps", false},
+	TimestampsChar: {"Cycle timestamp formats", false},
+	LogChar:        {"Toggle logging to file", false},
+	HexInputChar:   {"Toggle hexadecimal input mode", false},
+	FrameModeChar:  {"Toggle frame mode (split output on idle gaps)", false},
+	DecoderChar:    {"Cycle protocol decoders", false},
+	ControlsChar:   {"Toggle visible control characters", false},
+	SendFilesChar:  {"Send files with XMODEM, YMODEM or ZMODEM", false},
+	ReceiveChar:    {"Receive files with XMODEM, YMODEM or ZMODEM", false},
+	SendTextChar:   {"Send a text file, paced", false},
+	PasteGuardChar: {"Toggle paste guard (pace pasted text)", false},
+	CommandChar:    {"Run a local command, sending its output", false},
+	PipeChar:       {"Run a local command, sending its output and feeding it the received data", false},
 	// Available on Wi-Se server only
 	BreakChar:      {"Send break", true},
 	DetectBaudChar: {"Request baudrate detection", true},
@@ -79,6 +109,58 @@ type stdfdsHandler struct {
 	hexMode          bool
 	showTimestamps   bool
 	nextIsTimestamp  bool
+	timestamper      timestamper
+	hexDumper        hexDumper
+	hexInputMode     bool
+	hexInputBuf      []byte
+	frameMode        bool
+	frames           frameSplitter
+	decoder          *decoders.Stream
+	visibleControls  bool
+	controls         controlRenderer
+	logger           *SessionLogger
+	mapping          *Mapping
+	charset          *Charset
+	charsetEncoder   charsetEncoder
+	prompt           *linePrompt
+	modeMutex        sync.Mutex
+	taskMutex        sync.Mutex
+	task             backgroundTask
+	pacing           Pacing
+	pasteGuard       bool
+	pasting          bool
+	pasteBuf         []byte
+	// Set when the standard file descriptors aren't a terminal
+	pipe *PipeOptions
+}
+
+// PipeOptions configure the handler for standard file descriptors that aren't a terminal, i.e. to pipe commands to the
+// remote terminal and save its output from shell scripts
+type PipeOptions struct {
+	// Process the key commands, which are sent as they are otherwise
+	Escape bool
+	// Time to keep printing the output after the end of the input, negative to keep running until the session ends
+	Drain time.Duration
+}
+
+// backgroundTask is a transfer or a paced send, which has exclusive use of the input until it's over
+type backgroundTask interface {
+	cancel()
+}
+
+// Bracketed paste mode, which makes the terminal mark the pasted text
+const (
+	enableBracketedPaste  = "\033[?2004h"
+	disableBracketedPaste = "\033[?2004l"
+)
+
+var pasteStart = []byte("\033[200~")
+var pasteEnd = []byte("\033[201~")
+
+// linePrompt reads a line typed by the user, i.e. the arguments of a key command
+type linePrompt struct {
+	buf  []byte
+	done func(line string)
 }
 
 func NewStdFdsHandler(client *ws.Client, implementation ttyc.Implementation, credentials *url.Userinfo, server string) (tty TtyHandler, err error) {
@@ -93,10 +175,22 @@ func NewStdFdsHandler(client *ws.Client, implementation ttyc.Implementation, cre
 		hexMode:          false,
 		showTimestamps:   false,
 		nextIsTimestamp:  false,
+		timestamper:      newTimestamper(TimestampTime),
+		frames:           frameSplitter{gap: DefaultFrameGap},
 	}
 	return
 }
 
+// NewStdFdsPipeHandler is like NewStdFdsHandler, but it doesn't set up the console and it ends the session at the end
+// of the input
+func NewStdFdsPipeHandler(client *ws.Client, implementation ttyc.Implementation, credentials *url.Userinfo, server string, options PipeOptions) (tty TtyHandler, err error) {
+	if tty, err = NewStdFdsHandler(client, implementation, credentials, server); err != nil {
+		return
+	}
+	tty.(*stdfdsHandler).pipe = &options
+	return
+}
+
 func (s *stdfdsHandler) rawTtyPrintfLn(angry bool, format string, args ...interface{}) {
 	var newLineFile *os.File
 	if angry {
@@ -104,7 +198,7 @@ func (s *stdfdsHandler) rawTtyPrintfLn(angry bool, format string, args ...interf
 		newLineFile = os.Stderr
 	} else {
 		ttyc.TtycPrintf(format, args...)
-		newLineFile = os.Stdout
+		newLineFile = ttyc.StatusOutput
 	}
 	if s.console == nil {
 		_, _ = newLineFile.WriteString("\n")
@@ -114,6 +208,24 @@ func (s *stdfdsHandler) rawTtyPrintfLn(angry bool, format string, args ...interf
 	_ = newLineFile.Sync()
 }
 
+// Returns where prompts and key command messages are shown. In pipe mode the standard output only carries the output
+// of the remote terminal, so they go to ttyc.StatusOutput.
+func (s *stdfdsHandler) statusOutput() *os.File {
+	if s.pipe != nil {
+		return ttyc.StatusOutput
+	}
+	return os.Stdout
+}
+
+// Moves past the line the key command was typed on
+func (s *stdfdsHandler) printStatusNewLine() {
+	if s.pipe != nil {
+		_, _ = ttyc.StatusOutput.WriteString("\n")
+		return
+	}
+	println("")
+}
+
 func (s *stdfdsHandler) handleStdin(closeChan <-chan interface{}, inChan <-chan []byte, outChan chan<- []byte, errChan chan<- error) {
 	for {
 		var input []byte
@@ -122,13 +234,46 @@ func (s *stdfdsHandler) handleStdin(closeChan <-chan interface{}, inChan <-chan
 		select {
 		case <-closeChan:
 			return
-		case input = <-inChan:
+		case received, ok := <-inChan:
+			if !ok {
+				s.endOfInput(closeChan, outChan, errChan)
+				return
+			}
+			input = received
 		}
 		//println("SELECTED handleStdin")
 
+		if task := s.activeTask(); task != nil {
+			// Typing would corrupt the transfer, only ctrl-c is handled to cancel it
+			if bytes.IndexByte(input, 0x03) >= 0 {
+				task.cancel()
+			}
+			continue
+		}
+		if s.prompt != nil {
+			s.editPrompt(input)
+			continue
+		}
+		s.modeMutex.Lock()
+		pasteGuard := s.pasteGuard && !s.hexInputMode
+		var pasted []byte
+		if pasteGuard {
+			input, pasted = s.extractPaste(input)
+		}
+		s.modeMutex.Unlock()
+		if len(pasted) > 0 {
+			s.sendPaste(pasted)
+		}
+		if pasteGuard && len(input) == 0 {
+			continue
+		}
+
 		// Check for new EscapeChars before handling any pending ones, since we may add one back that needs to be
 		// passed through
-		escapePos := bytes.Index(input, []byte{EscapeChar})
+		escapePos := -1
+		if s.pipe == nil || s.pipe.Escape {
+			escapePos = bytes.Index(input, []byte{EscapeChar})
+		}
 
 		// Handle any pending commands, when EscapeChar was the last char of the previous buffer
 		if s.expectingCommand {
@@ -153,27 +298,256 @@ func (s *stdfdsHandler) handleStdin(closeChan <-chan interface{}, inChan <-chan
 			input = input[:len(input)-1]
 		} else if escapePos >= 0 {
 			before := input[:escapePos]
-			command := input[escapePos]
+			command := input[escapePos+1]
 			after := input[escapePos+2:]
 			replacement := s.handleCommand(command, errChan)
 			input = bytes.Join([][]byte{before, after}, replacement)
 		}
 		// More than one escape char? I hope you're happy with your life.
 
-		if s.localEchoMode {
-			for _, char := range input {
-				// If character is printable
-				if (char >= 32 && char <= 126) || char == '\r' || char == '\n' {
-					_, _ = os.Stdout.Write([]byte{char})
-				}
+		// The mutex must not be held while sending, the client may be waiting for the output loop
+		if input = s.prepareInput(input); len(input) == 0 {
+			continue
+		}
+		outChan <- input
+	}
+}
+
+// Converts the typed input as set by the modes and echoes it, returning the bytes to send
+func (s *stdfdsHandler) prepareInput(input []byte) []byte {
+	s.modeMutex.Lock()
+	defer s.modeMutex.Unlock()
+
+	if s.hexInputMode {
+		input = s.editHexInput(input)
+		if len(input) == 0 {
+			return nil
+		}
+	}
+
+	if s.charset != nil && !s.hexInputMode {
+		if input = s.charsetEncoder.encode(input); len(input) == 0 {
+			return nil
+		}
+	}
+
+	s.echoInput(input)
+	return input
+}
+
+// Ends the session once the input of a pipe is over, after waiting for the output to drain
+func (s *stdfdsHandler) endOfInput(closeChan <-chan interface{}, outChan chan<- []byte, errChan chan<- error) {
+	// The client ignores empty input, but only takes it once the previous input has been sent
+	select {
+	case outChan <- []byte{}:
+	case <-closeChan:
+		return
+	}
+	if s.pipe.Drain < 0 {
+		return
+	}
+	select {
+	case <-time.After(s.pipe.Drain):
+		errChan <- &ExitStatus{Status: 0}
+	case <-closeChan:
+	}
+}
+
+// Like utils.CopyReaderToChan, but closes outChan at the end of the input instead of failing
+func copyPipeToChan(closeChan <-chan interface{}, fd io.Reader, outChan chan<- []byte, errChan chan<- error) {
+	for {
+		buf := make([]byte, 4096)
+		bRead, err := fd.Read(buf)
+		if bRead > 0 {
+			select {
+			case outChan <- buf[:bRead]:
+			case <-closeChan:
+				return
 			}
-			_ = os.Stdout.Sync()
 		}
+		if err == io.EOF {
+			close(outChan)
+			return
+		}
+		if err != nil {
+			errChan <- fmt.Errorf("unable to read the standard input: %v", err)
+			return
+		}
+	}
+}
 
-		outChan <- input
+// Shows the input sent to the server, if local echo is enabled
+func (s *stdfdsHandler) echoInput(input []byte) {
+	if s.localEchoMode && s.hexMode {
+		_, _ = os.Stdout.Write(s.hexDumper.dump(hexDirectionTx, input, true, func() string {
+			return s.timestampPrefix(time.Now())
+		}))
+		_ = os.Stdout.Sync()
+	} else if s.localEchoMode && s.visibleControls && !s.hexInputMode {
+		s.hexDumper.skip(hexDirectionTx, len(input))
+		// Input isn't split in the middle of characters, nothing needs to be held back
+		renderer := controlRenderer{dim: s.controls.dim}
+		_, _ = os.Stdout.Write(append(renderer.render(s.toUtf8(input)), renderer.flush()...))
+		_ = os.Stdout.Sync()
+	} else if s.localEchoMode && !s.hexInputMode {
+		s.hexDumper.skip(hexDirectionTx, len(input))
+		for _, char := range input {
+			// If character is printable
+			if (char >= 32 && char <= 126) || char == '\r' || char == '\n' {
+				_, _ = os.Stdout.Write([]byte{char})
+			}
+		}
+		_ = os.Stdout.Sync()
+	} else {
+		s.hexDumper.skip(hexDirectionTx, len(input))
 	}
 }
 
+// Separates the text pasted in bracketed paste mode from the typed input. The pasted text is returned once the paste
+// ends, which may be in a later buffer.
+func (s *stdfdsHandler) extractPaste(input []byte) (typed []byte, pasted []byte) {
+	for len(input) > 0 {
+		if !s.pasting {
+			start := bytes.Index(input, pasteStart)
+			if start < 0 {
+				typed = append(typed, input...)
+				break
+			}
+			typed = append(typed, input[:start]...)
+			input = input[start+len(pasteStart):]
+			s.pasting = true
+			continue
+		}
+		// The end marker may be split across buffers, so it is looked for in all the text pasted so far
+		s.pasteBuf = append(s.pasteBuf, input...)
+		end := bytes.Index(s.pasteBuf, pasteEnd)
+		if end < 0 {
+			break
+		}
+		pasted = append(pasted, s.pasteBuf[:end]...)
+		input = append([]byte{}, s.pasteBuf[end+len(pasteEnd):]...)
+		s.pasteBuf = nil
+		s.pasting = false
+	}
+	return typed, pasted
+}
+
+func (s *stdfdsHandler) setPasteGuard(pasteGuard bool) {
+	if pasteGuard == s.pasteGuard {
+		return
+	}
+	s.pasteGuard = pasteGuard
+	s.pasting = false
+	s.pasteBuf = nil
+	if s.console != nil {
+		if pasteGuard {
+			_, _ = os.Stdout.WriteString(enableBracketedPaste)
+		} else {
+			_, _ = os.Stdout.WriteString(disableBracketedPaste)
+		}
+	}
+}
+
+// Adds the typed characters to the hex input buffer, echoing them, and returns the bytes to send when the buffer is
+// committed with Enter
+func (s *stdfdsHandler) editHexInput(input []byte) []byte {
+	var out []byte
+	var echo bytes.Buffer
+	for _, char := range input {
+		switch {
+		case (char >= '0' && char <= '9') || (char >= 'a' && char <= 'f') || (char >= 'A' && char <= 'F') || char == ' ':
+			s.hexInputBuf = append(s.hexInputBuf, char)
+			echo.WriteByte(char)
+		case char == 0x7f || char == '\b':
+			if len(s.hexInputBuf) > 0 {
+				s.hexInputBuf = s.hexInputBuf[:len(s.hexInputBuf)-1]
+				echo.WriteString("\b \b")
+			}
+		case char == '\r' || char == '\n':
+			echo.WriteString("\r\n")
+			data, err := parseHexInput(s.hexInputBuf)
+			s.hexInputBuf = s.hexInputBuf[:0]
+			if err != nil {
+				_, _ = os.Stdout.Write(echo.Bytes())
+				echo.Reset()
+				s.rawTtyPrintfLn(true, "Invalid hex input: %v", err)
+				continue
+			}
+			out = append(out, data...)
+		}
+	}
+	_, _ = os.Stdout.Write(echo.Bytes())
+	_ = os.Stdout.Sync()
+	return out
+}
+
+// Parses space separated groups of hex digit pairs, i.e. "AA 55 01FF"
+func parseHexInput(input []byte) ([]byte, error) {
+	var out []byte
+	for _, group := range strings.Fields(string(input)) {
+		if len(group)%2 != 0 {
+			return nil, fmt.Errorf("odd number of digits in %s", group)
+		}
+		data, err := hex.DecodeString(group)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, data...)
+	}
+	return out, nil
+}
+
+// Shows a prompt, the line typed is passed to done when Enter is pressed
+func (s *stdfdsHandler) startPrompt(label string, done func(line string)) {
+	ttyc.TtycPrintf("%s: ", label)
+	_ = s.statusOutput().Sync()
+	s.prompt = &linePrompt{done: done}
+}
+
+// Edits the prompt line with the typed characters. Enter submits it, Esc and ctrl-c cancel it.
+func (s *stdfdsHandler) editPrompt(input []byte) {
+	var echo bytes.Buffer
+	output := s.statusOutput()
+	defer func() {
+		_, _ = output.Write(echo.Bytes())
+		_ = output.Sync()
+	}()
+	for _, char := range input {
+		switch {
+		case char == '\r' || char == '\n':
+			echo.WriteString("\r\n")
+			prompt := s.prompt
+			s.prompt = nil
+			_, _ = output.Write(echo.Bytes())
+			echo.Reset()
+			prompt.done(strings.TrimSpace(string(prompt.buf)))
+			return
+		case char == 0x1b || char == 0x03:
+			echo.WriteString("\r\n")
+			s.prompt = nil
+			return
+		case char == 0x7f || char == '\b':
+			if len(s.prompt.buf) > 0 {
+				_, size := utf8.DecodeLastRune(s.prompt.buf)
+				s.prompt.buf = s.prompt.buf[:len(s.prompt.buf)-size]
+				echo.WriteString("\b \b")
+			}
+		case char >= 0x20:
+			s.prompt.buf = append(s.prompt.buf, char)
+			echo.WriteByte(char)
+		}
+	}
+}
+
+func (s *stdfdsHandler) setHexInputMode(hexInputMode bool) {
+	if s.hexInputMode && !hexInputMode && len(s.hexInputBuf) > 0 {
+		// Discard the uncommitted input
+		s.hexInputBuf = s.hexInputBuf[:0]
+		_, _ = os.Stdout.WriteString("\r\n")
+	}
+	s.hexInputMode = hexInputMode
+}
+
 func (s *stdfdsHandler) printStats() {
 	statsUrl := ttyc.GetUrlFor(ttyc.UrlForStats, s.client.BaseUrl)
 	res, err := http.Get(statsUrl.String())
@@ -206,12 +580,19 @@ func (s *stdfdsHandler) printStats() {
 }
 
 func (s *stdfdsHandler) handleCommand(command byte, errChan chan<- error) []byte {
+	// The other commands may block on the server, they must not hold up the output
+	switch command {
+	case LocalEchoChar, HexModeChar, FrameModeChar, DecoderChar, ControlsChar, PasteGuardChar, HexInputChar, TimestampsChar:
+		s.modeMutex.Lock()
+		defer s.modeMutex.Unlock()
+	}
+
 	switch command {
 	case QuitChar:
-		println("")
-		errChan <- fmt.Errorf("quitting")
+		s.printStatusNewLine()
+		errChan <- &ExitStatus{Status: 0, Err: fmt.Errorf("quitting")}
 	case ConfigChar:
-		println("")
+		s.printStatusNewLine()
 		s.rawTtyPrintfLn(false, "Configuration:")
 
 		additionalServerInfo := ""
@@ -220,6 +601,15 @@ func (s *stdfdsHandler) handleCommand(command byte, errChan chan<- error) []byte
 		}
 		wsUrl := ttyc.GetUrlFor(ttyc.UrlForWebSocket, s.client.BaseUrl)
 		s.rawTtyPrintfLn(false, " Remote server: %s%s", wsUrl.String(), additionalServerInfo)
+		if s.mapping != nil {
+			s.rawTtyPrintfLn(false, " Mapping: %s", s.mapping)
+		}
+		s.modeMutex.Lock()
+		charset := s.charset
+		s.modeMutex.Unlock()
+		if charset != nil {
+			s.rawTtyPrintfLn(false, " Charset: %s", charset.Name)
+		}
 
 		if s.implementation == ttyc.ImplementationWiSe {
 			sttyUrl := ttyc.GetUrlFor(ttyc.UrlForStty, s.client.BaseUrl)
@@ -239,7 +629,7 @@ func (s *stdfdsHandler) handleCommand(command byte, errChan chan<- error) []byte
 			}
 		}
 	case DetectBaudChar:
-		println("")
+		s.printStatusNewLine()
 		if s.implementation == ttyc.ImplementationWiSe {
 			s.rawTtyPrintfLn(false, "Requesting baud rate detection (it may take up to 10 seconds)")
 			s.client.RequestBaudrateDetection()
@@ -250,20 +640,130 @@ func (s *stdfdsHandler) handleCommand(command byte, errChan chan<- error) []byte
 		s.client.SendBreak()
 	case ClearChar:
 		// Clear screen using ANSI/VT100 escape code
-		print(ClearSequence)
-		_ = os.Stdout.Sync()
+		_, _ = s.statusOutput().WriteString(ClearSequence)
+		_ = s.statusOutput().Sync()
 	case CtrlTChar:
 		// Put back escape char into buffer
 		return []byte{EscapeChar}
 	case LocalEchoChar:
 		s.localEchoMode = !s.localEchoMode
 	case HexModeChar:
-		s.hexMode = !s.hexMode
+		s.setHexMode(!s.hexMode)
+	case FrameModeChar:
+		s.printStatusNewLine()
+		s.frameMode = !s.frameMode
+		if s.frameMode {
+			s.rawTtyPrintfLn(false, "Frame mode: output split on %v idle gaps", s.frames.gap)
+		} else {
+			s.rawTtyPrintfLn(false, "Frame mode off")
+		}
+	case DecoderChar:
+		// Cycle through off and all the decoders, starting over from the first one
+		s.printStatusNewLine()
+		name := ""
+		if s.decoder != nil {
+			name = s.decoder.Name
+		}
+		if err := s.setDecoder(nextDecoder(name)); err != nil {
+			s.rawTtyPrintfLn(true, "Failed to set decoder: %v", err)
+		} else if s.decoder != nil {
+			s.rawTtyPrintfLn(false, "Decoder: %s", s.decoder.Name)
+		} else {
+			s.rawTtyPrintfLn(false, "Decoder: off")
+		}
+	case ControlsChar:
+		s.printStatusNewLine()
+		s.visibleControls = !s.visibleControls
+		if s.visibleControls {
+			s.rawTtyPrintfLn(false, "Visible control characters on")
+		} else {
+			s.rawTtyPrintfLn(false, "Visible control characters off")
+		}
+	case SendFilesChar:
+		s.printStatusNewLine()
+		s.startPrompt("Send files (protocol:file[,file])", func(line string) {
+			s.startTransferFromPrompt(line, true)
+		})
+	case ReceiveChar:
+		s.printStatusNewLine()
+		s.startPrompt("Receive files (protocol[:path])", func(line string) {
+			s.startTransferFromPrompt(line, false)
+		})
+	case SendTextChar:
+		s.printStatusNewLine()
+		s.startPrompt("Send text file", func(line string) {
+			if line == "" {
+				return
+			}
+			if err := s.SendFile(line); err != nil {
+				s.rawTtyPrintfLn(true, "%v", err)
+			}
+		})
+	case CommandChar, PipeChar:
+		s.printStatusNewLine()
+		label := "Run command"
+		if command == PipeChar {
+			label = "Pipe through command"
+		}
+		s.startPrompt(label, func(line string) {
+			if line == "" {
+				return
+			}
+			if err := s.runCommand(line, command == PipeChar); err != nil {
+				s.rawTtyPrintfLn(true, "%v", err)
+			}
+		})
+	case PasteGuardChar:
+		s.printStatusNewLine()
+		s.setPasteGuard(!s.pasteGuard)
+		if !s.pasteGuard {
+			s.rawTtyPrintfLn(false, "Paste guard off")
+		} else if s.pacing.IsZero() {
+			s.rawTtyPrintfLn(false, "Paste guard on, but no pacing is configured (see --char-delay and --line-delay)")
+		} else {
+			s.rawTtyPrintfLn(false, "Paste guard on: %s", &s.pacing)
+		}
+	case HexInputChar:
+		s.printStatusNewLine()
+		s.setHexInputMode(!s.hexInputMode)
+		if s.hexInputMode {
+			s.rawTtyPrintfLn(false, "Hex input mode: type hex bytes, i.e. AA 55 01 FF, and press Enter to send them")
+		} else {
+			s.rawTtyPrintfLn(false, "Hex input mode off")
+		}
 	case TimestampsChar:
-		s.showTimestamps = !s.showTimestamps
+		// Cycle through off and all the formats, starting over from the first one
+		s.printStatusNewLine()
+		if !s.showTimestamps {
+			s.showTimestamps = true
+			s.timestamper.format = TimestampFormats[0]
+		} else if next := nextTimestampFormat(s.timestamper.format); next != "" {
+			s.timestamper.format = next
+		} else {
+			s.showTimestamps = false
+		}
 		s.nextIsTimestamp = false
+		if s.showTimestamps {
+			s.rawTtyPrintfLn(false, "Timestamps: %s", s.timestamper.format)
+		} else {
+			s.rawTtyPrintfLn(false, "Timestamps: off")
+		}
+	case LogChar:
+		s.printStatusNewLine()
+		if s.logger == nil {
+			s.rawTtyPrintfLn(true, "Logging is not available")
+			break
+		}
+		path, started, err := s.logger.Toggle()
+		if err != nil {
+			s.rawTtyPrintfLn(true, "Failed to toggle logging: %v", err)
+		} else if started {
+			s.rawTtyPrintfLn(false, "Logging to %s", path)
+		} else {
+			s.rawTtyPrintfLn(false, "Stopped logging to %s", path)
+		}
 	case HelpChar:
-		println("")
+		s.printStatusNewLine()
 		s.rawTtyPrintfLn(false, "Key commands:")
 		cmdsHelpOrder := make([]int, len(cmdsInfo))
 		i := 0
@@ -293,34 +793,74 @@ func (s *stdfdsHandler) handleCommand(command byte, errChan chan<- error) []byte
 	case StatsChar:
 		s.printStats()
 	case VersionChar:
-		println()
+		s.printStatusNewLine()
 		s.rawTtyPrintfLn(false, "ttyc %s", ttyc.VERSION)
 	}
 
 	return []byte{}
 }
 
-func bufferToHex(inBuf []byte) (outBuf []byte) {
-	outBuf = []byte{}
-	for _, value := range inBuf {
-		if value == '\n' || value == '\r' {
-			outBuf = append(outBuf, value)
-		} else {
-			byteStr := fmt.Sprintf("%02x ", value)
-			outBuf = append(outBuf, []byte(byteStr)...)
-		}
+func (s *stdfdsHandler) setHexMode(hexMode bool) {
+	if s.hexMode && !hexMode {
+		_, _ = os.Stdout.Write(s.hexDumper.finish())
 	}
-	return
+	s.hexMode = hexMode
+}
+
+// Converts text received from the server or sent to it to UTF-8
+func (s *stdfdsHandler) toUtf8(data []byte) []byte {
+	if s.charset == nil {
+		return data
+	}
+	return s.charset.Decode(data)
+}
+
+// Sets the remote charset by name, an empty name disables the conversion
+func (s *stdfdsHandler) setCharset(name string) error {
+	charset, err := LookupCharset(name)
+	if err != nil {
+		return err
+	}
+	if charset != s.charset {
+		s.charset = charset
+		s.charsetEncoder = charsetEncoder{charset: charset}
+	}
+	return nil
+}
+
+// Sets the protocol decoder by name, an empty name disables decoding
+func (s *stdfdsHandler) setDecoder(name string) error {
+	if name == "" {
+		s.decoder = nil
+		return nil
+	}
+	if s.decoder != nil && s.decoder.Name == name {
+		return nil
+	}
+	decoder, err := decoders.NewStream(name, s.frames.gap)
+	if err != nil {
+		return err
+	}
+	s.decoder = decoder
+	return nil
 }
 
-func (s *stdfdsHandler) injectTimestamps(inBuf []byte) (outBuf []byte) {
+// Returns the timestamp to prepend to a line, if timestamps are enabled
+func (s *stdfdsHandler) timestampPrefix(now time.Time) string {
+	if !s.showTimestamps {
+		return ""
+	}
+	return fmt.Sprintf(ttyc.PlatformGray()+"[%s]"+color.Reset+" ", s.timestamper.stamp(now))
+}
+
+func (s *stdfdsHandler) injectTimestamps(inBuf []byte, now time.Time) (outBuf []byte) {
 	outBuf = inBuf
-	tstamp := []byte(fmt.Sprintf(ttyc.PlatformGray()+"[%s]"+color.Reset+" ", ttyc.Strftime.FormatString(time.Now())))
 
 	i := 0
 
 	for i < len(outBuf) {
 		if s.nextIsTimestamp && i != len(outBuf)-1 {
+			tstamp := []byte(s.timestampPrefix(now))
 			end := append([]byte{}, outBuf[i:]...)
 			outBuf = append(outBuf[:i], tstamp...)
 			outBuf = append(outBuf, end...)
@@ -335,32 +875,355 @@ func (s *stdfdsHandler) injectTimestamps(inBuf []byte) (outBuf []byte) {
 	return
 }
 
+func writeAll(buf []byte) error {
+	written := 0
+	for written < len(buf) {
+		bWritten, err := os.Stdout.Write(buf[written:])
+		if err != nil {
+			return err
+		}
+		written += bWritten
+	}
+	_ = os.Stdout.Sync()
+	return nil
+}
+
+// Renders a frame completed by an idle gap
+func (s *stdfdsHandler) renderFrame(frame []byte, start time.Time) []byte {
+	stamp := s.timestampPrefix(start)
+	if stamp == "" {
+		stamp = fmt.Sprintf(ttyc.PlatformGray()+"[%s]"+color.Reset+" ", start.Format("15:04:05.000"))
+	}
+	return renderFrame(frame, stamp)
+}
+
+// Renders the frames found by a decoder
+func (s *stdfdsHandler) renderDecodedFrames(decoder *decoders.Stream, frames []decoders.Frame) []byte {
+	var buf []byte
+	for _, frame := range frames {
+		stamp := s.timestampPrefix(frame.Time)
+		if stamp == "" {
+			stamp = fmt.Sprintf(ttyc.PlatformGray()+"[%s]"+color.Reset+" ", frame.Time.Format("15:04:05.000"))
+		}
+		buf = append(buf, renderDecodedFrame(decoder.Name, frame, stamp)...)
+	}
+	return buf
+}
+
 func (s *stdfdsHandler) printOutput(errChan chan<- error) {
+	// Fires when the line has been idle for long enough to complete the pending frame
+	var frameTimer <-chan time.Time
 	for {
+		var buf []byte
 		select {
 		case <-s.client.CloseChan:
 			return
-		case buf := <-s.client.Output:
-			if s.hexMode {
-				buf = bufferToHex(buf)
+		case now := <-frameTimer:
+			frameTimer = nil
+			s.modeMutex.Lock()
+			// The decoder may be changed by key commands at any time
+			if decoder := s.decoder; decoder != nil {
+				buf = s.renderDecodedFrames(decoder, decoder.Idle())
+			} else if frame, start := s.frames.flush(); len(frame) > 0 {
+				buf = s.renderFrame(frame, start)
 			}
-			if s.showTimestamps {
-				buf = s.injectTimestamps(buf)
+			// Bytes held back by the visible controls mode are rendered as they are once the line is idle
+			if pending := s.controls.flush(); len(pending) > 0 {
+				if s.showTimestamps {
+					pending = s.injectTimestamps(pending, now)
+				}
+				buf = append(buf, pending...)
 			}
-			written := 0
-			for written < len(buf) {
-				bWritten, err := os.Stdout.Write(buf[written:])
-				if err != nil {
-					errChan <- err
-					return
+		case chunk := <-s.client.Output:
+			switch task := s.activeTask().(type) {
+			case *clientLink:
+				// The output isn't shown during transfers
+				task.feed(chunk.Data)
+				continue
+			case *pacedSender:
+				task.observe(chunk.Data)
+			case *commandTask:
+				if task.feedOutput {
+					// The output is only shown to the command
+					task.feed(chunk.Data)
+					continue
 				}
-				written += bWritten
 			}
-			_ = os.Stdout.Sync()
+			s.modeMutex.Lock()
+			buf = chunk.Data
+			if decoder := s.decoder; decoder != nil {
+				s.hexDumper.skip(hexDirectionRx, len(buf))
+				buf = s.renderDecodedFrames(decoder, decoder.Feed(chunk.Data, chunk.Time))
+				frameTimer = time.After(decoder.Gap)
+			} else if s.frameMode {
+				s.hexDumper.skip(hexDirectionRx, len(buf))
+				buf = nil
+				if frame, start := s.frames.add(chunk.Data, chunk.Time); len(frame) > 0 {
+					buf = s.renderFrame(frame, start)
+				}
+				frameTimer = time.After(s.frames.gap)
+			} else if s.hexMode {
+				buf = s.hexDumper.dump(hexDirectionRx, buf, s.localEchoMode, func() string {
+					return s.timestampPrefix(chunk.Time)
+				})
+			} else if s.visibleControls {
+				s.hexDumper.skip(hexDirectionRx, len(buf))
+				buf = s.controls.render(s.toUtf8(buf))
+				frameTimer = time.After(s.frames.gap)
+				if s.showTimestamps {
+					buf = s.injectTimestamps(buf, chunk.Time)
+				}
+			} else {
+				s.hexDumper.skip(hexDirectionRx, len(buf))
+				buf = s.toUtf8(buf)
+				// Bytes held back before leaving the visible controls mode
+				if pending := s.controls.flush(); len(pending) > 0 {
+					buf = append(pending, buf...)
+				}
+				if s.showTimestamps {
+					buf = s.injectTimestamps(buf, chunk.Time)
+				}
+			}
+		}
+		// Written before releasing the mutex, so that the output of the previous modes comes before the messages
+		// about the change
+		err := writeAll(buf)
+		s.modeMutex.Unlock()
+		if err != nil {
+			errChan <- err
+			return
 		}
 	}
 }
 
+func (s *stdfdsHandler) activeTask() backgroundTask {
+	s.taskMutex.Lock()
+	defer s.taskMutex.Unlock()
+	return s.task
+}
+
+// Starts a task, unless one is already running
+func (s *stdfdsHandler) startTask(task backgroundTask) error {
+	s.taskMutex.Lock()
+	defer s.taskMutex.Unlock()
+	if s.task != nil {
+		return fmt.Errorf("a transfer or a command is already running")
+	}
+	s.task = task
+	return nil
+}
+
+func (s *stdfdsHandler) setTask(task backgroundTask) {
+	s.taskMutex.Lock()
+	s.task = task
+	s.taskMutex.Unlock()
+}
+
+func (s *stdfdsHandler) startTransferFromPrompt(line string, send bool) {
+	if line == "" {
+		return
+	}
+	request, err := ParseTransfer(line, send)
+	if err != nil {
+		s.rawTtyPrintfLn(true, "Invalid transfer: %v", err)
+		return
+	}
+	if err := s.StartTransfer(request); err != nil {
+		s.rawTtyPrintfLn(true, "%v", err)
+	}
+}
+
+// StartTransfer runs a file transfer in the background. The output isn't shown and the input is ignored until it's
+// over, except for ctrl-c which cancels it.
+func (s *stdfdsHandler) StartTransfer(request *TransferRequest) error {
+	link := newClientLink(s.client)
+	if err := s.startTask(link); err != nil {
+		return err
+	}
+	go s.runTransfer(request, link)
+	return nil
+}
+
+func (s *stdfdsHandler) runTransfer(request *TransferRequest, link *clientLink) {
+	// Binary data must not be mapped
+	s.client.DisableMapping(true)
+	defer s.client.DisableMapping(false)
+
+	s.rawTtyPrintfLn(false, "Starting %s, press ctrl-c to cancel", request)
+	progress := transferProgress{verb: "Receiving"}
+	var received []string
+	var err error
+	if request.Send {
+		progress.verb = "Sending"
+		err = transfer.Send(link, request.Protocol, request.Paths, progress.update)
+	} else {
+		path := ""
+		if len(request.Paths) > 0 {
+			path = request.Paths[0]
+		}
+		received, err = transfer.Receive(link, request.Protocol, path, progress.update)
+	}
+	if err == transfer.ErrCanceled {
+		link.cancelRemote()
+	}
+	if err != nil && err != errSessionClosed {
+		// Keep hiding the output until the remote side gives up, so that the rest of the transfer isn't shown. The
+		// failed link may be canceled, so a new one collects it.
+		link = newClientLink(s.client)
+		s.setTask(link)
+		link.drain(500*time.Millisecond, 5*time.Second)
+	}
+	s.setTask(nil)
+	progress.finish()
+
+	switch {
+	case err == transfer.ErrCanceled:
+		s.rawTtyPrintfLn(true, "Transfer canceled")
+	case err != nil:
+		s.rawTtyPrintfLn(true, "Transfer failed: %v", err)
+	case request.Send:
+		s.rawTtyPrintfLn(false, "Sent %s", strings.Join(request.Paths, ", "))
+	case len(received) == 0:
+		s.rawTtyPrintfLn(false, "No files received")
+	default:
+		s.rawTtyPrintfLn(false, "Received %s", strings.Join(received, ", "))
+	}
+}
+
+func (s *stdfdsHandler) newPacedSender() *pacedSender {
+	var pacer *pacedSender
+	pacer = newPacedSender(s.pacing, func(data []byte) error {
+		s.modeMutex.Lock()
+		s.echoInput(data)
+		s.modeMutex.Unlock()
+		select {
+		case s.client.Input <- data:
+			return nil
+		case <-pacer.canceled:
+			return errPacingCanceled
+		case <-s.client.CloseChan:
+			return errSessionClosed
+		}
+	})
+	return pacer
+}
+
+// SendFile sends a text file in the background, paced as configured. The input is ignored until it's over, except for
+// ctrl-c which cancels it.
+func (s *stdfdsHandler) SendFile(path string) error {
+	text, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	s.modeMutex.Lock()
+	if s.charset != nil {
+		// The file is converted on its own, a truncated character at its end is sent as it is
+		encoder := charsetEncoder{charset: s.charset}
+		text = append(encoder.encode(text), encoder.pending...)
+	}
+	s.modeMutex.Unlock()
+	pacer := s.newPacedSender()
+	if err := s.startTask(pacer); err != nil {
+		return err
+	}
+	s.rawTtyPrintfLn(false, "Sending %s, press ctrl-c to cancel", path)
+	go func() {
+		err := pacer.run(text)
+		s.setTask(nil)
+		switch {
+		case err == errPacingCanceled:
+			s.rawTtyPrintfLn(true, "Sending %s canceled", path)
+		case err != nil:
+			s.rawTtyPrintfLn(true, "Sending %s failed: %v", path, err)
+		default:
+			s.rawTtyPrintfLn(false, "Sent %s", path)
+		}
+	}()
+	return nil
+}
+
+// Runs a local command in the background, sending its standard output to the remote terminal. If feedOutput is true,
+// the output of the remote terminal is written to its standard input instead of being shown. The input is ignored
+// until it's over, except for ctrl-c which stops it.
+func (s *stdfdsHandler) runCommand(command string, feedOutput bool) error {
+	var stderr io.Writer = os.Stderr
+	if s.console != nil {
+		stderr = rawTerminalWriter{os.Stderr}
+	}
+	task, err := startCommandTask(command, feedOutput, stderr)
+	if err != nil {
+		return fmt.Errorf("unable to run %s: %v", command, err)
+	}
+	if err := s.startTask(task); err != nil {
+		task.cancel()
+		go task.wait()
+		return err
+	}
+	s.rawTtyPrintfLn(false, "Running %s, press ctrl-c to stop it", command)
+	go func() {
+		for {
+			buf := make([]byte, 4096)
+			bRead, err := task.stdout.Read(buf)
+			if bRead > 0 {
+				data := buf[:bRead]
+				s.modeMutex.Lock()
+				if s.charset != nil {
+					data = s.charsetEncoder.encode(data)
+				}
+				s.echoInput(data)
+				s.modeMutex.Unlock()
+				select {
+				case s.client.Input <- data:
+				case <-s.client.CloseChan:
+					task.cancel()
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		canceled, err := task.wait()
+		s.setTask(nil)
+		exitErr, failed := err.(*exec.ExitError)
+		switch {
+		case task.isStalled():
+			s.rawTtyPrintfLn(true, "%s stopped, it didn't read the output", command)
+		case canceled:
+			s.rawTtyPrintfLn(true, "%s stopped", command)
+		case failed:
+			s.rawTtyPrintfLn(true, "%s exited with status %d", command, exitErr.ExitCode())
+		case err != nil:
+			s.rawTtyPrintfLn(true, "%s failed: %v", command, err)
+		default:
+			s.rawTtyPrintfLn(false, "%s done", command)
+		}
+	}()
+	return nil
+}
+
+// Sends pasted text in the background, paced as configured
+func (s *stdfdsHandler) sendPaste(text []byte) {
+	s.modeMutex.Lock()
+	if s.charset != nil {
+		text = s.charsetEncoder.encode(text)
+	}
+	s.modeMutex.Unlock()
+	pacer := s.newPacedSender()
+	if err := s.startTask(pacer); err != nil {
+		s.rawTtyPrintfLn(true, "Paste discarded: %v", err)
+		return
+	}
+	go func() {
+		err := pacer.run(text)
+		s.setTask(nil)
+		if err == errPacingCanceled {
+			s.rawTtyPrintfLn(true, "Paste canceled")
+		} else if err != nil {
+			s.rawTtyPrintfLn(true, "Paste interrupted: %v", err)
+		}
+	}()
+}
+
 func (s *stdfdsHandler) Run(errChan chan<- error) {
 	if err := s.HandleReconnect(); err != nil {
 		errChan <- err
@@ -368,15 +1231,21 @@ func (s *stdfdsHandler) Run(errChan chan<- error) {
 	}
 
 	cmdHandlingChan := make(chan []byte, 1)
-	go utils.CopyReaderToChan(s.client.CloseChan, os.Stdin, cmdHandlingChan, errChan)
+	if s.pipe == nil {
+		go utils.CopyReaderToChan(s.client.CloseChan, os.Stdin, cmdHandlingChan, errChan)
+	} else {
+		go copyPipeToChan(s.client.CloseChan, os.Stdin, cmdHandlingChan, errChan)
+	}
 	go s.handleStdin(s.client.CloseChan, cmdHandlingChan, s.client.Input, errChan)
 	go s.printOutput(errChan)
 
 	winch := make(chan switzerland.WinchSignal)
-	switz := switzerland.GetSwitzerland()
-	defer switz.Stop(winch)
+	if s.pipe == nil {
+		switz := switzerland.GetSwitzerland()
+		defer switz.Stop(winch)
+		switz.Notify(winch)
+	}
 	defer close(winch)
-	switz.Notify(winch)
 
 	for {
 		select {
@@ -415,6 +1284,11 @@ func (s *stdfdsHandler) Run(errChan chan<- error) {
 
 func (s *stdfdsHandler) HandleDisconnect() error {
 	if s.console != nil {
+		s.modeMutex.Lock()
+		if s.pasteGuard {
+			_, _ = os.Stdout.WriteString(disableBracketedPaste)
+		}
+		s.modeMutex.Unlock()
 		if err := (*s.console).Reset(); err != nil {
 			ttyc.Trace()
 			return err
@@ -431,6 +1305,9 @@ func (s *stdfdsHandler) HandleDisconnect() error {
 }
 
 func (s *stdfdsHandler) HandleReconnect() error {
+	if s.pipe != nil {
+		return nil
+	}
 	current := console.Current()
 	s.console = &current
 	if err := current.SetRaw(); err != nil {
@@ -442,6 +1319,11 @@ func (s *stdfdsHandler) HandleReconnect() error {
 		ttyc.Trace()
 		return err
 	}
+	s.modeMutex.Lock()
+	if s.pasteGuard {
+		_, _ = os.Stdout.WriteString(enableBracketedPaste)
+	}
+	s.modeMutex.Unlock()
 	//println("RESIZE TERM")
 	s.client.ResizeTerminal(int(winSize.Width), int(winSize.Height))
 	//println("TERM RESIZED")
@@ -454,3 +1336,81 @@ func (s *stdfdsHandler) Close() error {
 	}
 	return nil
 }
+
+func (s *stdfdsHandler) Modes() Modes {
+	s.modeMutex.Lock()
+	defer s.modeMutex.Unlock()
+	decoderName := ""
+	if s.decoder != nil {
+		decoderName = s.decoder.Name
+	}
+	charsetName := ""
+	if s.charset != nil {
+		charsetName = s.charset.Name
+	}
+	logError := ""
+	if s.logger != nil {
+		if err := s.logger.Err(); err != nil {
+			logError = err.Error()
+		}
+	}
+	return Modes{
+		LocalEcho:       s.localEchoMode,
+		Hex:             s.hexMode,
+		Timestamps:      s.showTimestamps,
+		TimestampFormat: s.timestamper.format,
+		HexInput:        s.hexInputMode,
+		Frames:          s.frameMode,
+		FrameGap:        s.frames.gap.Milliseconds(),
+		Decoder:         decoderName,
+		VisibleControls: s.visibleControls,
+		DimControls:     s.controls.dim,
+		Charset:         charsetName,
+		PasteGuard:      s.pasteGuard,
+		LogError:        logError,
+	}
+}
+
+// SetModes is called by the control API and on reload, while the input and output are handled
+func (s *stdfdsHandler) SetModes(modes Modes) {
+	s.modeMutex.Lock()
+	defer s.modeMutex.Unlock()
+	s.localEchoMode = modes.LocalEcho
+	s.setHexMode(modes.Hex)
+	if s.showTimestamps != modes.Timestamps {
+		s.showTimestamps = modes.Timestamps
+		s.nextIsTimestamp = false
+	}
+	s.setHexInputMode(modes.HexInput)
+	s.frameMode = modes.Frames
+	if modes.FrameGap > 0 {
+		s.frames.gap = time.Duration(modes.FrameGap) * time.Millisecond
+		if s.decoder != nil {
+			s.decoder.Gap = s.frames.gap
+		}
+	}
+	s.visibleControls = modes.VisibleControls
+	s.controls.dim = modes.DimControls
+	if err := s.setDecoder(modes.Decoder); err != nil {
+		s.rawTtyPrintfLn(true, "Failed to set decoder: %v", err)
+	}
+	if err := s.setCharset(modes.Charset); err != nil {
+		s.rawTtyPrintfLn(true, "Failed to set charset: %v", err)
+	}
+	s.setPasteGuard(modes.PasteGuard)
+	if modes.TimestampFormat != "" {
+		s.timestamper.format = modes.TimestampFormat
+	}
+}
+
+func (s *stdfdsHandler) SetLogger(logger *SessionLogger) {
+	s.logger = logger
+}
+
+func (s *stdfdsHandler) SetMapping(mapping *Mapping) {
+	s.mapping = mapping
+}
+
+func (s *stdfdsHandler) SetPacing(pacing Pacing) {
+	s.pacing = pacing
+}
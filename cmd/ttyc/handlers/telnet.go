@@ -0,0 +1,212 @@
+package handlers
+
+// Telnet protocol (RFC 854), as much of it as needed to serve the remote terminal to telnet clients
+
+import (
+	"bytes"
+)
+
+const (
+	telnetSE   = 240
+	telnetBRK  = 243
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+)
+
+const (
+	telnetOptBinary = 0
+	telnetOptEcho   = 1
+	telnetOptSGA    = 3
+	telnetOptNAWS   = 31
+)
+
+// Negotiation state of an option on one side of the connection, as in RFC 1143 without the queue
+const (
+	telnetOptNo = iota
+	telnetOptWantYes
+	telnetOptYes
+)
+
+// Decoder states
+const (
+	telnetStateData = iota
+	telnetStateCR
+	telnetStateIAC
+	telnetStateOption
+	telnetStateSB
+	telnetStateSBIAC
+)
+
+// Subnegotiations longer than this are not valid for any supported option and are discarded
+const telnetMaxSB = 256
+
+// telnetCodec decodes the data received from a telnet client, answering its option negotiations
+type telnetCodec struct {
+	// Options enabled on our side (WILL) and on the client side (DO)
+	local  [256]byte
+	remote [256]byte
+	// Options that we accept to enable on each side
+	localSupported  map[byte]bool
+	remoteSupported map[byte]bool
+	// Negotiation replies not sent yet
+	replies []byte
+	// Called for commands other than option negotiations, i.e. BRK
+	onCommand func(command byte)
+	// Called with the parameters of the subnegotiations of enabled options
+	onSubnegotiation func(option byte, params []byte)
+
+	state int
+	verb  byte
+	sb    []byte
+}
+
+func newTelnetCodec() *telnetCodec {
+	return &telnetCodec{
+		localSupported:  map[byte]bool{telnetOptBinary: true, telnetOptEcho: true, telnetOptSGA: true},
+		remoteSupported: map[byte]bool{telnetOptBinary: true, telnetOptSGA: true, telnetOptNAWS: true},
+	}
+}
+
+func (t *telnetCodec) reply(data []byte) {
+	t.replies = append(t.replies, data...)
+}
+
+// Returns the negotiation data to send to the client, after start and decode
+func (t *telnetCodec) takeReplies() []byte {
+	replies := t.replies
+	t.replies = nil
+	return replies
+}
+
+// Asks the client to enable the supported options: binary transmission in both directions, no go-ahead, and remote
+// echo and line editing so that the client sends keys as they are typed. The size of the terminal is requested too.
+func (t *telnetCodec) start() {
+	var negotiation []byte
+	for option := 0; option < 256; option++ {
+		if t.localSupported[byte(option)] {
+			t.local[option] = telnetOptWantYes
+			negotiation = append(negotiation, telnetIAC, telnetWILL, byte(option))
+		}
+	}
+	for option := 0; option < 256; option++ {
+		if t.remoteSupported[byte(option)] {
+			t.remote[option] = telnetOptWantYes
+			negotiation = append(negotiation, telnetIAC, telnetDO, byte(option))
+		}
+	}
+	t.reply(negotiation)
+}
+
+// Escapes IAC in data sent to the client, including subnegotiation parameters
+func telnetEscape(data []byte) []byte {
+	if bytes.IndexByte(data, telnetIAC) < 0 {
+		return data
+	}
+	return bytes.ReplaceAll(data, []byte{telnetIAC}, []byte{telnetIAC, telnetIAC})
+}
+
+// Decodes data received from the client, returning the terminal input it contains
+func (t *telnetCodec) decode(data []byte) []byte {
+	input := make([]byte, 0, len(data))
+	for _, b := range data {
+		switch t.state {
+		case telnetStateData, telnetStateCR:
+			if b == telnetIAC {
+				t.state = telnetStateIAC
+				continue
+			}
+			// Outside of binary mode, CR is followed by NUL when it's not a line feed
+			if t.state == telnetStateCR && b == 0 {
+				t.state = telnetStateData
+				continue
+			}
+			t.state = telnetStateData
+			if b == '\r' && t.remote[telnetOptBinary] != telnetOptYes {
+				t.state = telnetStateCR
+			}
+			input = append(input, b)
+		case telnetStateIAC:
+			t.state = telnetStateData
+			switch b {
+			case telnetIAC:
+				input = append(input, b)
+			case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+				t.verb = b
+				t.state = telnetStateOption
+			case telnetSB:
+				t.sb = t.sb[:0]
+				t.state = telnetStateSB
+			default:
+				if t.onCommand != nil {
+					t.onCommand(b)
+				}
+			}
+		case telnetStateOption:
+			t.state = telnetStateData
+			t.negotiate(t.verb, b)
+		case telnetStateSB:
+			if b == telnetIAC {
+				t.state = telnetStateSBIAC
+			} else if len(t.sb) < telnetMaxSB {
+				t.sb = append(t.sb, b)
+			}
+		case telnetStateSBIAC:
+			switch b {
+			case telnetIAC:
+				t.state = telnetStateSB
+				if len(t.sb) < telnetMaxSB {
+					t.sb = append(t.sb, b)
+				}
+			case telnetSE:
+				t.state = telnetStateData
+				t.subnegotiation()
+			default:
+				// Broken subnegotiation, drop it
+				t.state = telnetStateData
+			}
+		}
+	}
+	return input
+}
+
+func (t *telnetCodec) subnegotiation() {
+	if len(t.sb) == 0 || t.onSubnegotiation == nil {
+		return
+	}
+	option := t.sb[0]
+	if t.local[option] != telnetOptYes && t.remote[option] != telnetOptYes {
+		return
+	}
+	t.onSubnegotiation(option, t.sb[1:])
+}
+
+// Answers an option negotiation, replying only to requests that change the state so that negotiations don't loop
+func (t *telnetCodec) negotiate(verb byte, option byte) {
+	states, supported, accept, refuse := &t.remote, t.remoteSupported, byte(telnetDO), byte(telnetDONT)
+	if verb == telnetDO || verb == telnetDONT {
+		states, supported, accept, refuse = &t.local, t.localSupported, telnetWILL, telnetWONT
+	}
+	enable := verb == telnetWILL || verb == telnetDO
+
+	switch {
+	case enable && states[option] == telnetOptNo:
+		if supported[option] {
+			states[option] = telnetOptYes
+			t.reply([]byte{telnetIAC, accept, option})
+		} else {
+			t.reply([]byte{telnetIAC, refuse, option})
+		}
+	case enable:
+		states[option] = telnetOptYes
+	case states[option] == telnetOptYes:
+		states[option] = telnetOptNo
+		t.reply([]byte{telnetIAC, refuse, option})
+	default:
+		// Our request was refused
+		states[option] = telnetOptNo
+	}
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/Depau/ttyc"
+	"time"
+)
+
+// Timestamp formats, in the order they are cycled through with the key command
+const (
+	// Local time, i.e. 13:37:42
+	TimestampTime = "time"
+	// Local time with milliseconds, i.e. 13:37:42.123
+	TimestampMs = "ms"
+	// ISO 8601, i.e. 2022-03-14T13:37:42.123+01:00
+	TimestampIso = "iso"
+	// Time since the session started, i.e. 00:01:02.345
+	TimestampRelative = "relative"
+	// Time since the previous line, i.e. +0.250
+	TimestampDelta = "delta"
+)
+
+var TimestampFormats = []string{TimestampTime, TimestampMs, TimestampIso, TimestampRelative, TimestampDelta}
+
+func IsValidTimestampFormat(format string) bool {
+	for _, f := range TimestampFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the format following the given one, or an empty string after the last one
+func nextTimestampFormat(format string) string {
+	for i, f := range TimestampFormats {
+		if f == format && i+1 < len(TimestampFormats) {
+			return TimestampFormats[i+1]
+		}
+	}
+	return ""
+}
+
+type timestamper struct {
+	format string
+	start  time.Time
+	last   time.Time
+}
+
+func newTimestamper(format string) timestamper {
+	return timestamper{
+		format: format,
+		start:  time.Now(),
+	}
+}
+
+func (t *timestamper) stamp(now time.Time) string {
+	var formatted string
+	switch t.format {
+	case TimestampMs:
+		formatted = now.Format("15:04:05.000")
+	case TimestampIso:
+		formatted = now.Format("2006-01-02T15:04:05.000Z07:00")
+	case TimestampRelative:
+		elapsed := now.Sub(t.start)
+		formatted = fmt.Sprintf("%02d:%02d:%02d.%03d", int(elapsed.Hours()), int(elapsed.Minutes())%60,
+			int(elapsed.Seconds())%60, elapsed.Milliseconds()%1000)
+	case TimestampDelta:
+		var delta time.Duration
+		if !t.last.IsZero() {
+			delta = now.Sub(t.last)
+		}
+		formatted = fmt.Sprintf("+%.3f", delta.Seconds())
+	default:
+		formatted = ttyc.Strftime.FormatString(now)
+	}
+	t.last = now
+	return formatted
+}
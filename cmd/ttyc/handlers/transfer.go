@@ -0,0 +1,217 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Depau/ttyc"
+	"github.com/Depau/ttyc/transfer"
+	"github.com/Depau/ttyc/ws"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TransferRequest describes a file transfer over the session
+type TransferRequest struct {
+	Send     bool
+	Protocol string
+	// Files to send; when receiving, the file to write for XMODEM or the directory to save the files in
+	Paths []string
+}
+
+// ParseTransfer parses "protocol:file[,file]" for sending or "protocol[:path]" for receiving, i.e.
+// "ymodem:u-boot.bin" or "zmodem:/tmp". The files to send must exist.
+func ParseTransfer(spec string, send bool) (*TransferRequest, error) {
+	protocol, paths := spec, ""
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		protocol, paths = spec[:i], spec[i+1:]
+	}
+	request := &TransferRequest{
+		Send:     send,
+		Protocol: strings.ToLower(strings.TrimSpace(protocol)),
+	}
+	valid := false
+	for _, p := range transfer.Protocols {
+		if p == request.Protocol {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return nil, fmt.Errorf("unknown transfer protocol: %s (supported: %s)", request.Protocol,
+			strings.Join(transfer.Protocols, ", "))
+	}
+	for _, path := range strings.Split(paths, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			request.Paths = append(request.Paths, path)
+		}
+	}
+
+	xmodem := request.Protocol == transfer.Xmodem || request.Protocol == transfer.Xmodem1k
+	if send {
+		if len(request.Paths) == 0 {
+			return nil, fmt.Errorf("no files to send")
+		}
+		if xmodem && len(request.Paths) > 1 {
+			return nil, fmt.Errorf("XMODEM can only send one file at a time")
+		}
+		for _, path := range request.Paths {
+			if info, err := os.Stat(path); err != nil {
+				return nil, err
+			} else if !info.Mode().IsRegular() {
+				return nil, fmt.Errorf("not a regular file: %s", path)
+			}
+		}
+		return request, nil
+	}
+
+	if len(request.Paths) > 1 {
+		return nil, fmt.Errorf("only one destination can be given")
+	}
+	if xmodem && len(request.Paths) == 0 {
+		return nil, fmt.Errorf("XMODEM needs the name of the file to write")
+	}
+	if !xmodem && len(request.Paths) == 1 {
+		if info, err := os.Stat(request.Paths[0]); err != nil {
+			return nil, err
+		} else if !info.IsDir() {
+			return nil, fmt.Errorf("not a directory: %s", request.Paths[0])
+		}
+	}
+	return request, nil
+}
+
+func (r *TransferRequest) String() string {
+	if r.Send {
+		return fmt.Sprintf("%s send of %s", r.Protocol, strings.Join(r.Paths, ", "))
+	}
+	if len(r.Paths) == 0 {
+		return fmt.Sprintf("%s receive", r.Protocol)
+	}
+	return fmt.Sprintf("%s receive to %s", r.Protocol, r.Paths[0])
+}
+
+var errSessionClosed = errors.New("the session was closed")
+
+// clientLink runs a transfer over the session. The handler feeds it the output instead of showing it; the output is
+// buffered so that the handler never blocks the client while the transfer is writing.
+type clientLink struct {
+	client *ws.Client
+	mutex  sync.Mutex
+	buf    []byte
+	// Signaled when data is added to buf
+	notify     chan struct{}
+	canceled   chan struct{}
+	cancelOnce sync.Once
+}
+
+func newClientLink(client *ws.Client) *clientLink {
+	return &clientLink{
+		client:   client,
+		notify:   make(chan struct{}, 1),
+		canceled: make(chan struct{}),
+	}
+}
+
+func (l *clientLink) feed(data []byte) {
+	l.mutex.Lock()
+	l.buf = append(l.buf, data...)
+	l.mutex.Unlock()
+	select {
+	case l.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (l *clientLink) Read(timeout time.Duration) ([]byte, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		l.mutex.Lock()
+		data := l.buf
+		l.buf = nil
+		l.mutex.Unlock()
+		if len(data) > 0 {
+			return data, nil
+		}
+		select {
+		case <-l.notify:
+		case <-timer.C:
+			return nil, transfer.ErrTimeout
+		case <-l.canceled:
+			return nil, transfer.ErrCanceled
+		case <-l.client.CloseChan:
+			return nil, errSessionClosed
+		}
+	}
+}
+
+// Write blocks while Wi-Se flow control is engaged, since the client stops consuming the input until the server
+// resumes it.
+func (l *clientLink) Write(data []byte) error {
+	select {
+	case l.client.Input <- data:
+		return nil
+	case <-l.canceled:
+		return transfer.ErrCanceled
+	case <-l.client.CloseChan:
+		return errSessionClosed
+	}
+}
+
+func (l *clientLink) cancel() {
+	l.cancelOnce.Do(func() {
+		close(l.canceled)
+	})
+}
+
+// Tells the remote side that the transfer was canceled, which the link itself refuses to do once canceled
+func (l *clientLink) cancelRemote() {
+	_ = transfer.Cancel(&clientLink{client: l.client})
+}
+
+// Discards the output until the remote side has been idle for the given time, waiting at most max
+func (l *clientLink) drain(idle time.Duration, max time.Duration) {
+	deadline := time.Now().Add(max)
+	for time.Now().Before(deadline) {
+		if _, err := l.Read(idle); err != nil {
+			return
+		}
+	}
+}
+
+// Minimum interval between progress updates
+const transferProgressInterval = 100 * time.Millisecond
+
+// transferProgress shows the progress of a transfer on a single status line
+type transferProgress struct {
+	verb    string
+	last    time.Time
+	printed bool
+}
+
+func (p *transferProgress) update(name string, transferred int64, size int64) {
+	now := time.Now()
+	if now.Sub(p.last) < transferProgressInterval && transferred != size {
+		return
+	}
+	p.last = now
+	p.printed = true
+	_, _ = os.Stdout.WriteString("\r")
+	if size > 0 {
+		ttyc.TtycPrintf("%s %s: %d/%d bytes (%d%%)", p.verb, name, transferred, size, transferred*100/size)
+	} else {
+		ttyc.TtycPrintf("%s %s: %d bytes", p.verb, name, transferred)
+	}
+	// Clear what's left of a longer line
+	_, _ = os.Stdout.WriteString("\033[K")
+	_ = os.Stdout.Sync()
+}
+
+// Ends the status line
+func (p *transferProgress) finish() {
+	if p.printed {
+		_, _ = os.Stdout.WriteString("\r\n")
+	}
+}
@@ -5,11 +5,11 @@ import (
 	"fmt"
 	"github.com/Depau/ttyc"
 	"github.com/Depau/ttyc/cmd/ttyc/handlers"
+	"github.com/Depau/ttyc/utils"
 	"github.com/Depau/ttyc/ws"
 	"github.com/mattn/go-isatty"
 	"github.com/mkideal/cli"
-	"math"
-	"net/http"
+	"net"
 	"net/url"
 	"os"
 	"time"
@@ -26,35 +26,79 @@ func (argv *Config) Validate(ctx *cli.Context) error {
 		bufio.NewReader(os.Stdin).ReadBytes('\n')
 	}
 
-	if !(argv.User != "" && argv.Pass != "") && !(argv.User == "" && argv.Pass == "") {
-		return fmt.Errorf("user and password must be both provided or not provided at all")
+	if err := argv.loadConfigFile(); err != nil {
+		return err
 	}
-	parsedUrl, err := url.Parse(argv.Url)
-	if err != nil {
-		return fmt.Errorf("invalid URL: %v", err)
+	if err := argv.ConnectionConfig.validate(); err != nil {
+		return err
 	}
-	if parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https" {
-		return fmt.Errorf("invalid URL, must be http or https")
+	if argv.Pipe && (argv.GetTty() != "" || argv.Detach) {
+		return fmt.Errorf("pipe mode can't be used together with PTY mode or --detach")
 	}
-	if argv.GetTty() == "" && (!isatty.IsTerminal(os.Stdout.Fd()) || !isatty.IsTerminal(os.Stdin.Fd())) {
-		return fmt.Errorf("cannot launch in terminal mode when standard file descriptors aren't terminals")
+	if argv.Exec != "" && (argv.GetTty() != "" || argv.Detach || argv.Pipe) {
+		return fmt.Errorf("--exec can't be used together with PTY mode, --detach or --pipe")
 	}
-	if !(argv.Backoff == "none" || argv.Backoff == "linear" || argv.Backoff == "exponential") {
-		return fmt.Errorf("invalid backoff: %d", argv.Baud)
+	if argv.ExecPty && argv.Exec == "" {
+		return fmt.Errorf("--exec-pty requires --exec")
 	}
-	if argv.Baud != -1 && argv.Baud <= 0 {
-		return fmt.Errorf("invalid baud rate: %d", argv.Baud)
+	if argv.Listen != "" && (argv.GetTty() != "" || argv.Detach || argv.Pipe || argv.Exec != "") {
+		return fmt.Errorf("--listen can't be used together with PTY mode, --detach, --pipe or --exec")
+	}
+	if argv.Detach {
+		if argv.GetTty() != "" {
+			return fmt.Errorf("PTY mode can't be detached")
+		}
+		if argv.Session != "" && !isValidSessionName(argv.Session) {
+			return fmt.Errorf("invalid session name: %s", argv.Session)
+		}
 	}
-	if !(argv.Parity == "even" || argv.Parity == "odd" || argv.Parity == "none" || argv.Parity == "") {
-		return fmt.Errorf("invalid parity: %s", argv.Parity)
+	if argv.Scrollback < 0 {
+		return fmt.Errorf("invalid scrollback size: %d", argv.Scrollback)
 	}
-	if !(argv.Databits == -1 || (argv.Databits >= 5 && argv.Databits <= 8)) {
-		return fmt.Errorf("invalid data bits: %d", argv.Databits)
+	if err := argv.MappingConfig.validate(); err != nil {
+		return err
 	}
-	if !(argv.Stopbits == -1 || argv.Stopbits == 1 || argv.Stopbits == 2) {
-		return fmt.Errorf("invalid stop bits: %d", argv.Stopbits)
+	if err := argv.DisplayConfig.validate(); err != nil {
+		return err
 	}
-	return nil
+	if err := argv.LogConfig.validate(); err != nil {
+		return err
+	}
+	if err := argv.TransferConfig.validate(); err != nil {
+		return err
+	}
+	if err := argv.PacingConfig.validate(); err != nil {
+		return err
+	}
+	if err := argv.PipeConfig.validate(); err != nil {
+		return err
+	}
+	if err := argv.ListenConfig.validate(); err != nil {
+		return err
+	}
+	if argv.SendFile != "" && (argv.Send != "" || argv.Receive != "") {
+		return fmt.Errorf("--send-file can't be used together with --send or --receive")
+	}
+	if (argv.Send != "" || argv.Receive != "" || argv.SendFile != "") && (argv.GetTty() != "" || argv.Detach || argv.Exec != "" || argv.Listen != "" || argv.pipeMode()) {
+		return fmt.Errorf("file transfers are only available in terminal mode")
+	}
+	return argv.validateReloadable()
+}
+
+// Returns true if the standard file descriptors are used without setting up the terminal
+func (argv *Config) pipeMode() bool {
+	if argv.GetTty() != "" || argv.Detach || argv.Exec != "" || argv.Listen != "" {
+		return false
+	}
+	return argv.Pipe || !isatty.IsTerminal(os.Stdout.Fd()) || !isatty.IsTerminal(os.Stdin.Fd())
+}
+
+// Validates the parameters that may be changed while running by reloading the config file
+func (argv *Config) validateReloadable() error {
+	if err := argv.validateCredentials(); err != nil {
+		return err
+	}
+	return argv.SttyConfig.validate()
 }
 
 func stty(config *Config, sttyUrl *url.URL, credentials *url.Userinfo) error {
@@ -114,6 +158,13 @@ func doHandshakeAndSetTerminal(baseUrl *url.URL, credentials *url.Userinfo, conf
 	return
 }
 
+func getCredentials(config *Config, urlCredentials *url.Userinfo) *url.Userinfo {
+	if config.User != "" {
+		return url.UserPassword(config.User, config.Pass)
+	}
+	return urlCredentials
+}
+
 func nextBackoff(curBsckoff time.Duration, config *Config) time.Duration {
 	if config.Backoff == "none" {
 		return time.Duration(config.Reconnect) * time.Second
@@ -126,130 +177,113 @@ func nextBackoff(curBsckoff time.Duration, config *Config) time.Duration {
 }
 
 func main() {
-	config := Config{}
+	err := cli.Root(rootCommand,
+		cli.Tree(attachCommand),
+		cli.Tree(shareCommand),
+		cli.Tree(replayCommand),
+		cli.Tree(scriptCommand),
+		cli.Tree(sshServeCommand),
+	).Run(os.Args[1:])
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
 
-	ret := cli.Run(&config, func(ctx *cli.Context) error {
-		return nil
-	}, "ttyd protocol client")
+var rootCommand = &cli.Command{
+	Desc:        "ttyd protocol client",
+	Argv:        func() interface{} { return &Config{} },
+	CanSubRoute: true,
+	Fn:          runTtyc,
+}
 
-	if ret != 0 || config.Help {
-		os.Exit(ret)
+func newStdFdsHandler(client *ws.Client, implementation ttyc.Implementation, credentials *url.Userinfo, server string) (handlers.TtyHandler, error) {
+	handler, err := handlers.NewStdFdsHandler(client, implementation, credentials, server)
+	if err != nil {
+		return nil, fmt.Errorf("unable to launch console handler: %v", err)
 	}
-	if config.Version {
-		fmt.Printf("ttyc %s\n", ttyc.VERSION)
-		println(ttyc.COPYRIGHT)
+	ttyc.TtycPrintf("ttyc %s\n", ttyc.VERSION)
+	ttyc.TtycPrintf("Press ctrl-t q to quit, ctrl-t ? for help\n")
+	ttyc.TtycPrintf("Connected\n")
+	return handler, nil
+}
 
-		os.Exit(0)
+// Exits with the status reported by handlers that end on their own, or with 1 if the session ended because of an
+// error, so that scripts notice
+func exitWithStatus(err error) {
+	if status, ok := err.(*handlers.ExitStatus); ok {
+		os.Exit(status.Status)
+	} else if err != nil {
+		os.Exit(1)
 	}
+}
 
-	//fmt.Printf("%+v\n", config);
-
-	baseUrl, _ := url.Parse(config.Url)
+func runTtyc(ctx *cli.Context) error {
+	config := ctx.Argv().(*Config)
 
-	var credentials *url.Userinfo = nil
-	if config.User != "" {
-		credentials = url.UserPassword(config.User, config.Pass)
-	} else if config.User == "" && baseUrl.User != nil {
-		credentials = baseUrl.User
+	if config.Version {
+		fmt.Printf("ttyc %s\n", ttyc.VERSION)
+		println(ttyc.COPYRIGHT)
+		return nil
 	}
-	baseUrl.User = nil
 
-	// Reduce HTTP timeout so that the client doesn't stall on reconnection when the server is down for a few seconds
-	http.DefaultClient.Timeout = time.Duration(math.Max(math.Min(float64(config.Reconnect), 5.0), 2.0)) * time.Second
+	//fmt.Printf("%+v\n", config);
 
-	token, implementation, server, err := doHandshakeAndSetTerminal(baseUrl, credentials, &config)
-	if err != nil {
-		ttyc.TtycAngryPrintf("%v\n", err)
-		os.Exit(1)
+	if config.NoColor || utils.IsJournalStream() {
+		ttyc.UseColors = false
 	}
 
-	client, err := ws.DialAndAuth(baseUrl, &token, config.Watchdog)
-	if err != nil {
-		ttyc.TtycAngryPrintf("unable to connect or authenticate to server: %v\n", err)
-		os.Exit(1)
+	if config.Detach {
+		return runDetached(config)
 	}
-	defer client.Close()
-	go client.Run(config.Watchdog)
 
-	handlerErrChan := make(chan error, 1)
-	defer close(handlerErrChan)
-
-	var handler handlers.TtyHandler
-	if config.GetTty() == "" {
-		handler, err = handlers.NewStdFdsHandler(client, implementation, credentials, server)
-		if err != nil {
-			ttyc.TtycAngryPrintf("Unable to launch console handler: %v\n", err)
-			os.Exit(1)
-		}
-		ttyc.TtycPrintf("ttyc %s\n", ttyc.VERSION)
-		ttyc.TtycPrintf("Press ctrl-t q to quit, ctrl-t ? for help\n")
-		ttyc.TtycPrintf("Connected\n")
-	} else {
-		handler, err = handlers.NewPtyHandler(client, config.GetTty())
+	if config.Exec != "" {
+		err := runSession(config, func(client *ws.Client, _ ttyc.Implementation, _ *url.Userinfo, _ string) (handlers.TtyHandler, error) {
+			handler, err := handlers.NewExecHandler(client, config.Exec, config.ExecPty)
+			if err != nil {
+				return nil, fmt.Errorf("unable to launch exec handler: %v", err)
+			}
+			ttyc.TtycPrintf("Connected, running %s\n", config.Exec)
+			return handler, nil
+		})
+		exitWithStatus(err)
+	} else if config.Listen != "" {
+		// Validated already
+		address, protocol, _ := config.listenAddress()
+		listener, err := net.Listen("tcp", address)
 		if err != nil {
-			ttyc.TtycAngryPrintf("Unable to launch PTY handler: %v\n", err)
-			os.Exit(1)
+			return fmt.Errorf("unable to listen on %s: %v", address, err)
 		}
-	}
-	defer handler.Close()
-	go handler.Run(handlerErrChan)
-
-	var fatalError error
-
-	reconnect := time.Duration(config.Reconnect) * time.Second
-	for {
-		select {
-		case fatalError = <-handlerErrChan:
-			if err := handler.HandleDisconnect(); err != nil {
-				ttyc.TtycAngryPrintf("Error while handling disconnection: %v\n", err)
-			}
-			ttyc.TtycAngryPrintf("%v\n", fatalError)
-			return
-		case fatalError = <-client.Error:
-			// Restore terminal, if any
-			if err := handler.HandleDisconnect(); err != nil {
-				ttyc.TtycAngryPrintf("Error while handling disconnection: %v\n", err)
-				return
+		options := &handlers.ListenOptions{Protocol: protocol, Multi: config.ListenMulti}
+		runSession(config, func(client *ws.Client, implementation ttyc.Implementation, credentials *url.Userinfo, _ string) (handlers.TtyHandler, error) {
+			handler, err := handlers.NewListenHandler(client, implementation, credentials, listener, options)
+			if err != nil {
+				return nil, fmt.Errorf("unable to launch listen handler: %v", err)
 			}
-
-			println()
-			ttyc.TtycAngryPrintf("Server disconnected: %v\n", fatalError)
-			if err := client.SoftClose(); err != nil {
-				ttyc.TtycAngryPrintf("Error while cleaning up the WebSocket: %v\n", err)
-			}
-			if config.Reconnect < 0 {
-				return
+			ttyc.TtycPrintf("Connected, listening on %s\n", config.Listen)
+			return handler, nil
+		})
+	} else if config.pipeMode() {
+		ttyc.StatusOutput = os.Stderr
+		err := runSession(config, func(client *ws.Client, implementation ttyc.Implementation, credentials *url.Userinfo, server string) (handlers.TtyHandler, error) {
+			handler, err := handlers.NewStdFdsPipeHandler(client, implementation, credentials, server, config.pipeOptions())
+			if err != nil {
+				return nil, fmt.Errorf("unable to launch pipe handler: %v", err)
 			}
-
-			for {
-				if reconnect.Seconds() <= 0 {
-					ttyc.TtycPrintf("Reconnecting\n")
-				} else {
-					ttyc.TtycPrintf("Reconnecting in %d seconds\n", int(reconnect.Seconds()))
-					<-time.After(reconnect)
-				}
-				reconnect = nextBackoff(reconnect, &config)
-
-				token, _, _, err := doHandshakeAndSetTerminal(baseUrl, credentials, &config)
-				if err != nil {
-					ttyc.TtycAngryPrintf("Unable to perform authentication: %v\n", err)
-					continue
-				}
-				if err := client.Redial(&token); err != nil {
-					ttyc.TtycAngryPrintf("Unable to connect or authenticate to server: %v\n", err)
-					continue
-				}
-				break
-			}
-			ttyc.TtycPrintf("Reconnected\n")
-			go client.Run(config.Watchdog)
-
-			// Put back terminal into raw mode
-			if err := handler.HandleReconnect(); err != nil {
-				ttyc.TtycAngryPrintf("Error while handling reconnection: %v\n", err)
-				return
+			ttyc.TtycPrintf("Connected\n")
+			return handler, nil
+		})
+		exitWithStatus(err)
+	} else if config.GetTty() == "" {
+		runSession(config, newStdFdsHandler)
+	} else {
+		runSession(config, func(client *ws.Client, _ ttyc.Implementation, _ *url.Userinfo, _ string) (handlers.TtyHandler, error) {
+			handler, err := handlers.NewPtyHandler(client, config.GetTty())
+			if err != nil {
+				return nil, fmt.Errorf("unable to launch PTY handler: %v", err)
 			}
-		}
+			return handler, nil
+		})
 	}
-
+	return nil
 }
@@ -0,0 +1,280 @@
+package main
+
+// Replay server: serves a session recorded with --record or --log-file over the ttyd protocol, to test clients and
+// parsers without hardware
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Depau/ttyc"
+	"github.com/Depau/ttyc/cmd/ttyc/handlers"
+	"github.com/Depau/ttyc/ws"
+	"github.com/mkideal/cli"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"syscall"
+	"time"
+)
+
+// Frames closer than this are sent together, so that accelerated playback doesn't flood the clients
+const replayMinDelay = 5 * time.Millisecond
+const replayMaxChunk = 8192
+
+type replayFrame struct {
+	delay time.Duration
+	data  []byte
+}
+
+type replayConfig struct {
+	Help         bool    `cli:"!h,help" usage:"Show help"`
+	Listen       string  `cli:"l,listen" usage:"Address to serve the recording on" dft:"127.0.0.1:7681"`
+	Speed        float64 `cli:"S,speed" usage:"Playback speed multiplier" dft:"1"`
+	MaxWait      float64 `cli:"max-wait" usage:"Maximum pause between frames in seconds, 0 for no limit" dft:"0"`
+	LineInterval int     `cli:"line-interval" usage:"Milliseconds between lines for recordings without timing, such as raw logs" dft:"100"`
+	Loop         bool    `cli:"loop" usage:"Start over when the recording ends" dft:"false"`
+	Echo         bool    `cli:"e,echo" usage:"Echo the input sent by the clients" dft:"false"`
+}
+
+func (argv *replayConfig) AutoHelp() bool {
+	return argv.Help
+}
+
+func (argv *replayConfig) Validate(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return fmt.Errorf("exactly one recording must be provided")
+	}
+	if argv.Speed <= 0 {
+		return fmt.Errorf("invalid speed: %v", argv.Speed)
+	}
+	if argv.MaxWait < 0 {
+		return fmt.Errorf("invalid maximum wait: %v", argv.MaxWait)
+	}
+	if argv.LineInterval < 0 {
+		return fmt.Errorf("invalid line interval: %d", argv.LineInterval)
+	}
+	return nil
+}
+
+var replayCommand = &cli.Command{
+	Name: "replay-server",
+	Desc: "Serve a recorded session over the ttyd protocol",
+	Text: "Usage: ttyc replay-server [options] <recording.cast|log>",
+	// Allows the recording as positional argument
+	CanSubRoute: true,
+	Argv:        func() interface{} { return &replayConfig{} },
+	Fn:          runReplayServer,
+}
+
+// Loads an asciicast recording, a text log or, if the format is not recognized, a raw log
+func loadRecording(path string, lineInterval time.Duration) ([]replayFrame, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if frames, err := parseAsciicast(data); err == nil {
+		return frames, nil
+	}
+	if frames := parseTextLog(data); frames != nil {
+		return frames, nil
+	}
+	return parseRawLog(data, lineInterval), nil
+}
+
+func parseAsciicast(data []byte) ([]replayFrame, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), len(data)+1)
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("empty recording")
+	}
+	header := handlers.AsciicastHeader{}
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil || header.Version != 2 {
+		return nil, fmt.Errorf("not an asciicast v2 recording")
+	}
+
+	var frames []replayFrame
+	last := 0.0
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var event []interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil || len(event) != 3 {
+			return nil, fmt.Errorf("invalid event: %s", scanner.Text())
+		}
+		t, ok1 := event[0].(float64)
+		code, ok2 := event[1].(string)
+		eventData, ok3 := event[2].(string)
+		if !ok1 || !ok2 || !ok3 {
+			return nil, fmt.Errorf("invalid event: %s", scanner.Text())
+		}
+		if code != "o" {
+			continue
+		}
+		frames = append(frames, replayFrame{
+			delay: time.Duration((t - last) * float64(time.Second)),
+			data:  []byte(eventData),
+		})
+		last = t
+	}
+	return frames, scanner.Err()
+}
+
+var textLogLineRegexp = regexp.MustCompile(`^\[(\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}\.\d{3})\] (.*)$`)
+
+// Parses logs written with --log-format text; returns nil if any line is not in that format
+func parseTextLog(data []byte) []replayFrame {
+	var frames []replayFrame
+	var last time.Time
+	for _, line := range bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n")) {
+		match := textLogLineRegexp.FindSubmatch(line)
+		if match == nil {
+			return nil
+		}
+		t, err := time.Parse("2006-01-02 15:04:05.000", string(match[1]))
+		if err != nil {
+			return nil
+		}
+		var delay time.Duration
+		if !last.IsZero() && t.After(last) {
+			delay = t.Sub(last)
+		}
+		last = t
+		frames = append(frames, replayFrame{
+			delay: delay,
+			data:  append(append([]byte{}, match[2]...), '\r', '\n'),
+		})
+	}
+	return frames
+}
+
+func parseRawLog(data []byte, lineInterval time.Duration) []replayFrame {
+	var frames []replayFrame
+	for len(data) > 0 {
+		end := bytes.IndexByte(data, '\n') + 1
+		if end == 0 {
+			end = len(data)
+		}
+		frames = append(frames, replayFrame{
+			delay: lineInterval,
+			data:  data[:end],
+		})
+		data = data[end:]
+	}
+	if len(frames) > 0 {
+		frames[0].delay = 0
+	}
+	return frames
+}
+
+type replayHandler struct {
+	server *ws.Server
+	echo   bool
+}
+
+func (r *replayHandler) HandleInput(data []byte) {
+	if r.echo {
+		r.server.Output(data)
+	}
+}
+
+func (r *replayHandler) HandleResize(int, int) {}
+
+func (r *replayHandler) HandleBreak() {}
+
+func (r *replayHandler) HandleDetectBaudrate() {}
+
+// Plays the frames to the server clients, returns false if interrupted by stop
+func playRecording(server *ws.Server, frames []replayFrame, argv *replayConfig, stop <-chan interface{}) bool {
+	maxWait := time.Duration(argv.MaxWait * float64(time.Second))
+	var pending []byte
+	// Delays too short to wait for are added up, so that the playback doesn't get ahead of the recording
+	var wait time.Duration
+	for i, frame := range frames {
+		delay := time.Duration(float64(frame.delay) / argv.Speed)
+		if maxWait > 0 && delay > maxWait {
+			delay = maxWait
+		}
+		wait += delay
+		if wait >= replayMinDelay {
+			if len(pending) > 0 {
+				server.Output(pending)
+				pending = nil
+			}
+			select {
+			case <-time.After(wait):
+			case <-stop:
+				return false
+			}
+			wait = 0
+		}
+		pending = append(pending, frame.data...)
+		if len(pending) >= replayMaxChunk || i == len(frames)-1 {
+			server.Output(pending)
+			pending = nil
+		}
+	}
+	return true
+}
+
+func runReplayServer(ctx *cli.Context) error {
+	argv := ctx.Argv().(*replayConfig)
+	path := ctx.Args()[0]
+	frames, err := loadRecording(path, time.Duration(argv.LineInterval)*time.Millisecond)
+	if err != nil {
+		return fmt.Errorf("unable to load recording: %v", err)
+	}
+	if len(frames) == 0 {
+		return fmt.Errorf("the recording has no output")
+	}
+
+	listener, err := net.Listen("tcp", argv.Listen)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s: %v", argv.Listen, err)
+	}
+	handler := &replayHandler{echo: argv.Echo}
+	handler.server = ws.NewServer(handler, "ttyc-replay/"+ttyc.VERSION, 0)
+	httpServer := &http.Server{Handler: handler.server.NewEndpoint(false)}
+	go func() {
+		if err := httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			ttyc.TtycAngryPrintf("Replay server stopped: %v\n", err)
+		}
+	}()
+	defer httpServer.Close()
+	defer handler.server.Close()
+
+	stop := make(chan interface{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-signals
+		close(stop)
+	}()
+
+	ttyc.TtycPrintf("Serving %s on http://%s/, waiting for a client to start playback\n", path, listener.Addr())
+	for handler.server.Clients() == 0 {
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-stop:
+			return nil
+		}
+	}
+
+	for {
+		ttyc.TtycPrintf("Playing %s\n", path)
+		if !playRecording(handler.server, frames, argv, stop) {
+			return nil
+		}
+		if !argv.Loop {
+			break
+		}
+	}
+	ttyc.TtycPrintf("Playback finished\n")
+	<-stop
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+// Scripts: expect-like automation of console sessions, i.e. to log into a device and run commands from CI
+
+import (
+	"fmt"
+	"github.com/Depau/ttyc"
+	"github.com/Depau/ttyc/cmd/ttyc/handlers"
+	"github.com/Depau/ttyc/utils"
+	"github.com/Depau/ttyc/ws"
+	"github.com/mkideal/cli"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"time"
+)
+
+type scriptConfig struct {
+	Help bool `cli:"!h,help" usage:"Show help"`
+	ConnectionConfig
+	SttyConfig
+	MappingConfig
+	LogConfig
+	Timeout float64 `cli:"timeout" usage:"Default expect timeout in seconds" dft:"10"`
+	Quiet   bool    `cli:"q,quiet" usage:"Don't print the output of the session" dft:"false"`
+	ServiceConfig
+}
+
+func (argv *scriptConfig) AutoHelp() bool {
+	return argv.Help
+}
+
+func (argv *scriptConfig) Validate(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return fmt.Errorf("exactly one script must be provided")
+	}
+	if argv.Timeout <= 0 {
+		return fmt.Errorf("invalid timeout: %v", argv.Timeout)
+	}
+	// Report syntax errors before connecting
+	if _, err := loadScript(ctx.Args()[0]); err != nil {
+		return err
+	}
+	return argv.LogConfig.validate()
+}
+
+func loadScript(path string) (*handlers.Script, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	script, err := handlers.ParseScript(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return script, nil
+}
+
+var scriptCommand = &cli.Command{
+	Name: "script",
+	Desc: "Run an expect-like script on the session, exiting with its status",
+	Text: "Usage: ttyc script [options] <file>",
+	// Allows the script as positional argument
+	CanSubRoute: true,
+	Argv:        func() interface{} { return &scriptConfig{} },
+	Fn:          runScript,
+}
+
+func runScript(ctx *cli.Context) error {
+	argv := ctx.Argv().(*scriptConfig)
+	config := &Config{
+		ConnectionConfig: argv.ConnectionConfig,
+		SttyConfig:       argv.SttyConfig,
+		MappingConfig:    argv.MappingConfig,
+		LogConfig:        argv.LogConfig,
+		ServiceConfig:    argv.ServiceConfig,
+	}
+	if err := config.loadConfigFile(); err != nil {
+		return err
+	}
+	if err := config.ConnectionConfig.validate(); err != nil {
+		return err
+	}
+	if err := config.MappingConfig.validate(); err != nil {
+		return err
+	}
+	if err := config.validateReloadable(); err != nil {
+		return err
+	}
+	if config.NoColor || utils.IsJournalStream() {
+		ttyc.UseColors = false
+	}
+
+	script, err := loadScript(ctx.Args()[0])
+	if err != nil {
+		return err
+	}
+	var output io.Writer = os.Stdout
+	if argv.Quiet {
+		output = ioutil.Discard
+	}
+	timeout := time.Duration(argv.Timeout * float64(time.Second))
+
+	err = runSession(config, func(client *ws.Client, implementation ttyc.Implementation, credentials *url.Userinfo, _ string) (handlers.TtyHandler, error) {
+		return handlers.NewScriptHandler(client, implementation, credentials, script, output, timeout)
+	})
+	if status, ok := err.(*handlers.ExitStatus); ok {
+		os.Exit(status.Status)
+	}
+	// The session ended before the script did
+	os.Exit(1)
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+// Helpers for running ttyc as a system service: config file reloading, pidfile and systemd notifications
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Depau/ttyc"
+	"github.com/Depau/ttyc/utils"
+	"github.com/Depau/ttyc/ws"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+type configFileDTO struct {
+	User     *string `json:"user"`
+	Pass     *string `json:"pass"`
+	Baud     *int    `json:"baudrate"`
+	Parity   *string `json:"parity"`
+	Databits *int    `json:"databits"`
+	Stopbits *int    `json:"stopbits"`
+}
+
+func (config *Config) loadConfigFile() error {
+	if config.ConfigFile == "" {
+		return nil
+	}
+	buf, err := ioutil.ReadFile(config.ConfigFile)
+	if err != nil {
+		return fmt.Errorf("unable to read config file: %v", err)
+	}
+	dto := configFileDTO{}
+	if err = json.Unmarshal(buf, &dto); err != nil {
+		return fmt.Errorf("invalid config file: %v", err)
+	}
+
+	if dto.User != nil {
+		config.User = *dto.User
+	}
+	if dto.Pass != nil {
+		config.Pass = *dto.Pass
+	}
+	if dto.Baud != nil {
+		config.Baud = *dto.Baud
+	}
+	if dto.Parity != nil {
+		config.Parity = *dto.Parity
+	}
+	if dto.Databits != nil {
+		config.Databits = *dto.Databits
+	}
+	if dto.Stopbits != nil {
+		config.Stopbits = *dto.Stopbits
+	}
+	return nil
+}
+
+func writePidfile(path string) error {
+	if path == "" {
+		return nil
+	}
+	return ioutil.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+func removePidfile(path string) {
+	if path == "" {
+		return
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		ttyc.TtycAngryPrintf("Unable to remove pidfile: %v\n", err)
+	}
+}
+
+// notifySignals subscribes to the signals ttyc handles itself. SIGHUP is only handled in PTY mode, since in terminal
+// mode it means that the controlling terminal went away.
+func notifySignals(config *Config) chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	if config.GetTty() != "" {
+		signal.Notify(signals, syscall.SIGHUP)
+	}
+	return signals
+}
+
+func sdNotify(state string) {
+	if _, err := utils.SdNotify(state); err != nil {
+		ttyc.TtycAngryPrintf("Unable to notify service manager: %v\n", err)
+	}
+}
+
+func sdNotifyStatus(status string) {
+	if _, err := utils.SdNotifyStatus(status); err != nil {
+		ttyc.TtycAngryPrintf("Unable to notify service manager: %v\n", err)
+	}
+}
+
+// setupSdWatchdog makes the WebSocket watchdog also feed the systemd watchdog, so that the service is restarted if
+// the connection to the server stalls.
+func setupSdWatchdog(client *ws.Client, config *Config) {
+	sdWatchdog := utils.SdWatchdogEnabled()
+	if sdWatchdog <= 0 {
+		return
+	}
+	if config.Watchdog <= 0 {
+		ttyc.TtycAngryPrintf("Warning: systemd watchdog is enabled but the WebSocket watchdog is disabled, keepalives won't be sent\n")
+		return
+	}
+	if time.Duration(config.Watchdog)*time.Second >= sdWatchdog {
+		ttyc.TtycAngryPrintf("Warning: WebSocket watchdog interval (%ds) is not shorter than the systemd watchdog timeout (%v)\n", config.Watchdog, sdWatchdog)
+	}
+	client.OnPing = func() {
+		sdNotify(utils.SdNotifyWatchdog)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Depau/ttyc"
+	"github.com/Depau/ttyc/cmd/ttyc/handlers"
+	"github.com/Depau/ttyc/utils"
+	"github.com/Depau/ttyc/ws"
+	"github.com/containerd/console"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"time"
+)
+
+type handlerFactory func(client *ws.Client, implementation ttyc.Implementation, credentials *url.Userinfo, server string) (handlers.TtyHandler, error)
+
+// runSession connects to the server and runs the handler created by newHandler, reconnecting as configured, until
+// the handler fails or ttyc is asked to quit. It returns the error the handler ended with, if any.
+func runSession(config *Config, newHandler handlerFactory) error {
+	baseUrl, _ := url.Parse(config.Url)
+	urlCredentials := baseUrl.User
+	credentials := getCredentials(config, urlCredentials)
+	baseUrl.User = nil
+
+	// Reduce HTTP timeout so that the client doesn't stall on reconnection when the server is down for a few seconds
+	http.DefaultClient.Timeout = time.Duration(math.Max(math.Min(float64(config.Reconnect), 5.0), 2.0)) * time.Second
+
+	signals := notifySignals(config)
+
+	// Setup failures return rather than exiting right away, so that the deferred cleanup runs first
+	setupFailed := false
+	defer func() {
+		if setupFailed {
+			os.Exit(1)
+		}
+	}()
+
+	token, implementation, server, err := doHandshakeAndSetTerminal(baseUrl, credentials, config)
+	if err != nil {
+		ttyc.TtycAngryPrintf("%v\n", err)
+		os.Exit(1)
+	}
+
+	client, err := ws.DialAndAuth(baseUrl, &token, config.Watchdog)
+	if err != nil {
+		ttyc.TtycAngryPrintf("unable to connect or authenticate to server: %v\n", err)
+		os.Exit(1)
+	}
+	defer client.Close()
+	setupSdWatchdog(client, config)
+
+	// Validated already
+	mapping, _ := handlers.ParseMapping(config.Map)
+	if !mapping.IsEmpty() {
+		client.MapOutput = mapping.MapOutput
+		client.MapInput = mapping.MapInput
+	}
+
+	hub := handlers.NewEventHub()
+	client.OnOutput = hub.Output
+	client.OnInput = hub.Input
+	client.OnResize = hub.Resize
+	logOptions := config.logOptions()
+	if config.LogFile != "" {
+		logOptions.Pattern = config.LogFile
+	}
+	logOptions.Decoder = config.Decoder
+	logOptions.DecoderGap = time.Duration(config.FrameGap) * time.Millisecond
+	// Validated already
+	logOptions.Charset, _ = handlers.LookupCharset(config.Charset)
+	logger := handlers.NewSessionLogger(hub, logOptions)
+	if config.LogFile != "" {
+		if err := logger.Start(config.LogFile); err != nil {
+			ttyc.TtycAngryPrintf("Unable to open log file: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	defer logger.Stop()
+
+	if config.Record != "" {
+		recorder, err := startRecorder(config, hub, baseUrl, server)
+		if err != nil {
+			ttyc.TtycAngryPrintf("Unable to start recording: %v\n", err)
+			setupFailed = true
+			return err
+		}
+		defer recorder.Close()
+	}
+
+	go client.Run(config.Watchdog)
+
+	handlerErrChan := make(chan error, 1)
+	defer close(handlerErrChan)
+
+	handler, err := newHandler(client, implementation, credentials, server)
+	if err != nil {
+		ttyc.TtycAngryPrintf("%v\n", err)
+		os.Exit(1)
+	}
+	defer handler.Close()
+	config.DisplayConfig.applyModes(handler)
+	if logHandler, ok := handler.(handlers.LogHandler); ok {
+		logHandler.SetLogger(logger)
+	}
+	if mappingHandler, ok := handler.(handlers.MappingHandler); ok {
+		mappingHandler.SetMapping(mapping)
+	}
+	pacingHandler, canPace := handler.(handlers.PacingHandler)
+	if canPace {
+		pacingHandler.SetPacing(config.pacing())
+	}
+
+	var control *controlServer
+	if config.Control != "" {
+		control, err = startControlServer(config.Control, client, handler, hub, logger, implementation, credentials, server)
+		if err != nil {
+			ttyc.TtycAngryPrintf("%v\n", err)
+			setupFailed = true
+			return err
+		}
+		defer control.Close()
+	}
+
+	go handler.Run(handlerErrChan)
+
+	// Validated already
+	if request, _ := config.transferRequest(); request != nil {
+		if transferHandler, ok := handler.(handlers.TransferHandler); !ok {
+			ttyc.TtycAngryPrintf("File transfers are not supported in this mode\n")
+		} else if err := transferHandler.StartTransfer(request); err != nil {
+			ttyc.TtycAngryPrintf("Unable to start the transfer: %v\n", err)
+		}
+	}
+	if config.SendFile != "" {
+		if !canPace {
+			ttyc.TtycAngryPrintf("Sending files is not supported in this mode\n")
+		} else if err := pacingHandler.SendFile(config.SendFile); err != nil {
+			ttyc.TtycAngryPrintf("Unable to send %s: %v\n", config.SendFile, err)
+		}
+	}
+
+	if err := writePidfile(config.Pidfile); err != nil {
+		ttyc.TtycAngryPrintf("Unable to write pidfile: %v\n", err)
+	}
+	defer removePidfile(config.Pidfile)
+	sdNotifyStatus("Connected")
+	sdNotify(utils.SdNotifyReady)
+
+	// Returns true if ttyc should quit
+	handleSignal := func(sig os.Signal) bool {
+		if sig != syscall.SIGHUP {
+			ttyc.TtycPrintf("Received %v, shutting down\n", sig)
+			sdNotify(utils.SdNotifyStopping)
+			return true
+		}
+
+		ttyc.TtycPrintf("Reloading configuration\n")
+		sdNotify(utils.SdNotifyReloading)
+		defer sdNotify(utils.SdNotifyReady)
+
+		newConfig := *config
+		if err := newConfig.loadConfigFile(); err != nil {
+			ttyc.TtycAngryPrintf("%v\n", err)
+			return false
+		}
+		if err := newConfig.validateReloadable(); err != nil {
+			ttyc.TtycAngryPrintf("Invalid configuration: %v\n", err)
+			return false
+		}
+		*config = newConfig
+		credentials = getCredentials(config, urlCredentials)
+		if control != nil {
+			control.setCredentials(credentials)
+		}
+
+		if implementation == ttyc.ImplementationWiSe {
+			sttyHttpUrl := ttyc.GetUrlFor(ttyc.UrlForStty, baseUrl)
+			if err := stty(config, sttyHttpUrl, credentials); err != nil {
+				ttyc.TtycAngryPrintf("Unable to set remote UART parameters: %v\n", err)
+			}
+		}
+		return false
+	}
+
+	var fatalError error
+
+	reconnect := time.Duration(config.Reconnect) * time.Second
+	for {
+		select {
+		case sig := <-signals:
+			if handleSignal(sig) {
+				return nil
+			}
+		case fatalError = <-handlerErrChan:
+			if err := handler.HandleDisconnect(); err != nil {
+				ttyc.TtycAngryPrintf("Error while handling disconnection: %v\n", err)
+			}
+			// Handlers that end on their own only report why they failed, if they did
+			if status, ok := fatalError.(*handlers.ExitStatus); !ok || status.Err != nil {
+				ttyc.TtycAngryPrintf("%v\n", fatalError)
+			}
+			return fatalError
+		case fatalError = <-client.Error:
+			// Restore terminal, if any
+			if err := handler.HandleDisconnect(); err != nil {
+				ttyc.TtycAngryPrintf("Error while handling disconnection: %v\n", err)
+				return err
+			}
+
+			println()
+			ttyc.TtycAngryPrintf("Server disconnected: %v\n", fatalError)
+			hub.ConnectionEvent(handlers.EventDisconnected, fatalError.Error())
+			if err := client.SoftClose(); err != nil {
+				ttyc.TtycAngryPrintf("Error while cleaning up the WebSocket: %v\n", err)
+			}
+			if config.Reconnect < 0 {
+				return fatalError
+			}
+			sdNotifyStatus(fmt.Sprintf("Disconnected: %v", fatalError))
+
+			for {
+				if reconnect.Seconds() <= 0 {
+					ttyc.TtycPrintf("Reconnecting\n")
+				} else {
+					ttyc.TtycPrintf("Reconnecting in %d seconds\n", int(reconnect.Seconds()))
+					select {
+					case <-time.After(reconnect):
+					case sig := <-signals:
+						if handleSignal(sig) {
+							return nil
+						}
+					}
+				}
+				reconnect = nextBackoff(reconnect, config)
+
+				token, _, _, err := doHandshakeAndSetTerminal(baseUrl, credentials, config)
+				if err != nil {
+					ttyc.TtycAngryPrintf("Unable to perform authentication: %v\n", err)
+					continue
+				}
+				if err := client.Redial(&token); err != nil {
+					ttyc.TtycAngryPrintf("Unable to connect or authenticate to server: %v\n", err)
+					continue
+				}
+				break
+			}
+			ttyc.TtycPrintf("Reconnected\n")
+			hub.ConnectionEvent(handlers.EventReconnected, "")
+			sdNotifyStatus("Connected")
+			go client.Run(config.Watchdog)
+
+			// Put back terminal into raw mode
+			if err := handler.HandleReconnect(); err != nil {
+				ttyc.TtycAngryPrintf("Error while handling reconnection: %v\n", err)
+				return err
+			}
+		}
+	}
+
+}
+
+func startRecorder(config *Config, hub *handlers.EventHub, baseUrl *url.URL, server string) (*handlers.Recorder, error) {
+	title := "ttyc " + baseUrl.String()
+	if server != "" {
+		title += " (" + server + ")"
+	}
+	// The actual size is recorded as soon as the handler resizes the remote terminal
+	width, height := 80, 24
+	if current, err := console.ConsoleFromFile(os.Stdout); err == nil {
+		if winSize, err := current.Size(); err == nil && winSize.Width > 0 && winSize.Height > 0 {
+			width, height = int(winSize.Width), int(winSize.Height)
+		}
+	}
+	header := handlers.AsciicastHeader{
+		Width:  width,
+		Height: height,
+		Title:  title,
+		Env:    map[string]string{"TERM": os.Getenv("TERM")},
+	}
+	// Validated already
+	charset, _ := handlers.LookupCharset(config.Charset)
+	return handlers.NewRecorder(hub, config.Record, header, config.RecordInput, charset)
+}
@@ -0,0 +1,121 @@
+package main
+
+// Shared sessions: a single connection to the server is re-served over HTTP to any number of ttyd clients, so that
+// many users can watch the same console without overloading devices that handle few clients, such as Wi-Se.
+
+import (
+	"fmt"
+	"github.com/Depau/ttyc"
+	"github.com/Depau/ttyc/cmd/ttyc/handlers"
+	"github.com/Depau/ttyc/utils"
+	"github.com/Depau/ttyc/ws"
+	"github.com/mkideal/cli"
+	"net"
+	"net/url"
+)
+
+type shareConfig struct {
+	Help bool `cli:"!h,help" usage:"Show help"`
+	ConnectionConfig
+	SttyConfig
+	MappingConfig
+	LogConfig
+	Listen     string `cli:"l,listen" usage:"Address to serve the session on" dft:"127.0.0.1:7682"`
+	ReadWrite  bool   `cli:"read-write" usage:"Allow all viewers to type and change the UART parameters" dft:"false"`
+	ViewUser   string `cli:"view-user" usage:"Username required to watch the session" dft:""`
+	ViewPass   string `cli:"view-pass" usage:"Password required to watch the session" dft:""`
+	RwUser     string `cli:"rw-user" usage:"Username for read-write access, served under /rw/" dft:""`
+	RwPass     string `cli:"rw-pass" usage:"Password for read-write access, served under /rw/" dft:""`
+	Scrollback int    `cli:"scrollback" usage:"Bytes of output replayed to newly connected viewers" dft:"262144"`
+	ServiceConfig
+}
+
+func (argv *shareConfig) AutoHelp() bool {
+	return argv.Help
+}
+
+func (argv *shareConfig) Validate(ctx *cli.Context) error {
+	if argv.Listen == "" {
+		return fmt.Errorf("a listen address must be provided")
+	}
+	if (argv.ViewUser == "") != (argv.ViewPass == "") {
+		return fmt.Errorf("view user and password must be both provided or not provided at all")
+	}
+	if (argv.RwUser == "") != (argv.RwPass == "") {
+		return fmt.Errorf("read-write user and password must be both provided or not provided at all")
+	}
+	if argv.Scrollback < 0 {
+		return fmt.Errorf("invalid scrollback size: %d", argv.Scrollback)
+	}
+	return argv.LogConfig.validate()
+}
+
+var shareCommand = &cli.Command{
+	Name: "share",
+	Desc: "Serve a session to many ttyd clients over a single connection to the server",
+	Argv: func() interface{} { return &shareConfig{} },
+	Fn:   runShare,
+}
+
+func (argv *shareConfig) shareOptions() *handlers.ShareOptions {
+	options := &handlers.ShareOptions{
+		Scrollback: argv.Scrollback,
+		ReadWrite:  argv.ReadWrite,
+	}
+	if argv.ViewUser != "" {
+		options.ViewCredentials = url.UserPassword(argv.ViewUser, argv.ViewPass)
+	}
+	if argv.RwUser != "" {
+		options.RwCredentials = url.UserPassword(argv.RwUser, argv.RwPass)
+	}
+	return options
+}
+
+func runShare(ctx *cli.Context) error {
+	argv := ctx.Argv().(*shareConfig)
+	config := &Config{
+		ConnectionConfig: argv.ConnectionConfig,
+		SttyConfig:       argv.SttyConfig,
+		MappingConfig:    argv.MappingConfig,
+		LogConfig:        argv.LogConfig,
+		ServiceConfig:    argv.ServiceConfig,
+	}
+	if err := config.loadConfigFile(); err != nil {
+		return err
+	}
+	if err := config.ConnectionConfig.validate(); err != nil {
+		return err
+	}
+	if err := config.MappingConfig.validate(); err != nil {
+		return err
+	}
+	if err := config.validateReloadable(); err != nil {
+		return err
+	}
+	if config.NoColor || utils.IsJournalStream() {
+		ttyc.UseColors = false
+	}
+
+	listener, err := net.Listen("tcp", argv.Listen)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s: %v", argv.Listen, err)
+	}
+	options := argv.shareOptions()
+
+	runSession(config, func(client *ws.Client, _ ttyc.Implementation, credentials *url.Userinfo, server string) (handlers.TtyHandler, error) {
+		handler, err := handlers.NewShareHandler(client, credentials, server, listener, options)
+		if err != nil {
+			return nil, fmt.Errorf("unable to launch share handler: %v", err)
+		}
+		access := "read-only"
+		if options.ReadWrite {
+			access = "read-write"
+		}
+		ttyc.TtycPrintf("Sharing %s on http://%s/ (%s)\n", config.Url, listener.Addr(), access)
+		if options.RwCredentials != nil {
+			ttyc.TtycPrintf("Read-write access on http://%s/rw/\n", listener.Addr())
+		}
+		return handler, nil
+	})
+	return nil
+}
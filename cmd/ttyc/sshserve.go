@@ -0,0 +1,194 @@
+package main
+
+// SSH frontend: configured consoles are served over SSH with public key authentication, so that a team can use them
+// without sharing the credentials of the servers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/Depau/ttyc"
+	"github.com/Depau/ttyc/cmd/ttyc/handlers"
+	"github.com/Depau/ttyc/utils"
+	"github.com/mkideal/cli"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+type sshServeConfig struct {
+	Help           bool   `cli:"!h,help" usage:"Show help"`
+	Listen         string `cli:"l,listen" usage:"Address to serve SSH on" dft:"127.0.0.1:2222"`
+	HostKey        string `cli:"host-key" usage:"SSH host private key file, an ECDSA key is generated if it doesn't exist" dft:""`
+	AuthorizedKeys string `cli:"authorized-keys" usage:"Public keys allowed to log in, in the OpenSSH authorized_keys format without options; read on every login" dft:""`
+	User           string `cli:"u,user" usage:"Username for the consoles without credentials in their URL" dft:""`
+	Pass           string `cli:"k,pass" usage:"Password for the consoles without credentials in their URL" dft:""`
+	Watchdog       int    `cli:"w,watchdog" usage:"WebSocket ping interval in seconds, 0 to disable, default 2." dft:"2"`
+	NoColor        bool   `cli:"no-color" usage:"Print status messages without colors (implied when logging to journald)" dft:"false"`
+}
+
+func (argv *sshServeConfig) AutoHelp() bool {
+	return argv.Help
+}
+
+func (argv *sshServeConfig) Validate(ctx *cli.Context) error {
+	if ctx.NArg() == 0 {
+		return fmt.Errorf("at least one console must be provided")
+	}
+	if argv.HostKey == "" {
+		return fmt.Errorf("a host key file must be provided")
+	}
+	if argv.AuthorizedKeys == "" {
+		return fmt.Errorf("an authorized_keys file must be provided")
+	}
+	if (argv.User == "") != (argv.Pass == "") {
+		return fmt.Errorf("user and password must be both provided or not provided at all")
+	}
+	if argv.Watchdog < 0 {
+		return fmt.Errorf("invalid watchdog interval: %d", argv.Watchdog)
+	}
+	_, err := argv.consoles(ctx.Args())
+	return err
+}
+
+var sshServeCommand = &cli.Command{
+	Name: "ssh-serve",
+	Desc: "Serve consoles over SSH, one SSH user per console",
+	Text: "Usage: ttyc ssh-serve [options] <name>=<url>...",
+	// Allows the consoles as positional arguments
+	CanSubRoute: true,
+	Argv:        func() interface{} { return &sshServeConfig{} },
+	Fn:          runSshServe,
+}
+
+// Parses the consoles given as name=url
+func (argv *sshServeConfig) consoles(args []string) (map[string]*handlers.SshConsole, error) {
+	consoles := map[string]*handlers.SshConsole{}
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 || !isValidSessionName(parts[0]) {
+			return nil, fmt.Errorf("invalid console %s, must be name=url", arg)
+		}
+		name := parts[0]
+		if _, ok := consoles[name]; ok {
+			return nil, fmt.Errorf("duplicate console: %s", name)
+		}
+		parsedUrl, err := url.Parse(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid URL for %s: %v", name, err)
+		}
+		if parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https" {
+			return nil, fmt.Errorf("invalid URL for %s, must be http or https", name)
+		}
+		console := &handlers.SshConsole{Url: parsedUrl, Credentials: parsedUrl.User}
+		parsedUrl.User = nil
+		if console.Credentials == nil && argv.User != "" {
+			console.Credentials = url.UserPassword(argv.User, argv.Pass)
+		}
+		consoles[name] = console
+	}
+	return consoles, nil
+}
+
+// Loads the host key, generating it if the file doesn't exist
+func loadHostKey(path string) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			return nil, err
+		}
+		ttyc.TtycPrintf("Generated host key %s\n", path)
+	} else if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return signer, nil
+}
+
+// Loads the authorized keys. Options such as from= and command= can't be honored, so keys with options are refused
+// rather than granted more access than intended.
+func loadAuthorizedKeys(path string) ([]ssh.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []ssh.PublicKey
+	for len(data) > 0 {
+		key, comment, options, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			// No keys left, only blank lines and comments
+			break
+		}
+		if len(options) > 0 {
+			return nil, fmt.Errorf("%s: key options are not supported, found %s on %s %s", path, strings.Join(options, ","), ssh.FingerprintSHA256(key), comment)
+		}
+		keys = append(keys, key)
+		data = rest
+	}
+	return keys, nil
+}
+
+func runSshServe(ctx *cli.Context) error {
+	argv := ctx.Argv().(*sshServeConfig)
+	if argv.NoColor || utils.IsJournalStream() {
+		ttyc.UseColors = false
+	}
+
+	// Validated already
+	consoles, _ := argv.consoles(ctx.Args())
+	hostKey, err := loadHostKey(argv.HostKey)
+	if err != nil {
+		return fmt.Errorf("unable to load the host key: %v", err)
+	}
+	// Report a missing file now rather than at the first login
+	if _, err := loadAuthorizedKeys(argv.AuthorizedKeys); err != nil {
+		return fmt.Errorf("unable to load the authorized keys: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", argv.Listen)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s: %v", argv.Listen, err)
+	}
+	server := handlers.NewSshServer(hostKey, func() ([]ssh.PublicKey, error) {
+		return loadAuthorizedKeys(argv.AuthorizedKeys)
+	}, consoles, argv.Watchdog)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-signals
+		_ = server.Close()
+	}()
+
+	var names []string
+	for name := range consoles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ttyc.TtycPrintf("Serving %s on %s, host key %s\n", strings.Join(names, ", "), listener.Addr(), ssh.FingerprintSHA256(hostKey.PublicKey()))
+	if err := server.Serve(listener); err != nil {
+		return fmt.Errorf("SSH server stopped: %v", err)
+	}
+	return nil
+}
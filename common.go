@@ -26,6 +26,12 @@ const COPYRIGHT = "Copyright (c) 2022 Davide Depau\n\n" +
 
 var Strftime, _ = strftimeMod.New("%H:%M:%S")
 
+// Set to false to print status messages without ANSI colors, i.e. when logging to journald
+var UseColors = true
+
+// Where TtycPrintf prints status messages. Set to os.Stderr to keep the standard output clean, i.e. in pipe mode.
+var StatusOutput = os.Stdout
+
 type TokenDTO struct {
 	Token string `json:"token"`
 }
@@ -223,6 +229,9 @@ func Stty(url *url.URL, credentials *url.Userinfo, dto *SttyDTO) (stty SttyDTO,
 }
 
 func PlatformGray() string {
+	if !UseColors {
+		return ""
+	}
 	if runtime.GOOS == "windows" {
 		return color.Gray
 	}
@@ -230,24 +239,41 @@ func PlatformGray() string {
 }
 
 func PlatformYellow() string {
+	if !UseColors {
+		return ""
+	}
 	if runtime.GOOS == "windows" {
 		return color.Yellow
 	}
 	return "\u001B[31m"
 }
 
+func PlatformRed() string {
+	if !UseColors {
+		return ""
+	}
+	return color.Red
+}
+
+func PlatformReset() string {
+	if !UseColors {
+		return ""
+	}
+	return color.Reset
+}
+
 func TtycErrFprintf(w io.Writer, format string, a ...interface{}) {
 	// Ignore fprintf errors here since I wasn't planning to care anywhere else regardless
-	_, _ = fmt.Fprintf(w, color.Red+"[ttyc %s] ", Strftime.FormatString(time.Now()))
+	_, _ = fmt.Fprintf(w, PlatformRed()+"[ttyc %s] ", Strftime.FormatString(time.Now()))
 	_, _ = fmt.Fprintf(w, format, a...)
-	_, _ = fmt.Fprint(w, color.Reset)
+	_, _ = fmt.Fprint(w, PlatformReset())
 }
 
 func TtycFprintf(w io.Writer, format string, a ...interface{}) {
 	// Ignore fprintf errors here since I wasn't planning to care anywhere else regardless
 	_, _ = fmt.Fprintf(w, PlatformYellow()+"[ttyc %s] ", Strftime.FormatString(time.Now()))
 	_, _ = fmt.Fprintf(w, format, a...)
-	_, _ = fmt.Fprint(w, color.Reset)
+	_, _ = fmt.Fprint(w, PlatformReset())
 }
 
 func TtycErrPrintf(format string, args ...interface{}) {
@@ -260,5 +286,5 @@ func TtycAngryPrintf(format string, args ...interface{}) {
 }
 
 func TtycPrintf(format string, args ...interface{}) {
-	TtycFprintf(os.Stdout, format, args...)
+	TtycFprintf(StatusOutput, format, args...)
 }
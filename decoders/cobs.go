@@ -0,0 +1,70 @@
+package decoders
+
+import "fmt"
+
+// Frames that don't end after this many bytes are reported as invalid, so that a wrong decoder doesn't buffer forever
+const cobsMaxFrame = 64 * 1024
+
+func init() {
+	Register("cobs", func() Decoder { return &cobsDecoder{} })
+}
+
+// cobsDecoder decodes Consistent Overhead Byte Stuffing frames delimited by zero bytes
+type cobsDecoder struct {
+	encoded []byte
+}
+
+func (d *cobsDecoder) Decode(data []byte) []Frame {
+	var frames []Frame
+	for _, char := range data {
+		if char != 0 {
+			d.encoded = append(d.encoded, char)
+			if len(d.encoded) >= cobsMaxFrame {
+				frames = append(frames, Frame{
+					Summary: fmt.Sprintf("%d bytes", len(d.encoded)),
+					Payload: d.encoded,
+					Error:   "no delimiter found",
+				})
+				d.encoded = nil
+			}
+			continue
+		}
+		if len(d.encoded) == 0 {
+			continue
+		}
+		frame, err := cobsDecode(d.encoded)
+		f := Frame{
+			Summary: fmt.Sprintf("%d bytes", len(frame)),
+			Payload: frame,
+		}
+		if err != nil {
+			f.Error = err.Error()
+		}
+		frames = append(frames, f)
+		d.encoded = nil
+	}
+	return frames
+}
+
+func (d *cobsDecoder) Idle() []Frame {
+	return nil
+}
+
+// Decodes a COBS frame, without the delimiter. On error, the data decoded so far is returned.
+func cobsDecode(encoded []byte) ([]byte, error) {
+	decoded := make([]byte, 0, len(encoded))
+	for pos := 0; pos < len(encoded); {
+		code := int(encoded[pos])
+		end := pos + code
+		if end > len(encoded) {
+			return append(decoded, encoded[pos+1:]...), fmt.Errorf("block at offset %d is truncated", pos)
+		}
+		decoded = append(decoded, encoded[pos+1:end]...)
+		pos = end
+		// The zero is implicit after blocks shorter than the maximum, except at the end of the frame
+		if code < 0xFF && pos < len(encoded) {
+			decoded = append(decoded, 0)
+		}
+	}
+	return decoded, nil
+}
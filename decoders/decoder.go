@@ -0,0 +1,115 @@
+// Package decoders finds the frames of serial protocols in the received byte stream, so that they can be shown
+// decoded in the terminal and in the logs.
+//
+// Decoders for other protocols can be added by implementing Decoder and registering a factory with Register, usually
+// from an init function.
+package decoders
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Frame is a protocol frame found in the stream
+type Frame struct {
+	// Short description of the frame, i.e. the message type
+	Summary string
+	// Decoded payload, may be empty
+	Payload []byte
+	// Set if the frame is invalid, i.e. because the checksum doesn't match
+	Error string
+	// When the last byte of the frame was received, set by Stream
+	Time time.Time
+}
+
+// Decoder is fed the received data and returns the frames it completes. Decoders are stateful: frames may span any
+// number of chunks.
+type Decoder interface {
+	Decode(data []byte) []Frame
+	// Idle is called when nothing has been received for a while. Protocols delimiting frames with silence, such as
+	// Modbus RTU, complete the pending frame; most decoders return nil.
+	Idle() []Frame
+}
+
+type Factory func() Decoder
+
+var (
+	registryLock sync.RWMutex
+	registry     = map[string]Factory{}
+)
+
+// Register makes a decoder available under the given name, replacing any decoder with the same name
+func Register(name string, factory Factory) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registry[name] = factory
+}
+
+// New creates a decoder by name
+func New(name string) (Decoder, error) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	factory, ok := registry[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown decoder '%s'", name)
+	}
+	return factory(), nil
+}
+
+// Names returns the names of the registered decoders, sorted
+func Names() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Stream feeds a decoder with timestamped chunks, reporting the idle gaps longer than Gap found between them
+type Stream struct {
+	Name    string
+	Decoder Decoder
+	Gap     time.Duration
+	last    time.Time
+}
+
+func NewStream(name string, gap time.Duration) (*Stream, error) {
+	decoder, err := New(name)
+	if err != nil {
+		return nil, err
+	}
+	return &Stream{
+		Name:    name,
+		Decoder: decoder,
+		Gap:     gap,
+	}, nil
+}
+
+// Feed decodes a chunk received at the given time
+func (s *Stream) Feed(data []byte, now time.Time) []Frame {
+	var frames []Frame
+	if !s.last.IsZero() && now.Sub(s.last) > s.Gap {
+		frames = s.Idle()
+	}
+	s.last = now
+	return append(frames, stampFrames(s.Decoder.Decode(data), now)...)
+}
+
+// Idle reports that the line has been idle since the last chunk, i.e. when a timer expires
+func (s *Stream) Idle() []Frame {
+	frames := stampFrames(s.Decoder.Idle(), s.last)
+	s.last = time.Time{}
+	return frames
+}
+
+func stampFrames(frames []Frame, now time.Time) []Frame {
+	for i := range frames {
+		frames[i].Time = now
+	}
+	return frames
+}
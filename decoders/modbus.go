@@ -0,0 +1,124 @@
+package decoders
+
+import "fmt"
+
+// Modbus RTU frames are delimited by silence on the line, and are at most 256 bytes long
+const modbusMaxFrame = 256
+
+var modbusFunctions = map[byte]string{
+	0x01: "Read Coils",
+	0x02: "Read Discrete Inputs",
+	0x03: "Read Holding Registers",
+	0x04: "Read Input Registers",
+	0x05: "Write Single Coil",
+	0x06: "Write Single Register",
+	0x07: "Read Exception Status",
+	0x08: "Diagnostics",
+	0x0B: "Get Comm Event Counter",
+	0x0C: "Get Comm Event Log",
+	0x0F: "Write Multiple Coils",
+	0x10: "Write Multiple Registers",
+	0x11: "Report Server ID",
+	0x14: "Read File Record",
+	0x15: "Write File Record",
+	0x16: "Mask Write Register",
+	0x17: "Read/Write Multiple Registers",
+	0x18: "Read FIFO Queue",
+	0x2B: "Encapsulated Interface Transport",
+}
+
+var modbusExceptions = map[byte]string{
+	0x01: "Illegal Function",
+	0x02: "Illegal Data Address",
+	0x03: "Illegal Data Value",
+	0x04: "Server Device Failure",
+	0x05: "Acknowledge",
+	0x06: "Server Device Busy",
+	0x08: "Memory Parity Error",
+	0x0A: "Gateway Path Unavailable",
+	0x0B: "Gateway Target Device Failed to Respond",
+}
+
+func init() {
+	Register("modbus-rtu", func() Decoder { return &modbusDecoder{} })
+}
+
+type modbusDecoder struct {
+	frame []byte
+}
+
+func (d *modbusDecoder) Decode(data []byte) []Frame {
+	d.frame = append(d.frame, data...)
+	if len(d.frame) <= modbusMaxFrame {
+		return nil
+	}
+	frame := Frame{
+		Summary: fmt.Sprintf("%d bytes", len(d.frame)),
+		Payload: d.frame,
+		Error:   "frame too long, the idle gap may be too short",
+	}
+	d.frame = nil
+	return []Frame{frame}
+}
+
+func (d *modbusDecoder) Idle() []Frame {
+	if len(d.frame) == 0 {
+		return nil
+	}
+	frame := decodeModbusFrame(d.frame)
+	d.frame = nil
+	return []Frame{frame}
+}
+
+func decodeModbusFrame(data []byte) Frame {
+	if len(data) < 4 {
+		return Frame{
+			Summary: fmt.Sprintf("%d bytes", len(data)),
+			Payload: data,
+			Error:   "frame too short",
+		}
+	}
+
+	body := data[:len(data)-2]
+	address, function := body[0], body[1]
+	frame := Frame{Payload: body[2:]}
+
+	name, ok := modbusFunctions[function&0x7F]
+	if !ok {
+		name = "Unknown Function"
+	}
+	if function&0x80 != 0 && len(frame.Payload) == 1 {
+		code := frame.Payload[0]
+		exception, ok := modbusExceptions[code]
+		if !ok {
+			exception = "Unknown Exception"
+		}
+		frame.Summary = fmt.Sprintf("slave %d, %s (0x%02x) exception: %s (0x%02x)", address, name, function&0x7F, exception, code)
+	} else {
+		frame.Summary = fmt.Sprintf("slave %d, %s (0x%02x)", address, name, function)
+	}
+
+	expected := crc16Modbus(body)
+	// The CRC is sent low byte first
+	received := uint16(data[len(data)-2]) | uint16(data[len(data)-1])<<8
+	if expected != received {
+		frame.Error = fmt.Sprintf("CRC mismatch: received %04x, expected %04x", received, expected)
+	}
+	return frame
+}
+
+// CRC-16/MODBUS: reflected polynomial 0xA001, initial value 0xFFFF
+func crc16Modbus(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, char := range data {
+		crc ^= uint16(char)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
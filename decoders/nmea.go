@@ -0,0 +1,89 @@
+package decoders
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Sentences are at most 82 characters long; longer lines are reported as soon as this is exceeded
+const nmeaMaxLine = 1024
+
+func init() {
+	Register("nmea", func() Decoder { return &nmeaDecoder{} })
+}
+
+// nmeaDecoder validates NMEA 0183 sentences, one per line
+type nmeaDecoder struct {
+	line []byte
+}
+
+func (d *nmeaDecoder) Decode(data []byte) []Frame {
+	var frames []Frame
+	for len(data) > 0 {
+		end := bytes.IndexByte(data, '\n')
+		if end < 0 {
+			d.line = append(d.line, data...)
+			if len(d.line) > nmeaMaxLine {
+				frames = append(frames, Frame{
+					Summary: printable(d.line),
+					Error:   "line too long",
+				})
+				d.line = nil
+			}
+			break
+		}
+		d.line = append(d.line, data[:end]...)
+		data = data[end+1:]
+		line := bytes.TrimRight(d.line, "\r")
+		d.line = nil
+		if len(line) > 0 {
+			frames = append(frames, decodeNmeaSentence(line))
+		}
+	}
+	return frames
+}
+
+func (d *nmeaDecoder) Idle() []Frame {
+	return nil
+}
+
+// Escapes the non-printable characters in a line, so that binary data doesn't garble the terminal
+func printable(line []byte) string {
+	var sb strings.Builder
+	for _, char := range line {
+		if char >= 0x20 && char <= 0x7e {
+			sb.WriteByte(char)
+		} else {
+			_, _ = fmt.Fprintf(&sb, "\\x%02x", char)
+		}
+	}
+	return sb.String()
+}
+
+func decodeNmeaSentence(line []byte) Frame {
+	frame := Frame{Summary: printable(line)}
+	// '!' starts encapsulated sentences, such as AIS messages
+	if line[0] != '$' && line[0] != '!' {
+		frame.Error = "not an NMEA sentence"
+		return frame
+	}
+
+	star := bytes.LastIndexByte(line, '*')
+	if star < 0 {
+		frame.Error = "missing checksum"
+		return frame
+	}
+	var expected byte
+	for _, char := range line[1:star] {
+		expected ^= char
+	}
+	received, err := strconv.ParseUint(string(line[star+1:]), 16, 8)
+	if err != nil || len(line) != star+3 {
+		frame.Error = "invalid checksum"
+	} else if byte(received) != expected {
+		frame.Error = fmt.Sprintf("checksum mismatch: received %02X, expected %02X", received, expected)
+	}
+	return frame
+}
@@ -0,0 +1,61 @@
+package decoders
+
+import "fmt"
+
+// SLIP (RFC 1055) special characters
+const (
+	slipEnd    = 0xC0
+	slipEsc    = 0xDB
+	slipEscEnd = 0xDC
+	slipEscEsc = 0xDD
+)
+
+func init() {
+	Register("slip", func() Decoder { return &slipDecoder{} })
+}
+
+type slipDecoder struct {
+	frame   []byte
+	escaped bool
+	err     string
+}
+
+func (d *slipDecoder) Decode(data []byte) []Frame {
+	var frames []Frame
+	for _, char := range data {
+		switch {
+		case char == slipEnd:
+			// Back-to-back END characters are used to flush line noise, they don't delimit empty frames
+			if len(d.frame) > 0 || d.err != "" {
+				frames = append(frames, Frame{
+					Summary: fmt.Sprintf("%d bytes", len(d.frame)),
+					Payload: d.frame,
+					Error:   d.err,
+				})
+			}
+			d.frame, d.escaped, d.err = nil, false, ""
+		case d.escaped:
+			d.escaped = false
+			switch char {
+			case slipEscEnd:
+				d.frame = append(d.frame, slipEnd)
+			case slipEscEsc:
+				d.frame = append(d.frame, slipEsc)
+			default:
+				if d.err == "" {
+					d.err = fmt.Sprintf("invalid escape sequence db %02x", char)
+				}
+				d.frame = append(d.frame, char)
+			}
+		case char == slipEsc:
+			d.escaped = true
+		default:
+			d.frame = append(d.frame, char)
+		}
+	}
+	return frames
+}
+
+func (d *slipDecoder) Idle() []Frame {
+	return nil
+}
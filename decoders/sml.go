@@ -0,0 +1,295 @@
+package decoders
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// SML (Smart Message Language) transport protocol v1, as sent by smart electricity meters: files start with an escape
+// sequence followed by 01010101, end with an escape sequence followed by 1a, the number of fill bytes and a CRC.
+// Escape sequences in the data are doubled. Everything is aligned to 4 bytes.
+
+const smlMaxFile = 64 * 1024
+
+var (
+	smlEscape = []byte{0x1b, 0x1b, 0x1b, 0x1b}
+	smlStart  = []byte{0x1b, 0x1b, 0x1b, 0x1b, 0x01, 0x01, 0x01, 0x01}
+)
+
+// Type-length field types
+const (
+	smlTypeMask     = 0x70
+	smlTypeUnsigned = 0x60
+	smlTypeList     = 0x70
+)
+
+var smlMessageNames = map[uint32]string{
+	0x0100: "OpenRequest",
+	0x0101: "OpenResponse",
+	0x0200: "CloseRequest",
+	0x0201: "CloseResponse",
+	0x0300: "GetProfilePackRequest",
+	0x0301: "GetProfilePackResponse",
+	0x0400: "GetProfileListRequest",
+	0x0401: "GetProfileListResponse",
+	0x0500: "GetProcParameterRequest",
+	0x0501: "GetProcParameterResponse",
+	0x0600: "SetProcParameterRequest",
+	0x0700: "GetListRequest",
+	0x0701: "GetListResponse",
+	0x0800: "GetCosemRequest",
+	0x0801: "GetCosemResponse",
+	0x0900: "SetCosemRequest",
+	0x0901: "SetCosemResponse",
+	0x0A00: "ActionCosemRequest",
+	0x0A01: "ActionCosemResponse",
+	0xFF01: "AttentionResponse",
+}
+
+func init() {
+	Register("sml", func() Decoder { return &smlDecoder{} })
+}
+
+type smlDecoder struct {
+	data []byte
+	// Whether data starts with a start sequence
+	inFile bool
+	// Offset of the next 4-byte block to check for escape sequences
+	scan int
+	// Bytes received outside of files, reported when the next file starts
+	skipped int
+}
+
+func (d *smlDecoder) Decode(data []byte) []Frame {
+	d.data = append(d.data, data...)
+	var frames []Frame
+	for {
+		if !d.inFile {
+			start := bytes.Index(d.data, smlStart)
+			if start < 0 {
+				// Keep the bytes that could be the beginning of a start sequence
+				if keep := len(smlStart) - 1; len(d.data) > keep {
+					d.skipped += len(d.data) - keep
+					d.data = append([]byte{}, d.data[len(d.data)-keep:]...)
+				}
+				return frames
+			}
+			d.skipped += start
+			if d.skipped > 0 {
+				frames = append(frames, Frame{
+					Summary: fmt.Sprintf("%d bytes", d.skipped),
+					Error:   "data outside of SML files",
+				})
+				d.skipped = 0
+			}
+			d.data = d.data[start:]
+			d.inFile = true
+			d.scan = len(smlStart)
+		}
+
+		frame, found := d.findEnd()
+		if !found {
+			if len(d.data) > smlMaxFile {
+				frames = append(frames, Frame{
+					Summary: fmt.Sprintf("%d bytes", len(d.data)),
+					Error:   "no end sequence found",
+				})
+				d.data = nil
+				d.inFile = false
+			}
+			return frames
+		}
+		frames = append(frames, frame)
+	}
+}
+
+// Looks for the end of the current file, consuming it if found
+func (d *smlDecoder) findEnd() (frame Frame, found bool) {
+	for ; d.scan+8 <= len(d.data); d.scan += 4 {
+		if !bytes.Equal(d.data[d.scan:d.scan+4], smlEscape) {
+			continue
+		}
+		next := d.data[d.scan+4 : d.scan+8]
+		switch {
+		case bytes.Equal(next, smlEscape):
+			// Escaped escape sequence
+			d.scan += 4
+			continue
+		case next[0] == 0x1a:
+			frame = decodeSmlFile(d.data[:d.scan+8])
+			d.data = d.data[d.scan+8:]
+		case bytes.Equal(next, smlStart[4:]):
+			frame = Frame{
+				Summary: fmt.Sprintf("%d bytes", d.scan),
+				Error:   "truncated file",
+			}
+			d.data = d.data[d.scan:]
+		default:
+			frame = Frame{
+				Summary: fmt.Sprintf("%d bytes", d.scan+8),
+				Error:   fmt.Sprintf("invalid escape sequence % x", next),
+			}
+			d.data = d.data[d.scan+8:]
+		}
+		d.inFile = false
+		return frame, true
+	}
+	return frame, false
+}
+
+func (d *smlDecoder) Idle() []Frame {
+	return nil
+}
+
+// Decodes a file including the start and end sequences
+func decodeSmlFile(file []byte) Frame {
+	var body []byte
+	for pos := len(smlStart); pos < len(file)-8; pos += 4 {
+		body = append(body, file[pos:pos+4]...)
+		if bytes.Equal(file[pos:pos+4], smlEscape) {
+			pos += 4
+		}
+	}
+	frame := Frame{Payload: body}
+
+	fill := int(file[len(file)-3])
+	if fill > 3 || fill > len(body) {
+		frame.Summary = fmt.Sprintf("%d bytes", len(body))
+		frame.Error = fmt.Sprintf("invalid fill byte count %d", fill)
+		return frame
+	}
+	frame.Payload = body[:len(body)-fill]
+
+	if messages, err := smlMessageTypes(frame.Payload); err != nil {
+		frame.Summary = fmt.Sprintf("%d bytes", len(frame.Payload))
+		frame.Error = err.Error()
+	} else {
+		frame.Summary = strings.Join(messages, ", ")
+	}
+
+	expected := crc16X25(file[:len(file)-2])
+	// The CRC is sent low byte first
+	received := uint16(file[len(file)-2]) | uint16(file[len(file)-1])<<8
+	if expected != received {
+		frame.Error = fmt.Sprintf("CRC mismatch: received %04x, expected %04x", received, expected)
+	}
+	return frame
+}
+
+// Returns the type of the messages in a file body
+func smlMessageTypes(body []byte) ([]string, error) {
+	var messages []string
+	pos := 0
+	for pos < len(body) {
+		// A message is a list of transaction ID, group number, abort on error, message body, CRC and end of message
+		typ, length, size, err := smlReadTL(body, pos)
+		if err != nil {
+			return nil, err
+		}
+		if typ != smlTypeList || length != 6 {
+			return nil, fmt.Errorf("expected a message at offset %d", pos)
+		}
+		pos += size
+		for i := 0; i < 3; i++ {
+			if pos, err = smlSkip(body, pos); err != nil {
+				return nil, err
+			}
+		}
+
+		// The message body is a list of a tag and the content
+		typ, length, size, err = smlReadTL(body, pos)
+		if err != nil {
+			return nil, err
+		}
+		if typ != smlTypeList || length != 2 {
+			return nil, fmt.Errorf("expected a message body at offset %d", pos)
+		}
+		pos += size
+		typ, length, size, err = smlReadTL(body, pos)
+		if err != nil {
+			return nil, err
+		}
+		if typ != smlTypeUnsigned || length <= size || pos+length > len(body) {
+			return nil, fmt.Errorf("expected a message tag at offset %d", pos)
+		}
+		var tag uint32
+		for _, char := range body[pos+size : pos+length] {
+			tag = tag<<8 | uint32(char)
+		}
+		name, ok := smlMessageNames[tag]
+		if !ok {
+			name = fmt.Sprintf("message %04x", tag)
+		}
+		messages = append(messages, name)
+		pos += length
+
+		// Content and CRC
+		for i := 0; i < 2; i++ {
+			if pos, err = smlSkip(body, pos); err != nil {
+				return nil, err
+			}
+		}
+		if pos >= len(body) || body[pos] != 0 {
+			return nil, fmt.Errorf("expected end of message at offset %d", pos)
+		}
+		pos++
+	}
+	return messages, nil
+}
+
+// Reads the type-length field at pos, returning the type, the length and the size of the field itself. For lists the
+// length is the number of elements, otherwise it includes the type-length field.
+func smlReadTL(data []byte, pos int) (typ byte, length int, size int, err error) {
+	if pos >= len(data) {
+		return 0, 0, 0, fmt.Errorf("unexpected end of data")
+	}
+	typ = data[pos] & smlTypeMask
+	length = int(data[pos] & 0x0F)
+	size = 1
+	for data[pos+size-1]&0x80 != 0 {
+		if pos+size >= len(data) {
+			return 0, 0, 0, fmt.Errorf("unexpected end of data")
+		}
+		length = length<<4 | int(data[pos+size]&0x0F)
+		size++
+	}
+	return
+}
+
+// Returns the position following the element at pos
+func smlSkip(data []byte, pos int) (int, error) {
+	typ, length, size, err := smlReadTL(data, pos)
+	if err != nil {
+		return 0, err
+	}
+	if typ == smlTypeList {
+		pos += size
+		for i := 0; i < length; i++ {
+			if pos, err = smlSkip(data, pos); err != nil {
+				return 0, err
+			}
+		}
+		return pos, nil
+	}
+	if length < size || pos+length > len(data) {
+		return 0, fmt.Errorf("invalid element at offset %d", pos)
+	}
+	return pos + length, nil
+}
+
+// CRC-16/X-25: reflected polynomial 0x8408, initial value 0xFFFF, inverted result
+func crc16X25(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, char := range data {
+		crc ^= uint16(char)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0x8408
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return ^crc
+}
@@ -0,0 +1,283 @@
+// Package expect drives a ttyd or Wi-Se console from Go code, i.e. for hardware-in-the-loop integration tests.
+//
+//	session, err := expect.Dial("http://wi-se.local", &expect.Options{Timeout: 30 * time.Second})
+//	if err != nil {
+//		return err
+//	}
+//	defer session.Close()
+//	_ = session.SendLine("uname -r")
+//	match, err := session.Expect(ctx, regexp.MustCompile(`(\d+)\.(\d+)\.\d+`))
+//
+// Sessions don't reconnect: once the connection is lost every call fails.
+package expect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Depau/ttyc"
+	"github.com/Depau/ttyc/ws"
+	"io"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Unmatched output included in Expect errors
+const maxErrorOutput = 512
+
+// ErrNotWiSe is returned by the operations that are only available on Wi-Se
+var ErrNotWiSe = errors.New("only available with Wi-Se")
+
+// Options configures a Session
+type Options struct {
+	// Credentials for the server, taken from the URL if nil
+	Credentials *url.Userinfo
+	// WebSocket ping interval in seconds, 0 to disable
+	Watchdog int
+	// Timeout of Expect when the context has no deadline, 10 seconds if zero
+	Timeout time.Duration
+	// The output of the session is copied here, if set
+	Transcript io.Writer
+	// Directory where ForTest saves a transcript for each test, if set
+	TranscriptDir string
+}
+
+// Session is a connection to a console
+type Session struct {
+	client         *ws.Client
+	implementation ttyc.Implementation
+	server         string
+	credentials    *url.Userinfo
+	timeout        time.Duration
+	transcript     io.Writer
+
+	mutex sync.Mutex
+	// All the output received
+	output []byte
+	// Offset in output where the next Expect starts looking
+	matched int
+	// Why the session ended, if it did
+	err error
+	// Signaled when output is received
+	notify chan struct{}
+	done   chan struct{}
+	// Held while sending to the client, so that Close doesn't close its channels meanwhile
+	sendMutex sync.Mutex
+}
+
+// Dial performs the handshake with the server at rawUrl, connects to its terminal and starts capturing the output
+func Dial(rawUrl string, options *Options) (*Session, error) {
+	if options == nil {
+		options = &Options{}
+	}
+	baseUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	credentials := options.Credentials
+	if credentials == nil {
+		credentials = baseUrl.User
+	}
+	baseUrl.User = nil
+
+	token, implementation, server, err := ttyc.Handshake(ttyc.GetUrlFor(ttyc.UrlForToken, baseUrl), credentials)
+	if err != nil {
+		return nil, fmt.Errorf("handshake failed: %v", err)
+	}
+	client, err := ws.DialAndAuth(baseUrl, &token, options.Watchdog)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect or authenticate to server: %v", err)
+	}
+
+	s := &Session{
+		client:         client,
+		implementation: implementation,
+		server:         server,
+		credentials:    credentials,
+		timeout:        options.Timeout,
+		transcript:     options.Transcript,
+		notify:         make(chan struct{}, 1),
+		done:           make(chan struct{}),
+	}
+	if s.timeout <= 0 {
+		s.timeout = 10 * time.Second
+	}
+	go client.Run(options.Watchdog)
+	go s.readLoop()
+	return s, nil
+}
+
+func (s *Session) readLoop() {
+	for {
+		select {
+		case chunk, ok := <-s.client.Output:
+			if !ok {
+				return
+			}
+			if s.transcript != nil {
+				_, _ = s.transcript.Write(chunk.Data)
+			}
+			s.mutex.Lock()
+			s.output = append(s.output, chunk.Data...)
+			s.mutex.Unlock()
+			select {
+			case s.notify <- struct{}{}:
+			default:
+			}
+		case err := <-s.client.Error:
+			s.finish(fmt.Errorf("disconnected: %v", err))
+			return
+		case <-s.client.WinTitle:
+		case <-s.client.DetectedBaudrate:
+		case <-s.client.CloseChan:
+			return
+		}
+	}
+}
+
+// Marks the session as ended, keeping the first reason
+func (s *Session) finish(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.err == nil {
+		s.err = err
+		close(s.done)
+	}
+}
+
+// Err returns why the session ended, or nil if it's still connected
+func (s *Session) Err() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.err
+}
+
+// Server returns the Server header sent by the server
+func (s *Session) Server() string {
+	return s.server
+}
+
+// IsWiSe returns true if the server is a Wi-Se
+func (s *Session) IsWiSe() bool {
+	return s.implementation == ttyc.ImplementationWiSe
+}
+
+// Expect waits for the output received since the previous match to match re, and returns the match and its
+// submatches. The output up to the end of the match is consumed. If ctx has no deadline, the session timeout applies.
+func (s *Session) Expect(ctx context.Context, re *regexp.Regexp) ([]string, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	for {
+		s.mutex.Lock()
+		pending := s.output[s.matched:]
+		match := re.FindSubmatchIndex(pending)
+		var submatches []string
+		if match != nil {
+			for i := 0; i < len(match); i += 2 {
+				if match[i] >= 0 {
+					submatches = append(submatches, string(pending[match[i]:match[i+1]]))
+				} else {
+					submatches = append(submatches, "")
+				}
+			}
+			s.matched += match[1]
+		}
+		err := s.err
+		s.mutex.Unlock()
+		if match != nil {
+			return submatches, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("expect /%s/: %v", re, err)
+		}
+
+		select {
+		case <-s.notify:
+		case <-s.done:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("expect /%s/: %v, unmatched output: %q", re, ctx.Err(), s.pending())
+		}
+	}
+}
+
+// Returns the tail of the output not matched yet
+func (s *Session) pending() []byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	pending := s.output[s.matched:]
+	if len(pending) > maxErrorOutput {
+		pending = pending[len(pending)-maxErrorOutput:]
+	}
+	return append([]byte(nil), pending...)
+}
+
+// Send sends data to the terminal
+func (s *Session) Send(data []byte) error {
+	s.sendMutex.Lock()
+	defer s.sendMutex.Unlock()
+	if err := s.Err(); err != nil {
+		return err
+	}
+	select {
+	case s.client.Input <- data:
+		return nil
+	case <-s.done:
+		return s.Err()
+	}
+}
+
+// SendLine sends line followed by CR, like the Enter key
+func (s *Session) SendLine(line string) error {
+	return s.Send([]byte(line + "\r"))
+}
+
+// SendBreak sends a break (Wi-Se only)
+func (s *Session) SendBreak() error {
+	if !s.IsWiSe() {
+		return ErrNotWiSe
+	}
+	s.sendMutex.Lock()
+	defer s.sendMutex.Unlock()
+	if err := s.Err(); err != nil {
+		return err
+	}
+	s.client.SendBreak()
+	return nil
+}
+
+// SetStty sets the remote UART parameters that are not nil in dto, and returns the resulting ones (Wi-Se only)
+func (s *Session) SetStty(dto *ttyc.SttyDTO) (ttyc.SttyDTO, error) {
+	if !s.IsWiSe() {
+		return ttyc.SttyDTO{}, ErrNotWiSe
+	}
+	return ttyc.Stty(ttyc.GetUrlFor(ttyc.UrlForStty, s.client.BaseUrl), s.credentials, dto)
+}
+
+// GetStty returns the remote UART parameters (Wi-Se only)
+func (s *Session) GetStty() (ttyc.SttyDTO, error) {
+	if !s.IsWiSe() {
+		return ttyc.SttyDTO{}, ErrNotWiSe
+	}
+	return ttyc.GetStty(ttyc.GetUrlFor(ttyc.UrlForStty, s.client.BaseUrl), s.credentials)
+}
+
+// Output returns a copy of all the output received so far, matched or not
+func (s *Session) Output() []byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]byte(nil), s.output...)
+}
+
+// Close disconnects from the server
+func (s *Session) Close() error {
+	s.finish(errors.New("session closed"))
+	// Sends blocked on the client are interrupted by finish
+	s.sendMutex.Lock()
+	defer s.sendMutex.Unlock()
+	return s.client.Close()
+}
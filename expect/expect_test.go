@@ -0,0 +1,131 @@
+package expect
+
+import (
+	"context"
+	"github.com/Depau/ttyc"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+func dialFake(t *testing.T, wiSe bool) (*FakeServer, *Session) {
+	t.Helper()
+	fake := NewFakeServer(wiSe)
+	t.Cleanup(fake.Close)
+	session := ForTest(t, fake.URL, &Options{Timeout: 5 * time.Second})
+	return fake, session
+}
+
+// Waits for cond to become true, failing the test after a while
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestExpect(t *testing.T) {
+	fake, session := dialFake(t, false)
+	fake.Echo = true
+
+	fake.Output([]byte("U-Boot 2021.04\r\n=> "))
+	match, err := session.Expect(context.Background(), regexp.MustCompile(`U-Boot (\d+)\.(\d+)`))
+	if err != nil {
+		t.Fatalf("expect failed: %v", err)
+	}
+	if len(match) != 3 || match[1] != "2021" || match[2] != "04" {
+		t.Fatalf("unexpected match: %q", match)
+	}
+	if _, err := session.Expect(context.Background(), regexp.MustCompile(`=> $`)); err != nil {
+		t.Fatalf("expect failed: %v", err)
+	}
+
+	if err := session.SendLine("version"); err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+	if _, err := session.Expect(context.Background(), regexp.MustCompile(`version\r`)); err != nil {
+		t.Fatalf("expect failed: %v", err)
+	}
+	if input := string(fake.Input()); input != "version\r" {
+		t.Fatalf("unexpected input: %q", input)
+	}
+
+	// The output matched already is consumed
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := session.Expect(ctx, regexp.MustCompile(`U-Boot`)); err == nil {
+		t.Fatalf("expect matched consumed output")
+	}
+}
+
+func TestSendBreak(t *testing.T) {
+	fake, session := dialFake(t, true)
+	if err := session.SendBreak(); err != nil {
+		t.Fatalf("send break failed: %v", err)
+	}
+	waitFor(t, "the break", func() bool { return fake.Breaks() == 1 })
+
+	_, session = dialFake(t, false)
+	if err := session.SendBreak(); err != ErrNotWiSe {
+		t.Fatalf("expected ErrNotWiSe, got %v", err)
+	}
+}
+
+func TestSetStty(t *testing.T) {
+	fake, session := dialFake(t, true)
+	baudrate := uint(9600)
+	parity := "even"
+	stty, err := session.SetStty(&ttyc.SttyDTO{Baudrate: &baudrate, Parity: &parity})
+	if err != nil {
+		t.Fatalf("stty failed: %v", err)
+	}
+	if stty.Baudrate == nil || *stty.Baudrate != 9600 || stty.Parity == nil || *stty.Parity != "even" {
+		t.Fatalf("unexpected stty result: %+v", stty)
+	}
+	if *stty.Databits != 8 || *stty.Stopbits != 1 {
+		t.Fatalf("stty changed other parameters: %+v", stty)
+	}
+	if current := fake.Stty(); *current.Baudrate != 9600 {
+		t.Fatalf("server baud rate is %d", *current.Baudrate)
+	}
+
+	_, session = dialFake(t, false)
+	if _, err := session.SetStty(&ttyc.SttyDTO{Baudrate: &baudrate}); err != ErrNotWiSe {
+		t.Fatalf("expected ErrNotWiSe, got %v", err)
+	}
+}
+
+func TestSendAfterClose(t *testing.T) {
+	_, session := dialFake(t, true)
+
+	// Sends in progress while closing must not panic either
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for session.Send([]byte("x")) == nil {
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := session.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	wg.Wait()
+
+	if err := session.Send([]byte("x")); err == nil {
+		t.Fatalf("send succeeded after close")
+	}
+	if err := session.SendBreak(); err == nil {
+		t.Fatalf("send break succeeded after close")
+	}
+	if _, err := session.Expect(context.Background(), regexp.MustCompile(`never`)); err == nil {
+		t.Fatalf("expect succeeded after close")
+	}
+}
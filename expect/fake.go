@@ -0,0 +1,170 @@
+package expect
+
+// Fake console server, to test code that uses sessions without hardware
+
+import (
+	"encoding/json"
+	"github.com/Depau/ttyc"
+	"github.com/Depau/ttyc/ws"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// Wi-Se /stty format
+type fakeStty struct {
+	Baudrate uint  `json:"baudrate"`
+	Databits uint8 `json:"bits"`
+	Stopbits uint8 `json:"stop"`
+	Parity   *int  `json:"parity"`
+}
+
+// FakeServer is a local ttyd server, optionally posing as a Wi-Se, that records what clients send and outputs what it's
+// told to
+type FakeServer struct {
+	// URL to Dial
+	URL string
+	// Echo the input back to the clients
+	Echo bool
+	// Called with the input of the clients, if set
+	OnInput func(data []byte)
+
+	server *ws.Server
+	http   *httptest.Server
+	mutex  sync.Mutex
+	input  []byte
+	breaks int
+	stty   fakeStty
+	resize [2]int
+}
+
+// NewFakeServer starts a fake server on a local port. If wiSe is true, it identifies itself as a Wi-Se and serves
+// /stty, starting at 115200 8N1.
+func NewFakeServer(wiSe bool) *FakeServer {
+	f := &FakeServer{
+		stty: fakeStty{Baudrate: 115200, Databits: 8, Stopbits: 1},
+	}
+	header := "ttyd"
+	if wiSe {
+		header = "Wi-Se"
+	}
+	f.server = ws.NewServer(f, header, 1024*1024)
+	endpoint := f.server.NewEndpoint(false)
+	if wiSe {
+		endpoint.Handle("/stty", http.HandlerFunc(f.serveStty))
+	}
+	f.http = httptest.NewServer(endpoint)
+	f.URL = f.http.URL
+	return f
+}
+
+func (f *FakeServer) serveStty(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if r.Method == http.MethodPost {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Only the parameters in the request are changed
+		fields := map[string]json.RawMessage{}
+		if err := json.Unmarshal(body, &fields); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		stty := f.stty
+		if _, ok := fields["parity"]; ok {
+			stty.Parity = nil
+		}
+		if err := json.Unmarshal(body, &stty); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.stty = stty
+	}
+	message, _ := json.Marshal(&f.stty)
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(message)
+}
+
+func (f *FakeServer) HandleInput(data []byte) {
+	f.mutex.Lock()
+	f.input = append(f.input, data...)
+	onInput := f.OnInput
+	f.mutex.Unlock()
+	if f.Echo {
+		f.server.Output(data)
+	}
+	if onInput != nil {
+		onInput(data)
+	}
+}
+
+func (f *FakeServer) HandleResize(cols int, rows int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.resize = [2]int{cols, rows}
+}
+
+func (f *FakeServer) HandleBreak() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.breaks++
+}
+
+func (f *FakeServer) HandleDetectBaudrate() {
+	f.mutex.Lock()
+	baudrate := f.stty.Baudrate
+	f.mutex.Unlock()
+	f.server.DetectedBaudrate([2]int64{int64(baudrate), 0})
+}
+
+// Output sends output to the clients. Clients that connect later receive it too.
+func (f *FakeServer) Output(data []byte) {
+	f.server.Output(data)
+}
+
+// Input returns everything the clients sent
+func (f *FakeServer) Input() []byte {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]byte(nil), f.input...)
+}
+
+// Breaks returns the number of breaks received
+func (f *FakeServer) Breaks() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.breaks
+}
+
+// Size returns the last terminal size requested by the clients
+func (f *FakeServer) Size() (cols int, rows int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.resize[0], f.resize[1]
+}
+
+// Stty returns the UART parameters set by the clients
+func (f *FakeServer) Stty() ttyc.SttyDTO {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	baudrate, databits, stopbits := f.stty.Baudrate, f.stty.Databits, f.stty.Stopbits
+	stty := ttyc.SttyDTO{Baudrate: &baudrate, Databits: &databits, Stopbits: &stopbits}
+	if f.stty.Parity != nil {
+		parity := "odd"
+		if *f.stty.Parity == 0 {
+			parity = "even"
+		}
+		stty.Parity = &parity
+	}
+	return stty
+}
+
+// Close disconnects the clients and stops the server
+func (f *FakeServer) Close() {
+	f.server.Close()
+	f.http.Close()
+}
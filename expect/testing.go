@@ -0,0 +1,73 @@
+package expect
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// Output logged when a test fails
+const maxFailureOutput = 4096
+
+// TestingT is the subset of testing.TB used by ForTest
+type TestingT interface {
+	Helper()
+	Name() string
+	Failed() bool
+	Logf(format string, args ...interface{})
+	Fatalf(format string, args ...interface{})
+	Cleanup(func())
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// ForTest dials rawUrl for a test, failing it if the connection fails. The session is closed when the test ends, and
+// the tail of the output is logged if the test failed. If options.TranscriptDir is set, the transcript of the session
+// is saved there in a file named after the test.
+func ForTest(t TestingT, rawUrl string, options *Options) *Session {
+	t.Helper()
+	testOptions := Options{}
+	if options != nil {
+		testOptions = *options
+	}
+
+	var transcript *os.File
+	if testOptions.TranscriptDir != "" {
+		if err := os.MkdirAll(testOptions.TranscriptDir, 0755); err != nil {
+			t.Fatalf("unable to create the transcript directory: %v", err)
+		}
+		path := filepath.Join(testOptions.TranscriptDir, unsafeFileChars.ReplaceAllString(t.Name(), "_")+".log")
+		var err error
+		if transcript, err = os.Create(path); err != nil {
+			t.Fatalf("unable to create the transcript: %v", err)
+		}
+		if testOptions.Transcript != nil {
+			testOptions.Transcript = io.MultiWriter(testOptions.Transcript, transcript)
+		} else {
+			testOptions.Transcript = transcript
+		}
+	}
+
+	session, err := Dial(rawUrl, &testOptions)
+	if err != nil {
+		if transcript != nil {
+			_ = transcript.Close()
+		}
+		t.Fatalf("unable to connect to %s: %v", rawUrl, err)
+	}
+	t.Cleanup(func() {
+		_ = session.Close()
+		if transcript != nil {
+			_ = transcript.Close()
+		}
+		if t.Failed() {
+			output := session.Output()
+			if len(output) > maxFailureOutput {
+				output = output[len(output)-maxFailureOutput:]
+			}
+			t.Logf("console output:\n%s", output)
+		}
+	})
+	return session
+}
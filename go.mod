@@ -9,6 +9,7 @@ require (
 	github.com/lestrrat-go/strftime v1.0.4
 	github.com/mattn/go-isatty v0.0.12
 	github.com/mkideal/cli v0.2.5
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
 	golang.org/x/sys v0.0.0-20210124154548-22da62e12c0c
 	nhooyr.io/websocket v1.8.6
 )
@@ -0,0 +1,215 @@
+// Package transfer implements the XMODEM, YMODEM and ZMODEM file transfer protocols over any byte stream, such as a
+// ttyd session, so that files can be sent to and received from bootloaders and shells on the remote device.
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Link is the connection to the remote device a transfer runs over
+type Link interface {
+	// Read returns the data received, waiting at most timeout. It returns ErrTimeout if nothing was received.
+	Read(timeout time.Duration) ([]byte, error)
+	Write(data []byte) error
+}
+
+var (
+	ErrTimeout  = errors.New("timed out")
+	ErrCanceled = errors.New("canceled")
+	// The remote side aborted the transfer
+	ErrAborted = errors.New("aborted by the remote side")
+)
+
+// Protocols, as accepted by Send and Receive
+const (
+	// XMODEM with 128 byte blocks and CRC, falling back to checksums
+	Xmodem = "xmodem"
+	// XMODEM with 1024 byte blocks
+	Xmodem1k = "xmodem-1k"
+	// YMODEM batch
+	Ymodem = "ymodem"
+	Zmodem = "zmodem"
+)
+
+var Protocols = []string{Xmodem, Xmodem1k, Ymodem, Zmodem}
+
+// Progress is called as the transfer of a file progresses. size is -1 if unknown.
+type Progress func(name string, transferred int64, size int64)
+
+// Time a receiver waits for the sender to start, and the time either side waits for a reply
+const (
+	startTimeout = 60 * time.Second
+	replyTimeout = 10 * time.Second
+	maxRetries   = 10
+)
+
+const (
+	soh = 0x01
+	stx = 0x02
+	eot = 0x04
+	ack = 0x06
+	nak = 0x15
+	can = 0x18
+	sub = 0x1A
+)
+
+// port buffers the data received from a link, so that it can be read byte by byte
+type port struct {
+	link     Link
+	buf      []byte
+	progress Progress
+}
+
+func newPort(link Link, progress Progress) *port {
+	if progress == nil {
+		progress = func(string, int64, int64) {}
+	}
+	return &port{
+		link:     link,
+		progress: progress,
+	}
+}
+
+func (p *port) readByte(timeout time.Duration) (byte, error) {
+	deadline := time.Now().Add(timeout)
+	for len(p.buf) == 0 {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return 0, ErrTimeout
+		}
+		data, err := p.link.Read(remaining)
+		if err != nil {
+			return 0, err
+		}
+		p.buf = append(p.buf, data...)
+	}
+	char := p.buf[0]
+	p.buf = p.buf[1:]
+	return char, nil
+}
+
+// Reads exactly n bytes, waiting at most timeout for each
+func (p *port) readFull(n int, timeout time.Duration) ([]byte, error) {
+	out := make([]byte, n)
+	for i := range out {
+		char, err := p.readByte(timeout)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = char
+	}
+	return out, nil
+}
+
+// Discards the data received until the line has been idle for the given time
+func (p *port) purge(idle time.Duration) error {
+	p.buf = nil
+	for {
+		if _, err := p.link.Read(idle); err == ErrTimeout {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func (p *port) write(data ...byte) error {
+	return p.link.Write(data)
+}
+
+// Tells the remote side to abort the transfer
+func (p *port) abort() {
+	_ = Cancel(p.link)
+}
+
+// Cancel tells the remote side to abort a transfer canceled locally. The same sequence works for all protocols.
+func Cancel(link Link) error {
+	return link.Write([]byte{can, can, can, can, can, can, can, can, 8, 8, 8, 8, 8, 8, 8, 8})
+}
+
+// Send sends files with the given protocol. XMODEM only supports a single file.
+func Send(link Link, protocol string, paths []string, progress Progress) error {
+	if len(paths) == 0 {
+		return fmt.Errorf("no files to send")
+	}
+	switch protocol {
+	case Xmodem, Xmodem1k:
+		if len(paths) != 1 {
+			return fmt.Errorf("XMODEM can only send one file at a time")
+		}
+		return xmodemSendFile(newPort(link, progress), paths[0], protocol == Xmodem1k)
+	case Ymodem:
+		return ymodemSend(newPort(link, progress), paths)
+	case Zmodem:
+		return zmodemSend(newPort(link, progress), paths)
+	}
+	return fmt.Errorf("unknown protocol: %s", protocol)
+}
+
+// Receive receives files with the given protocol. For XMODEM, which doesn't transfer file names, path is the file to
+// write; for the other protocols it is the directory to save the files in. It returns the files written.
+func Receive(link Link, protocol string, path string, progress Progress) ([]string, error) {
+	switch protocol {
+	case Xmodem, Xmodem1k:
+		if path == "" {
+			return nil, fmt.Errorf("XMODEM needs the name of the file to write")
+		}
+		if err := xmodemReceiveFile(newPort(link, progress), path); err != nil {
+			return nil, err
+		}
+		return []string{path}, nil
+	case Ymodem:
+		return ymodemReceive(newPort(link, progress), directory(path))
+	case Zmodem:
+		return zmodemReceive(newPort(link, progress), directory(path))
+	}
+	return nil, fmt.Errorf("unknown protocol: %s", protocol)
+}
+
+func directory(path string) string {
+	if path == "" {
+		return "."
+	}
+	return path
+}
+
+// Creates a file for a name sent by the remote side in the given directory. Directories in the name are ignored, and
+// existing files are not overwritten: a .1, .2 and so on suffix is added instead.
+func createReceivedFile(dir string, name string) (*os.File, string, error) {
+	name = filepath.Base(filepath.FromSlash(strings.ReplaceAll(name, "\\", "/")))
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return nil, "", fmt.Errorf("invalid file name")
+	}
+	path := filepath.Join(dir, name)
+	candidate := path
+	for n := 1; ; n++ {
+		file, err := os.OpenFile(candidate, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			return file, candidate, nil
+		}
+		if !os.IsExist(err) {
+			return nil, "", err
+		}
+		candidate = fmt.Sprintf("%s.%d", path, n)
+	}
+}
+
+// CRC-16/XMODEM: polynomial 0x1021, initial value 0
+func crc16(crc uint16, data []byte) uint16 {
+	for _, char := range data {
+		crc ^= uint16(char) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
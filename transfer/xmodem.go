@@ -0,0 +1,488 @@
+package transfer
+
+// XMODEM and YMODEM, as described in Chuck Forsberg's "XMODEM/YMODEM PROTOCOL REFERENCE"
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Interval between the start requests sent by a receiver
+const startInterval = 3 * time.Second
+
+// A receiver falls back to checksums if the sender doesn't react to this many CRC start requests
+const crcStartAttempts = 4
+
+// Returned by receiveBlock when a block is garbled, so that it is requested again
+var errBadBlock = errors.New("bad block")
+
+// Reads the start request of a receiver, returning whether it asked for CRCs
+func (p *port) waitStart() (crc bool, err error) {
+	deadline := time.Now().Add(startTimeout)
+	for {
+		char, err := p.readByte(time.Until(deadline))
+		if err != nil {
+			return false, err
+		}
+		switch char {
+		case 'C':
+			return true, nil
+		case nak:
+			return false, nil
+		case can:
+			if next, err := p.readByte(time.Second); err == nil && next == can {
+				return false, ErrAborted
+			}
+		}
+	}
+}
+
+// Sends a block, resending it until it is acknowledged. data must be 128 or 1024 bytes long.
+func (p *port) sendBlock(num byte, data []byte, crc bool) error {
+	packet := []byte{soh, num, ^num}
+	if len(data) == 1024 {
+		packet[0] = stx
+	}
+	packet = append(packet, data...)
+	if crc {
+		sum := crc16(0, data)
+		packet = append(packet, byte(sum>>8), byte(sum))
+	} else {
+		var sum byte
+		for _, char := range data {
+			sum += char
+		}
+		packet = append(packet, sum)
+	}
+
+	for retry := 0; retry < maxRetries; retry++ {
+		if err := p.link.Write(packet); err != nil {
+			return err
+		}
+		if acked, err := p.waitAck(); err != nil {
+			return err
+		} else if acked {
+			return nil
+		}
+	}
+	p.abort()
+	return fmt.Errorf("block %d was not acknowledged", num)
+}
+
+// Waits for the reply to a block: true for ACK, false for NAK or no reply
+func (p *port) waitAck() (bool, error) {
+	for {
+		char, err := p.readByte(replyTimeout)
+		if err == ErrTimeout {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		switch char {
+		case ack:
+			return true, nil
+		case nak:
+			return false, nil
+		case can:
+			if next, err := p.readByte(time.Second); err == nil && next == can {
+				return false, ErrAborted
+			}
+		}
+		// Anything else, such as the CRC start requests of a slow receiver, is ignored
+	}
+}
+
+// Sends EOT until it is acknowledged. YMODEM receivers reply NAK to the first one.
+func (p *port) sendEot() error {
+	for retry := 0; retry < maxRetries; retry++ {
+		if err := p.write(eot); err != nil {
+			return err
+		}
+		if acked, err := p.waitAck(); err != nil {
+			return err
+		} else if acked {
+			return nil
+		}
+	}
+	return fmt.Errorf("end of transmission was not acknowledged")
+}
+
+// Sends the content of r in blocks numbered from 1. With large blocks, the last one is sent as a 128 byte block if it
+// fits.
+func (p *port) sendData(r io.Reader, name string, size int64, blockSize int, crc bool) error {
+	num := byte(1)
+	var sent int64
+	buf := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n == 0 {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		block := buf[:blockSize]
+		if n <= 128 {
+			block = buf[:128]
+		}
+		for i := n; i < len(block); i++ {
+			block[i] = sub
+		}
+		if err := p.sendBlock(num, block, crc); err != nil {
+			return err
+		}
+		num++
+		sent += int64(n)
+		p.progress(name, sent, size)
+		if err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil && err != io.EOF {
+			p.abort()
+			return err
+		}
+	}
+	return p.sendEot()
+}
+
+func xmodemSendFile(p *port, path string, oneK bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	crc, err := p.waitStart()
+	if err != nil {
+		return err
+	}
+	blockSize := 128
+	// 1K blocks require CRCs
+	if oneK && crc {
+		blockSize = 1024
+	}
+	return p.sendData(file, filepath.Base(path), info.Size(), blockSize, crc)
+}
+
+func ymodemSend(p *port, paths []string) error {
+	for _, path := range paths {
+		if err := ymodemSendFile(p, path); err != nil {
+			return err
+		}
+	}
+	// An empty header ends the batch
+	if _, err := p.waitStart(); err != nil {
+		return err
+	}
+	return p.sendBlock(0, make([]byte, 128), true)
+}
+
+func ymodemSendFile(p *port, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	name := filepath.Base(path)
+	header := []byte(fmt.Sprintf("%s\x00%d %o %o", name, info.Size(), info.ModTime().Unix(), info.Mode().Perm()))
+	if len(header) < 128 {
+		header = append(header, make([]byte, 128-len(header))...)
+	} else if len(header) < 1024 {
+		header = append(header, make([]byte, 1024-len(header))...)
+	} else {
+		return fmt.Errorf("file name too long: %s", name)
+	}
+
+	if _, err := p.waitStart(); err != nil {
+		return err
+	}
+	if err := p.sendBlock(0, header, true); err != nil {
+		return err
+	}
+	// The receiver asks for the data after acknowledging the header
+	if _, err := p.waitStart(); err != nil {
+		return err
+	}
+	return p.sendData(file, name, info.Size(), 1024, true)
+}
+
+// Receives a block, returning its number and data, or eot set if the sender ended the transmission
+func (p *port) receiveBlock(crc bool, timeout time.Duration) (num byte, data []byte, isEot bool, err error) {
+	var size int
+	for size == 0 {
+		char, err := p.readByte(timeout)
+		if err != nil {
+			return 0, nil, false, err
+		}
+		switch char {
+		case soh:
+			size = 128
+		case stx:
+			size = 1024
+		case eot:
+			return 0, nil, true, nil
+		case can:
+			if next, err := p.readByte(time.Second); err == nil && next == can {
+				return 0, nil, false, ErrAborted
+			}
+		}
+		// Line noise before the header is skipped
+	}
+
+	trailer := 1
+	if crc {
+		trailer = 2
+	}
+	packet, err := p.readFull(2+size+trailer, time.Second)
+	if err == ErrTimeout {
+		return 0, nil, false, errBadBlock
+	} else if err != nil {
+		return 0, nil, false, err
+	}
+	if packet[0] != ^packet[1] {
+		return 0, nil, false, errBadBlock
+	}
+	data = packet[2 : 2+size]
+	if crc {
+		if crc16(0, data) != uint16(packet[2+size])<<8|uint16(packet[3+size]) {
+			return 0, nil, false, errBadBlock
+		}
+	} else {
+		var sum byte
+		for _, char := range data {
+			sum += char
+		}
+		if sum != packet[2+size] {
+			return 0, nil, false, errBadBlock
+		}
+	}
+	return packet[0], data, false, nil
+}
+
+// Receives the data blocks of a file until EOT and writes them to w. If size is -1, as with XMODEM, the padding is
+// removed from the last block; otherwise the data is truncated to size.
+func (p *port) receiveData(w io.Writer, name string, size int64, crc bool, ymodem bool) error {
+	expected := byte(1)
+	var written int64
+	// Without a size, the last block is held back until EOT to remove its padding
+	var held []byte
+	started := false
+	garbled := false
+	startAttempts := 0
+	eots := 0
+	retries := 0
+
+	request := func() error {
+		// A garbled first block means that the sender started, it is rejected like the others
+		if started || garbled {
+			return p.write(nak)
+		}
+		startAttempts++
+		if !ymodem && crc && startAttempts > crcStartAttempts {
+			crc = false
+		}
+		if crc {
+			return p.write('C')
+		}
+		return p.write(nak)
+	}
+	if err := request(); err != nil {
+		return err
+	}
+
+	for {
+		timeout := replyTimeout
+		if !started {
+			timeout = startInterval
+		}
+		num, data, isEot, err := p.receiveBlock(crc, timeout)
+		garbled = err == errBadBlock
+		if err == ErrTimeout || err == errBadBlock {
+			if !started && err == ErrTimeout && time.Duration(startAttempts)*startInterval >= startTimeout {
+				p.abort()
+				return fmt.Errorf("the sender did not start")
+			}
+			retries++
+			if started && retries > maxRetries {
+				p.abort()
+				return fmt.Errorf("too many errors")
+			}
+			if err := p.purge(100 * time.Millisecond); err != nil {
+				return err
+			}
+			if err := request(); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			if err != ErrAborted {
+				p.abort()
+			}
+			return err
+		}
+		retries = 0
+
+		if isEot {
+			// YMODEM senders expect the first EOT to be rejected, which also guards against a garbled one
+			eots++
+			if ymodem && eots == 1 {
+				if err := p.write(nak); err != nil {
+					return err
+				}
+				continue
+			}
+			if held != nil {
+				if _, err := w.Write(bytes.TrimRight(held, string([]byte{sub}))); err != nil {
+					p.abort()
+					return err
+				}
+			}
+			return p.write(ack)
+		}
+		if num == expected-1 {
+			// Our acknowledgement got lost, the sender repeated the block; for the first block, that's the YMODEM
+			// header and the sender waits for the data to be requested again
+			if err := p.write(ack); err != nil {
+				return err
+			}
+			if !started {
+				if err := request(); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		started = true
+		if num != expected {
+			p.abort()
+			return fmt.Errorf("expected block %d, received %d", expected, num)
+		}
+
+		if size < 0 {
+			if held != nil {
+				if _, err := w.Write(held); err != nil {
+					p.abort()
+					return err
+				}
+			}
+			held = append(held[:0], data...)
+		} else {
+			if remaining := size - written; int64(len(data)) > remaining {
+				data = data[:remaining]
+			}
+			if _, err := w.Write(data); err != nil {
+				p.abort()
+				return err
+			}
+		}
+		written += int64(len(data))
+		expected++
+		p.progress(name, written, size)
+		if err := p.write(ack); err != nil {
+			return err
+		}
+	}
+}
+
+func xmodemReceiveFile(p *port, path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	err = p.receiveData(file, filepath.Base(path), -1, true, false)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Receives the header of the next file: its name, or an empty name at the end of the batch, and its size, or -1
+func (p *port) ymodemReceiveHeader() (name string, size int64, err error) {
+	request := byte('C')
+	for attempt := 0; ; attempt++ {
+		if time.Duration(attempt)*startInterval >= startTimeout {
+			p.abort()
+			return "", 0, fmt.Errorf("the sender did not start")
+		}
+		if err := p.write(request); err != nil {
+			return "", 0, err
+		}
+		num, data, isEot, err := p.receiveBlock(true, startInterval)
+		request = 'C'
+		if err == errBadBlock {
+			if err := p.purge(100 * time.Millisecond); err != nil {
+				return "", 0, err
+			}
+			request = nak
+			continue
+		}
+		if err == ErrTimeout || (err == nil && (isEot || num != 0)) {
+			// EOT or a data block are repeated from the previous file, since the last ACK was lost
+			if err == nil {
+				if err := p.write(ack); err != nil {
+					return "", 0, err
+				}
+			}
+			continue
+		} else if err != nil {
+			return "", 0, err
+		}
+		if err := p.write(ack); err != nil {
+			return "", 0, err
+		}
+
+		end := bytes.IndexByte(data, 0)
+		if end <= 0 {
+			return "", -1, nil
+		}
+		name = string(data[:end])
+		size = -1
+		if fields := strings.Fields(string(bytes.TrimRight(data[end+1:], "\x00"))); len(fields) > 0 {
+			if parsed, err := strconv.ParseInt(fields[0], 10, 64); err == nil {
+				size = parsed
+			}
+		}
+		return name, size, nil
+	}
+}
+
+func ymodemReceive(p *port, dir string) ([]string, error) {
+	var received []string
+	for {
+		name, size, err := p.ymodemReceiveHeader()
+		if err != nil {
+			return received, err
+		}
+		if name == "" {
+			return received, nil
+		}
+		file, path, err := createReceivedFile(dir, name)
+		if err != nil {
+			p.abort()
+			return received, err
+		}
+		err = p.receiveData(file, name, size, true, true)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return received, err
+		}
+		received = append(received, path)
+	}
+}
@@ -0,0 +1,769 @@
+package transfer
+
+// ZMODEM, as described in Chuck Forsberg's "The ZMODEM Inter Application File Transfer Protocol". Only what is
+// needed to interoperate with lrzsz is implemented: no compression, encryption, commands or crash recovery.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	zpad  = '*'
+	zdle  = 0x18
+	zbin  = 'A'
+	zhex  = 'B'
+	zbin3 = 'C'
+)
+
+// Frame types
+const (
+	zrqinit    = 0
+	zrinit     = 1
+	zsinit     = 2
+	zack       = 3
+	zfile      = 4
+	zskip      = 5
+	znak       = 6
+	zabort     = 7
+	zfin       = 8
+	zrpos      = 9
+	zdata      = 10
+	zeof       = 11
+	zferr      = 12
+	zchallenge = 14
+	zcan       = 16
+)
+
+// Data subpacket ends
+const (
+	// End of frame, header follows
+	zcrce = 'h'
+	// Frame continues nonstop
+	zcrcg = 'i'
+	// Frame continues, ZACK expected
+	zcrcq = 'j'
+	// End of frame, ZACK expected
+	zcrcw = 'k'
+	// Escaped 0x7f and 0xff
+	zrub0 = 'l'
+	zrub1 = 'm'
+)
+
+// ZRINIT capabilities, in ZF0
+const (
+	canfdx  = 0x01
+	canovio = 0x02
+	canfc32 = 0x20
+)
+
+// ZF0 of ZFILE: binary transfer
+const zcbin = 1
+
+// Header fields: ZF0 is the last byte, positions are little endian
+const (
+	zf0 = 3
+)
+
+const zmodemSubpacketSize = 1024
+const zmodemMaxSubpacket = 8192
+
+var errBadHeader = errors.New("bad header")
+
+type zheader struct {
+	typ  byte
+	data [4]byte
+	// Whether the data subpackets following it have 32 bit CRCs
+	crc32 bool
+}
+
+func (h *zheader) pos() int64 {
+	return int64(binary.LittleEndian.Uint32(h.data[:]))
+}
+
+func posData(pos int64) (data [4]byte) {
+	binary.LittleEndian.PutUint32(data[:], uint32(pos))
+	return
+}
+
+func (p *port) unread(char byte) {
+	p.buf = append([]byte{char}, p.buf...)
+}
+
+func zdleEscape(out []byte, char byte) []byte {
+	switch char {
+	case zdle, 0x10, 0x90, 0x11, 0x91, 0x13, 0x93:
+		return append(out, zdle, char^0x40)
+	}
+	return append(out, char)
+}
+
+func (p *port) sendHexHeader(typ byte, data [4]byte) error {
+	header := append([]byte{typ}, data[:]...)
+	crc := crc16(0, header)
+	out := []byte(fmt.Sprintf("%c%c%c%c%x%04x\r\x8a", zpad, zpad, zdle, zhex, header, crc))
+	if typ != zfin && typ != zack {
+		out = append(out, 0x11)
+	}
+	return p.link.Write(out)
+}
+
+func (p *port) sendBinaryHeader(typ byte, data [4]byte, useCrc32 bool) error {
+	header := append([]byte{typ}, data[:]...)
+	out := []byte{zpad, zdle, zbin}
+	if useCrc32 {
+		out[2] = zbin3
+		var crc [4]byte
+		binary.LittleEndian.PutUint32(crc[:], crc32.ChecksumIEEE(header))
+		header = append(header, crc[:]...)
+	} else {
+		crc := crc16(0, header)
+		header = append(header, byte(crc>>8), byte(crc))
+	}
+	for _, char := range header {
+		out = zdleEscape(out, char)
+	}
+	return p.link.Write(out)
+}
+
+func (p *port) sendSubpacket(data []byte, end byte, useCrc32 bool) error {
+	out := make([]byte, 0, len(data)+len(data)/8+16)
+	for _, char := range data {
+		out = zdleEscape(out, char)
+	}
+	out = append(out, zdle, end)
+	checked := append(append([]byte{}, data...), end)
+	if useCrc32 {
+		var crc [4]byte
+		binary.LittleEndian.PutUint32(crc[:], crc32.ChecksumIEEE(checked))
+		for _, char := range crc {
+			out = zdleEscape(out, char)
+		}
+	} else {
+		crc := crc16(0, checked)
+		out = zdleEscape(zdleEscape(out, byte(crc>>8)), byte(crc))
+	}
+	if end == zcrcw {
+		out = append(out, 0x11)
+	}
+	return p.link.Write(out)
+}
+
+// Reads a ZDLE escaped byte; end is set if it marks the end of a data subpacket
+func (p *port) readEscaped(timeout time.Duration) (char byte, end bool, err error) {
+	for {
+		char, err := p.readByte(timeout)
+		if err != nil {
+			return 0, false, err
+		}
+		switch char {
+		case 0x11, 0x13, 0x91, 0x93:
+			// Flow control characters are not data
+			continue
+		case zdle:
+		default:
+			return char, false, nil
+		}
+
+		cans := 1
+		for {
+			if char, err = p.readByte(timeout); err != nil {
+				return 0, false, err
+			}
+			if char != zdle {
+				break
+			}
+			// Five CANs abort the transfer
+			if cans++; cans == 5 {
+				return 0, false, ErrAborted
+			}
+		}
+		switch {
+		case char == zcrce || char == zcrcg || char == zcrcq || char == zcrcw:
+			return char, true, nil
+		case char == zrub0:
+			return 0x7f, false, nil
+		case char == zrub1:
+			return 0xff, false, nil
+		case char&0x60 == 0x40:
+			return char ^ 0x40, false, nil
+		}
+		return 0, false, errBadHeader
+	}
+}
+
+func hexValue(char byte) (byte, bool) {
+	switch {
+	case char >= '0' && char <= '9':
+		return char - '0', true
+	case char >= 'a' && char <= 'f':
+		return char - 'a' + 10, true
+	}
+	return 0, false
+}
+
+// Waits for a header, skipping anything else
+func (p *port) readHeader(timeout time.Duration) (*zheader, error) {
+	deadline := time.Now().Add(timeout)
+	cans := 0
+	for {
+		char, err := p.readByte(time.Until(deadline))
+		if err != nil {
+			return nil, err
+		}
+		if char == can {
+			if cans++; cans >= 5 {
+				return nil, ErrAborted
+			}
+			continue
+		}
+		cans = 0
+		if char != zpad {
+			continue
+		}
+		for char == zpad {
+			if char, err = p.readByte(time.Second); err != nil {
+				return nil, err
+			}
+		}
+		if char != zdle {
+			continue
+		}
+		if char, err = p.readByte(time.Second); err != nil {
+			return nil, err
+		}
+		switch char {
+		case zhex:
+			return p.readHexHeader()
+		case zbin, zbin3:
+			return p.readBinaryHeader(char == zbin3)
+		}
+	}
+}
+
+func (p *port) readHexHeader() (*zheader, error) {
+	var raw [7]byte
+	for i := range raw {
+		digits, err := p.readFull(2, time.Second)
+		if err != nil {
+			return nil, err
+		}
+		high, ok1 := hexValue(digits[0] & 0x7f)
+		low, ok2 := hexValue(digits[1] & 0x7f)
+		if !ok1 || !ok2 {
+			return nil, errBadHeader
+		}
+		raw[i] = high<<4 | low
+	}
+	if crc16(0, raw[:5]) != uint16(raw[5])<<8|uint16(raw[6]) {
+		return nil, errBadHeader
+	}
+	// Skip the CR LF that follow, so that a data subpacket can be read next
+	if char, err := p.readByte(100 * time.Millisecond); err == nil {
+		if char&0x7f == '\r' {
+			if char, err = p.readByte(100 * time.Millisecond); err == nil && char&0x7f != '\n' {
+				p.unread(char)
+			}
+		} else {
+			p.unread(char)
+		}
+	}
+	h := &zheader{typ: raw[0]}
+	copy(h.data[:], raw[1:5])
+	return h, nil
+}
+
+func (p *port) readBinaryHeader(useCrc32 bool) (*zheader, error) {
+	length := 7
+	if useCrc32 {
+		length = 9
+	}
+	raw := make([]byte, length)
+	for i := range raw {
+		char, end, err := p.readEscaped(time.Second)
+		if err == ErrTimeout {
+			return nil, errBadHeader
+		} else if err != nil {
+			return nil, err
+		}
+		if end {
+			return nil, errBadHeader
+		}
+		raw[i] = char
+	}
+	if useCrc32 {
+		if crc32.ChecksumIEEE(raw[:5]) != binary.LittleEndian.Uint32(raw[5:]) {
+			return nil, errBadHeader
+		}
+	} else if crc16(0, raw[:5]) != uint16(raw[5])<<8|uint16(raw[6]) {
+		return nil, errBadHeader
+	}
+	h := &zheader{typ: raw[0], crc32: useCrc32}
+	copy(h.data[:], raw[1:5])
+	return h, nil
+}
+
+// Reads a data subpacket, returning its data and how it ended
+func (p *port) readSubpacket(useCrc32 bool) (data []byte, end byte, err error) {
+	for {
+		char, isEnd, err := p.readEscaped(time.Second)
+		if err == ErrTimeout {
+			return nil, 0, errBadHeader
+		} else if err != nil {
+			return nil, 0, err
+		}
+		if isEnd {
+			end = char
+			break
+		}
+		if len(data) >= zmodemMaxSubpacket {
+			return nil, 0, errBadHeader
+		}
+		data = append(data, char)
+	}
+
+	length := 2
+	if useCrc32 {
+		length = 4
+	}
+	crc := make([]byte, length)
+	for i := range crc {
+		char, isEnd, err := p.readEscaped(time.Second)
+		if err == ErrTimeout || isEnd {
+			return nil, 0, errBadHeader
+		} else if err != nil {
+			return nil, 0, err
+		}
+		crc[i] = char
+	}
+	checked := append(append([]byte{}, data...), end)
+	if useCrc32 {
+		if crc32.ChecksumIEEE(checked) != binary.LittleEndian.Uint32(crc) {
+			return nil, 0, errBadHeader
+		}
+	} else if crc16(0, checked) != uint16(crc[0])<<8|uint16(crc[1]) {
+		return nil, 0, errBadHeader
+	}
+	return data, end, nil
+}
+
+func zmodemSend(p *port, paths []string) error {
+	// Start the receiver, in case the remote side is a shell
+	if err := p.link.Write([]byte("rz\r")); err != nil {
+		return err
+	}
+	if err := p.sendHexHeader(zrqinit, [4]byte{}); err != nil {
+		return err
+	}
+
+	var useCrc32 bool
+	deadline := time.Now().Add(startTimeout)
+WaitReceiver:
+	for {
+		h, err := p.readHeader(replyTimeout)
+		switch {
+		case err == ErrTimeout || err == errBadHeader:
+			if time.Now().After(deadline) {
+				p.abort()
+				return fmt.Errorf("the receiver did not start")
+			}
+			if err := p.sendHexHeader(zrqinit, [4]byte{}); err != nil {
+				return err
+			}
+			continue
+		case err != nil:
+			return err
+		}
+		switch h.typ {
+		case zrinit:
+			useCrc32 = h.data[zf0]&canfc32 != 0
+			break WaitReceiver
+		case zchallenge:
+			if err := p.sendHexHeader(zack, h.data); err != nil {
+				return err
+			}
+		case zcan, zabort:
+			return ErrAborted
+		}
+		// Anything else, i.e. our own ZRQINIT echoed by the remote shell, is ignored
+	}
+
+	var totalSize int64
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			totalSize += info.Size()
+		}
+	}
+	for i, path := range paths {
+		sent, err := zmodemSendFile(p, path, useCrc32, len(paths)-i, totalSize)
+		if err != nil {
+			return err
+		}
+		totalSize -= sent
+	}
+
+	for retry := 0; retry < maxRetries; retry++ {
+		if err := p.sendHexHeader(zfin, [4]byte{}); err != nil {
+			return err
+		}
+		h, err := p.readHeader(replyTimeout)
+		if err == ErrTimeout || err == errBadHeader {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if h.typ == zfin {
+			// Over and out
+			return p.link.Write([]byte("OO"))
+		}
+	}
+	return fmt.Errorf("the receiver did not finish the session")
+}
+
+// Sends a file, returning its size. Files skipped by the receiver are not an error.
+func zmodemSendFile(p *port, path string, useCrc32 bool, filesLeft int, bytesLeft int64) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		p.abort()
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		p.abort()
+		return 0, err
+	}
+	name := filepath.Base(path)
+	size := info.Size()
+	fileInfo := []byte(fmt.Sprintf("%s\x00%d %o %o 0 %d %d\x00", name, size, info.ModTime().Unix(),
+		info.Mode().Perm(), filesLeft, bytesLeft))
+
+	var pos int64
+	retries := 0
+Offer:
+	for {
+		if retries++; retries > maxRetries {
+			p.abort()
+			return 0, fmt.Errorf("the receiver did not accept %s", name)
+		}
+		if err := p.sendBinaryHeader(zfile, [4]byte{zf0: zcbin}, useCrc32); err != nil {
+			return 0, err
+		}
+		if err := p.sendSubpacket(fileInfo, zcrcw, useCrc32); err != nil {
+			return 0, err
+		}
+		for {
+			h, err := p.readHeader(replyTimeout)
+			if err == ErrTimeout || err == errBadHeader {
+				continue Offer
+			} else if err != nil {
+				return 0, err
+			}
+			switch h.typ {
+			case zrpos:
+				pos = h.pos()
+				break Offer
+			case zskip:
+				return size, nil
+			case zrinit, znak:
+				continue Offer
+			case zcan, zabort, zferr:
+				return 0, ErrAborted
+			}
+		}
+	}
+
+	buf := make([]byte, zmodemSubpacketSize)
+	retries = 0
+	// Errors are only counted while the transfer doesn't progress
+	reached := pos
+	for {
+		if pos > reached {
+			reached = pos
+			retries = 0
+		}
+		if retries++; retries > maxRetries {
+			p.abort()
+			return 0, fmt.Errorf("too many errors sending %s", name)
+		}
+		h, err := zmodemSendData(p, file, buf, name, pos, size, useCrc32)
+		if err != nil {
+			return 0, err
+		}
+		if h == nil {
+			// Sent until the end, wait for the receiver to confirm it
+			if err := p.sendBinaryHeader(zeof, posData(size), useCrc32); err != nil {
+				return 0, err
+			}
+			if h, err = p.readHeader(replyTimeout); err == ErrTimeout || err == errBadHeader {
+				pos = size
+				continue
+			} else if err != nil {
+				return 0, err
+			}
+		}
+		switch h.typ {
+		case zrinit:
+			return size, nil
+		case zrpos:
+			pos = h.pos()
+		case zskip:
+			return size, nil
+		case zcan, zabort, zferr:
+			return 0, ErrAborted
+		}
+		// ZACK and anything else: resend from the current position, or just ZEOF if all was sent
+	}
+}
+
+// Streams the file from pos. If the receiver interrupts with a header, i.e. to ask for a retransmission, the header
+// is returned.
+func zmodemSendData(p *port, file *os.File, buf []byte, name string, pos int64, size int64, useCrc32 bool) (*zheader, error) {
+	if pos >= size {
+		return nil, nil
+	}
+	if _, err := file.Seek(pos, io.SeekStart); err != nil {
+		p.abort()
+		return nil, err
+	}
+	if err := p.sendBinaryHeader(zdata, posData(pos), useCrc32); err != nil {
+		return nil, err
+	}
+	for {
+		n, err := io.ReadFull(file, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			p.abort()
+			return nil, err
+		}
+		end := byte(zcrcg)
+		if pos+int64(n) >= size {
+			end = zcrce
+		}
+		if err := p.sendSubpacket(buf[:n], end, useCrc32); err != nil {
+			return nil, err
+		}
+		pos += int64(n)
+		p.progress(name, pos, size)
+		if end == zcrce {
+			return nil, nil
+		}
+
+		// Check for interruptions without waiting
+		data, err := p.link.Read(0)
+		if err != nil && err != ErrTimeout {
+			return nil, err
+		}
+		p.buf = append(p.buf, data...)
+		if bytes.IndexByte(p.buf, zpad) >= 0 || bytes.IndexByte(p.buf, can) >= 0 {
+			// End the frame, so that the receiver reads the header we reply with
+			if err := p.sendSubpacket(nil, zcrce, useCrc32); err != nil {
+				return nil, err
+			}
+			h, err := p.readHeader(replyTimeout)
+			if err == ErrTimeout || err == errBadHeader {
+				return &zheader{typ: zrpos, data: posData(pos)}, nil
+			}
+			return h, err
+		}
+	}
+}
+
+func zmodemReceive(p *port, dir string) ([]string, error) {
+	var received []string
+	sendInit := func() error {
+		return p.sendHexHeader(zrinit, [4]byte{zf0: canfdx | canovio | canfc32})
+	}
+	if err := sendInit(); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(startTimeout)
+	retries := 0
+	for {
+		h, err := p.readHeader(replyTimeout)
+		if err == ErrTimeout || err == errBadHeader {
+			if retries++; retries > maxRetries || (len(received) == 0 && time.Now().After(deadline)) {
+				p.abort()
+				return received, fmt.Errorf("the sender did not start")
+			}
+			if err := sendInit(); err != nil {
+				return received, err
+			}
+			continue
+		} else if err != nil {
+			return received, err
+		}
+		retries = 0
+
+		switch h.typ {
+		case zsinit:
+			// The attention string is not needed over a ttyd session
+			if _, _, err := p.readSubpacket(h.crc32); err != nil {
+				if err := p.sendHexHeader(znak, [4]byte{}); err != nil {
+					return received, err
+				}
+				continue
+			}
+			if err := p.sendHexHeader(zack, [4]byte{}); err != nil {
+				return received, err
+			}
+		case zfile:
+			info, _, err := p.readSubpacket(h.crc32)
+			if err == errBadHeader {
+				if err := p.sendHexHeader(znak, [4]byte{}); err != nil {
+					return received, err
+				}
+				continue
+			} else if err != nil {
+				return received, err
+			}
+			path, err := zmodemReceiveFile(p, dir, info)
+			if err != nil {
+				return received, err
+			}
+			received = append(received, path)
+			if err := sendInit(); err != nil {
+				return received, err
+			}
+		case zfin:
+			if err := p.sendHexHeader(zfin, [4]byte{}); err != nil {
+				return received, err
+			}
+			// Over and out, if it arrives
+			_, _ = p.readFull(2, time.Second)
+			return received, nil
+		case zcan, zabort:
+			return received, ErrAborted
+		default:
+			if err := sendInit(); err != nil {
+				return received, err
+			}
+		}
+	}
+}
+
+func zmodemReceiveFile(p *port, dir string, info []byte) (string, error) {
+	end := bytes.IndexByte(info, 0)
+	if end <= 0 {
+		p.abort()
+		return "", fmt.Errorf("invalid file information")
+	}
+	name := string(info[:end])
+	size := int64(-1)
+	if fields := strings.Fields(string(bytes.TrimRight(info[end+1:], "\x00"))); len(fields) > 0 {
+		if parsed, err := strconv.ParseInt(fields[0], 10, 64); err == nil {
+			size = parsed
+		}
+	}
+	file, path, err := createReceivedFile(dir, name)
+	if err != nil {
+		p.abort()
+		return "", err
+	}
+	defer file.Close()
+
+	var pos int64
+	if err := p.sendHexHeader(zrpos, posData(pos)); err != nil {
+		return "", err
+	}
+	retries := 0
+	for {
+		h, err := p.readHeader(replyTimeout)
+		if err == ErrTimeout || err == errBadHeader {
+			if retries++; retries > maxRetries {
+				p.abort()
+				return "", fmt.Errorf("too many errors receiving %s", name)
+			}
+			if err := p.sendHexHeader(zrpos, posData(pos)); err != nil {
+				return "", err
+			}
+			continue
+		} else if err != nil {
+			return "", err
+		}
+
+		switch h.typ {
+		case zdata:
+			if h.pos() != pos {
+				if err := p.purge(100 * time.Millisecond); err != nil {
+					return "", err
+				}
+				if err := p.sendHexHeader(zrpos, posData(pos)); err != nil {
+					return "", err
+				}
+				continue
+			}
+			start := pos
+			if err := zmodemReceiveData(p, file, name, &pos, size, h.crc32); err == errBadHeader {
+				// Errors are only counted while the transfer doesn't progress
+				if pos > start {
+					retries = 0
+				}
+				if retries++; retries > maxRetries {
+					p.abort()
+					return "", fmt.Errorf("too many errors receiving %s", name)
+				}
+				if err := p.purge(100 * time.Millisecond); err != nil {
+					return "", err
+				}
+				if err := p.sendHexHeader(zrpos, posData(pos)); err != nil {
+					return "", err
+				}
+			} else if err != nil {
+				return "", err
+			} else {
+				retries = 0
+			}
+		case zeof:
+			// A ZEOF for a different position was sent before our last ZRPOS was received
+			if h.pos() == pos {
+				return path, file.Close()
+			}
+		case zfile:
+			// Our ZRPOS was lost
+			if _, _, err := p.readSubpacket(h.crc32); err != nil && err != errBadHeader {
+				return "", err
+			}
+			if err := p.sendHexHeader(zrpos, posData(pos)); err != nil {
+				return "", err
+			}
+		case zcan, zabort, zfin:
+			return "", ErrAborted
+		}
+	}
+}
+
+// Receives the data subpackets of a ZDATA frame
+func zmodemReceiveData(p *port, w io.Writer, name string, pos *int64, size int64, useCrc32 bool) error {
+	for {
+		data, end, err := p.readSubpacket(useCrc32)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			p.abort()
+			return err
+		}
+		*pos += int64(len(data))
+		p.progress(name, *pos, size)
+		switch end {
+		case zcrcw:
+			return p.sendHexHeader(zack, posData(*pos))
+		case zcrcq:
+			if err := p.sendHexHeader(zack, posData(*pos)); err != nil {
+				return err
+			}
+		case zcrce:
+			return nil
+		}
+	}
+}
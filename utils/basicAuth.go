@@ -0,0 +1,32 @@
+package utils
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// RequireBasicAuth wraps a handler so that it is only served to clients providing the given credentials.
+// If credentials is nil the handler is returned unchanged.
+func RequireBasicAuth(handler http.Handler, credentials *url.Userinfo, realm string) http.Handler {
+	if credentials == nil {
+		return handler
+	}
+	expectedUser := []byte(credentials.Username())
+	password, _ := credentials.Password()
+	expectedPass := []byte(password)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		// Evaluate both comparisons to avoid leaking which one failed through timing
+		userOk := subtle.ConstantTimeCompare([]byte(user), expectedUser)
+		passOk := subtle.ConstantTimeCompare([]byte(pass), expectedPass)
+		if !ok || userOk&passOk != 1 {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, realm))
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -36,24 +36,3 @@ func CopyReaderToChan(closeChan <-chan interface{}, fd io.Reader, outChan chan<-
 		outChan <- buf[0:bRead]
 	}
 }
-
-func CopyChanToWriter(closeChan <-chan interface{}, inChan <-chan []byte, fd io.Writer, errChan chan<- error) {
-	for {
-		//println("SELECT CopyChanToWriter")
-		select {
-		case <-closeChan:
-			return
-		case buf := <-inChan:
-			written := 0
-			for written < len(buf) {
-				bWritten, err := fd.Write(buf[written:])
-				if err != nil {
-					errChan <- err
-					return
-				}
-				written += bWritten
-			}
-		}
-		//println("SELECTED CopyChanToWriter")
-	}
-}
@@ -0,0 +1,39 @@
+// +build !windows
+
+package utils
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// MkdirPrivate creates dir if it doesn't exist and checks that only the current user can access it, so that other
+// users can't take it over by creating it, or a symbolic link with its name, first
+func MkdirPrivate(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("%s is a symbolic link", dir)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); !ok || int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("%s is not owned by the current user", dir)
+	}
+	if info.Mode().Perm() != 0700 {
+		return fmt.Errorf("%s is accessible by other users, its mode must be 0700", dir)
+	}
+	return nil
+}
+
+// withPrivateUmask runs fn with a umask that keeps the files it creates accessible only by the current user. The umask
+// is per process, other goroutines creating files in the meantime get the same restriction.
+func withPrivateUmask(fn func() error) error {
+	oldMask := syscall.Umask(0077)
+	defer syscall.Umask(oldMask)
+	return fn()
+}
@@ -0,0 +1,13 @@
+package utils
+
+import "os"
+
+// MkdirPrivate creates dir if it doesn't exist. Directories get the permissions of their parent on Windows.
+func MkdirPrivate(dir string) error {
+	return os.MkdirAll(dir, 0700)
+}
+
+// withPrivateUmask just runs fn, there is no umask on Windows.
+func withPrivateUmask(fn func() error) error {
+	return fn()
+}
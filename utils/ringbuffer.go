@@ -0,0 +1,53 @@
+package utils
+
+// RingBuffer keeps the last Size bytes written to it. It is not safe for concurrent use.
+type RingBuffer struct {
+	buf   []byte
+	start int
+	full  bool
+}
+
+func NewRingBuffer(size int) *RingBuffer {
+	return &RingBuffer{
+		buf: make([]byte, 0, size),
+	}
+}
+
+func (r *RingBuffer) Size() int {
+	return cap(r.buf)
+}
+
+func (r *RingBuffer) Write(data []byte) (int, error) {
+	written := len(data)
+	size := cap(r.buf)
+	if size == 0 {
+		return written, nil
+	}
+	if len(data) >= size {
+		data = data[len(data)-size:]
+	}
+	if !r.full {
+		free := size - len(r.buf)
+		if len(data) <= free {
+			r.buf = append(r.buf, data...)
+			r.full = len(r.buf) == size
+			return written, nil
+		}
+		r.buf = append(r.buf, data[:free]...)
+		data = data[free:]
+		r.full = true
+	}
+	for len(data) > 0 {
+		n := copy(r.buf[r.start:], data)
+		data = data[n:]
+		r.start = (r.start + n) % size
+	}
+	return written, nil
+}
+
+// Bytes returns a copy of the buffer contents, oldest byte first
+func (r *RingBuffer) Bytes() []byte {
+	out := make([]byte, 0, len(r.buf))
+	out = append(out, r.buf[r.start:]...)
+	return append(out, r.buf[:r.start]...)
+}
@@ -0,0 +1,84 @@
+package utils
+
+// Minimal implementation of the systemd notification protocol, see sd_notify(3)
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SdNotifyReady     = "READY=1"
+	SdNotifyReloading = "RELOADING=1"
+	SdNotifyStopping  = "STOPPING=1"
+	SdNotifyWatchdog  = "WATCHDOG=1"
+)
+
+// SdNotify sends a state string to the service manager. It does nothing and returns false if the process was not
+// started by systemd with NOTIFY_SOCKET set.
+func SdNotify(state string) (bool, error) {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return false, nil
+	}
+	// Go maps the leading '@' to the Linux abstract namespace on its own
+	addr := &net.UnixAddr{Name: socketPath, Net: "unixgram"}
+	conn, err := net.DialUnix(addr.Net, nil, addr)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SdNotifyStatus sends a free-form status string that is shown by "systemctl status"
+func SdNotifyStatus(status string) (bool, error) {
+	return SdNotify("STATUS=" + status)
+}
+
+// SdWatchdogEnabled returns the watchdog interval requested by the service manager, or 0 if watchdog keepalives
+// are not expected from this process.
+func SdWatchdogEnabled() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pidStr := os.Getenv("WATCHDOG_PID"); pidStr != "" {
+		pid, err := strconv.Atoi(pidStr)
+		if err != nil || pid != os.Getpid() {
+			return 0
+		}
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// IsJournalStream returns true if the standard output or error is connected to the systemd journal. JOURNAL_STREAM
+// is inherited by child processes, so it's only trusted if it matches the device and inode of the file descriptor,
+// as described in sd-daemon(3).
+func IsJournalStream() bool {
+	parts := strings.SplitN(os.Getenv("JOURNAL_STREAM"), ":", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	dev, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return false
+	}
+	ino, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return false
+	}
+	for _, file := range []*os.File{os.Stdout, os.Stderr} {
+		if fileDev, fileIno, ok := fileDevIno(file); ok && fileDev == dev && fileIno == ino {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,21 @@
+// +build !windows
+
+package utils
+
+import (
+	"os"
+	"syscall"
+)
+
+// Returns the device and inode numbers of file
+func fileDevIno(file *os.File) (dev uint64, ino uint64, ok bool) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, 0, false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return uint64(stat.Dev), uint64(stat.Ino), true
+}
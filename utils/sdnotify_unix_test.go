@@ -0,0 +1,83 @@
+// +build !windows
+
+package utils
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Binds a notification socket like the one systemd provides and points NOTIFY_SOCKET to it
+func listenNotifySocket(t *testing.T) *net.UnixConn {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "sdnotify")
+	if err != nil {
+		t.Fatalf("unable to create a directory: %v", err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	socketPath := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("unable to bind the socket: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	setNotifySocket(t, socketPath)
+	return conn
+}
+
+// Sets NOTIFY_SOCKET until the end of the test, unsetting it if socketPath is empty
+func setNotifySocket(t *testing.T, socketPath string) {
+	oldSocket, wasSet := os.LookupEnv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		_ = os.Unsetenv("NOTIFY_SOCKET")
+	} else {
+		_ = os.Setenv("NOTIFY_SOCKET", socketPath)
+	}
+	t.Cleanup(func() {
+		if wasSet {
+			_ = os.Setenv("NOTIFY_SOCKET", oldSocket)
+		} else {
+			_ = os.Unsetenv("NOTIFY_SOCKET")
+		}
+	})
+}
+
+func TestSdNotify(t *testing.T) {
+	conn := listenNotifySocket(t)
+	buf := make([]byte, 256)
+	for _, state := range []string{SdNotifyReady, SdNotifyReloading, SdNotifyStopping, SdNotifyWatchdog} {
+		sent, err := SdNotify(state)
+		if !sent || err != nil {
+			t.Fatalf("%s not sent: %v", state, err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("unable to receive %s: %v", state, err)
+		}
+		if received := string(buf[:n]); received != state {
+			t.Fatalf("expected %s, received %q", state, received)
+		}
+	}
+
+	if _, err := SdNotifyStatus("Connected"); err != nil {
+		t.Fatalf("status not sent: %v", err)
+	}
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "STATUS=Connected" {
+		t.Fatalf("unexpected status %q: %v", buf[:n], err)
+	}
+}
+
+func TestSdNotifyWithoutSocket(t *testing.T) {
+	setNotifySocket(t, "")
+	if sent, err := SdNotify(SdNotifyReady); sent || err != nil {
+		t.Fatalf("expected nothing to be sent without NOTIFY_SOCKET, got %v, %v", sent, err)
+	}
+}
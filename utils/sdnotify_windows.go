@@ -0,0 +1,8 @@
+package utils
+
+import "os"
+
+// There's no journal on Windows
+func fileDevIno(_ *os.File) (dev uint64, ino uint64, ok bool) {
+	return 0, 0, false
+}
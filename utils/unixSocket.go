@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// UseUnixSocket makes all HTTP and WebSocket connections that use the default transport go to the given Unix socket,
+// regardless of the host in the URL.
+func UseUnixSocket(socketPath string) {
+	transport := http.DefaultTransport.(*http.Transport)
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		dialer := net.Dialer{}
+		return dialer.DialContext(ctx, "unix", socketPath)
+	}
+}
+
+// ListenUnixSocket listens on the given path, replacing stale sockets left behind by processes that crashed. Anything
+// else already at that path is left alone. The socket is created only accessible by the current user.
+func ListenUnixSocket(socketPath string) (net.Listener, error) {
+	if info, err := os.Lstat(socketPath); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s already exists and is not a socket", socketPath)
+		}
+		if conn, err := net.DialTimeout("unix", socketPath, time.Second); err == nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("socket %s is already in use", socketPath)
+		}
+		_ = os.Remove(socketPath)
+	}
+	var listener net.Listener
+	err := withPrivateUmask(func() (err error) {
+		listener, err = net.Listen("unix", socketPath)
+		return err
+	})
+	return listener, err
+}
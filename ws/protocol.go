@@ -11,7 +11,7 @@ import (
 	"nhooyr.io/websocket"
 	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,6 +19,12 @@ type AuthDTO struct {
 	AuthToken string
 }
 
+// OutputChunk is a piece of terminal output, along with the time it was received
+type OutputChunk struct {
+	Data []byte
+	Time time.Time
+}
+
 type ResizeTerminalDTO struct {
 	Columns int `json:"columns"`
 	Rows    int `json:"rows"`
@@ -49,21 +55,34 @@ type Client struct {
 	WsClient         *websocket.Conn
 	HttpResp         *http.Response
 	WinTitle         <-chan []byte
-	Output           <-chan []byte
+	Output           <-chan OutputChunk
 	Input            chan<- []byte
 	DetectedBaudrate <-chan [2]int64
 	Error            <-chan error
 	CloseChan        <-chan interface{}
+	// Called after every successful watchdog ping, if set
+	OnPing func()
+	// Called from the client goroutine for every chunk of output received and input sent, if set. They must not
+	// block and must not retain the buffer.
+	OnOutput func(data []byte)
+	OnInput  func(data []byte)
+	// Called by ResizeTerminal, if set
+	OnResize func(cols int, rows int)
+	// Called from the client goroutine to transform the output received and the input sent, before any other hook, if
+	// set. They must not modify the buffer in place.
+	MapOutput func(data []byte) []byte
+	MapInput  func(data []byte) []byte
+	// Set to skip MapOutput and MapInput, accessed atomically
+	mappingDisabled int32
 
 	mainCtx            context.Context
 	mainCtxCancel      context.CancelFunc
 	wsHttpClient       http.Client
 	winTitle           chan []byte
 	detectedBaudrate   chan [2]int64
-	output             chan []byte
+	output             chan OutputChunk
 	input              chan []byte
-	flowControl        sync.Mutex
-	flowControlEngaged bool
+	flowControlEngaged int32
 	error              chan error
 
 	watchdogInterval int
@@ -71,8 +90,10 @@ type Client struct {
 	fromWs           chan []byte
 	shutdown         chan interface{}
 	closeChan        chan interface{}
-	isShutdown       bool
-	closed           bool
+	// Set by doShutdown and Close, which may be called from any goroutine. These and flowControlEngaged are accessed
+	// atomically.
+	isShutdown int32
+	closed     int32
 }
 
 type TtyClientOps interface {
@@ -92,17 +113,17 @@ func DialAndAuth(baseUrl *url.URL, token *string, watchdog int) (client *Client,
 	client = &Client{
 		BaseUrl:            baseUrl,
 		winTitle:           make(chan []byte),
-		output:             make(chan []byte),
+		output:             make(chan OutputChunk),
 		input:              make(chan []byte),
 		detectedBaudrate:   make(chan [2]int64),
-		flowControlEngaged: false,
+		flowControlEngaged: 0,
 		wsHttpClient:       http.Client{},
 		error:              make(chan error),
 		toWs:               make(chan []byte),
 		fromWs:             make(chan []byte),
 		closeChan:          make(chan interface{}),
-		isShutdown:         true,
-		closed:             false,
+		isShutdown:         1,
+		closed:             0,
 		watchdogInterval:   watchdog,
 	}
 	client.mainCtx, client.mainCtxCancel = context.WithCancel(context.Background())
@@ -130,7 +151,7 @@ func (c *Client) getReadContext() (context.Context, context.CancelFunc) {
 }
 
 func (c *Client) Redial(token *string) error {
-	if c.closed {
+	if atomic.LoadInt32(&c.closed) != 0 {
 		return fmt.Errorf("not allowed to redial on closed client")
 	}
 
@@ -163,12 +184,17 @@ func (c *Client) Redial(token *string) error {
 	c.WsClient = wsClient
 	c.HttpResp = resp
 	c.shutdown = make(chan interface{})
-	c.isShutdown = false
+	atomic.StoreInt32(&c.isShutdown, 0)
 	return nil
 }
 
+// Returns false once the connection is shut down or the client is closed
+func (c *Client) running() bool {
+	return atomic.LoadInt32(&c.closed) == 0 && atomic.LoadInt32(&c.isShutdown) == 0
+}
+
 func (c *Client) SoftClose() error {
-	if !c.isShutdown {
+	if atomic.LoadInt32(&c.isShutdown) == 0 {
 		return fmt.Errorf("can only soft-close in order to redial if the client is already shut down")
 	}
 	err := c.WsClient.Close(websocket.StatusGoingAway, "")
@@ -181,14 +207,12 @@ func (c *Client) SoftClose() error {
 
 func (c *Client) Close() error {
 	c.doShutdown(nil)
-	if c.closed {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
 		return nil
 	}
-	c.closed = true
 
+	// The channels written by chanLoop are left open, since it may still be sending to them: readers stop at CloseChan
 	close(c.closeChan)
-	close(c.winTitle)
-	close(c.output)
 	close(c.input)
 	close(c.error)
 	close(c.toWs)
@@ -205,14 +229,11 @@ func (c *Client) Close() error {
 }
 
 func (c *Client) doShutdown(err error) {
-	if !c.isShutdown {
+	// The read loop and the watchdog may both fail at once
+	if atomic.CompareAndSwapInt32(&c.isShutdown, 0, 1) {
 		close(c.shutdown)
-		c.isShutdown = true
 
-		if c.flowControlEngaged {
-			c.flowControlEngaged = false
-			c.flowControl.Unlock()
-		}
+		atomic.StoreInt32(&c.flowControlEngaged, 0)
 
 		if err != nil {
 			c.error <- err
@@ -221,7 +242,7 @@ func (c *Client) doShutdown(err error) {
 }
 
 func (c *Client) readLoop() {
-	for !c.closed && !c.isShutdown {
+	for c.running() {
 		//println("BLOCKING readLoop")
 		ctx, cancel := c.getReadContext()
 		msgType, data, err := c.WsClient.Read(ctx)
@@ -240,7 +261,14 @@ func (c *Client) readLoop() {
 }
 
 func (c *Client) chanLoop() {
-	for !c.closed && !c.isShutdown {
+	for c.running() {
+		// While flow control is engaged the input is left in the channel, so that senders block until the server
+		// resumes. Other messages are still sent, and the server messages are still read so that the resume message
+		// can be received.
+		input := c.input
+		if atomic.LoadInt32(&c.flowControlEngaged) != 0 {
+			input = nil
+		}
 		//println("SELECT chanLoop")
 		select {
 		case data := <-c.fromWs:
@@ -249,17 +277,23 @@ func (c *Client) chanLoop() {
 			}
 			switch data[0] {
 			case MsgOutput:
-				c.output <- data[1:]
-			case MsgServerPause:
-				if !c.flowControlEngaged {
-					c.flowControlEngaged = true
-					c.flowControl.Lock()
+				chunk := OutputChunk{Data: data[1:], Time: time.Now()}
+				if c.MapOutput != nil && atomic.LoadInt32(&c.mappingDisabled) == 0 {
+					if chunk.Data = c.MapOutput(chunk.Data); len(chunk.Data) == 0 {
+						continue
+					}
 				}
-			case MsgServerResume:
-				if c.flowControlEngaged {
-					c.flowControlEngaged = false
-					c.flowControl.Unlock()
+				if c.OnOutput != nil {
+					c.OnOutput(chunk.Data)
 				}
+				select {
+				case c.output <- chunk:
+				case <-c.closeChan:
+				}
+			case MsgServerPause:
+				atomic.StoreInt32(&c.flowControlEngaged, 1)
+			case MsgServerResume:
+				atomic.StoreInt32(&c.flowControlEngaged, 0)
 			case MsgSetWindowTitle:
 			EmptyWinTitleChanLoop:
 				// Empty channel so we don't block if the user is not reading
@@ -270,7 +304,10 @@ func (c *Client) chanLoop() {
 						break EmptyWinTitleChanLoop
 					}
 				}
-				c.winTitle <- data[1:]
+				select {
+				case c.winTitle <- data[1:]:
+				case <-c.closeChan:
+				}
 			case MsgDetectBaudrate:
 				// Empty channel so we don't block if the user is not reading
 			EmptyBaudChanLoop:
@@ -306,7 +343,10 @@ func (c *Client) chanLoop() {
 					result[0] = i
 					result[1] = 0
 				}
-				c.detectedBaudrate <- result
+				select {
+				case c.detectedBaudrate <- result:
+				case <-c.closeChan:
+				}
 			}
 			if data[0] == MsgOutput {
 			}
@@ -317,32 +357,36 @@ func (c *Client) chanLoop() {
 			if len(data) == 0 {
 				continue
 			}
-			c.flowControl.Lock()
 			ctx, cancel := c.getWriteContext()
 			err := c.WsClient.Write(ctx, websocket.MessageBinary, data)
 			cancel()
-			c.flowControl.Unlock()
 			if err != nil {
 				ttyc.Trace()
 				c.doShutdown(err)
 				return
 			}
-		case data := <-c.input:
+		case data := <-input:
 			if len(data) == 0 {
 				continue
 			}
+			if c.MapInput != nil && atomic.LoadInt32(&c.mappingDisabled) == 0 {
+				if data = c.MapInput(data); len(data) == 0 {
+					continue
+				}
+			}
 			// I could avoid duplicating the code but I'd rather avoid the additional copy, since writing to the
 			// WebSocket is this goroutine's job anyway.
-			c.flowControl.Lock()
 			ctx, cancel := c.getWriteContext()
 			err := c.WsClient.Write(ctx, websocket.MessageBinary, append([]byte{MsgInput}, data...))
 			cancel()
-			c.flowControl.Unlock()
 			if err != nil {
 				ttyc.Trace()
 				c.doShutdown(err)
 				return
 			}
+			if c.OnInput != nil {
+				c.OnInput(data)
+			}
 		case <-c.closeChan:
 		case <-c.shutdown:
 		}
@@ -354,7 +398,7 @@ func (c *Client) watchdog(interval int) {
 	pingDuration := time.Duration(interval) * time.Second
 	nextPing := time.Now().Add(pingDuration)
 
-	for !c.closed && !c.isShutdown {
+	for c.running() {
 		select {
 		case <-time.After(nextPing.Sub(time.Now())):
 			ctx, cancel := c.getWriteContext()
@@ -365,6 +409,9 @@ func (c *Client) watchdog(interval int) {
 				c.doShutdown(err)
 				return
 			}
+			if c.OnPing != nil {
+				c.OnPing()
+			}
 			nextPing = time.Now().Add(pingDuration)
 		case <-c.closeChan:
 		case <-c.shutdown:
@@ -388,6 +435,18 @@ func (c *Client) ResizeTerminal(cols int, rows int) {
 	}
 	msg, _ := json.Marshal(&dto)
 	c.toWs <- append([]byte{MsgResizeTerminal}, msg...)
+	if c.OnResize != nil {
+		c.OnResize(cols, rows)
+	}
+}
+
+// DisableMapping makes the data pass through unchanged while disabled is true, i.e. during binary file transfers
+func (c *Client) DisableMapping(disabled bool) {
+	var value int32
+	if disabled {
+		value = 1
+	}
+	atomic.StoreInt32(&c.mappingDisabled, value)
 }
 
 func (c *Client) Pause() {
@@ -0,0 +1,270 @@
+package ws
+
+// Server side of the ttyd protocol, used to re-serve a terminal to other ttyd clients
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/Depau/ttyc"
+	"github.com/Depau/ttyc/utils"
+	"net/http"
+	"nhooyr.io/websocket"
+	"sync"
+	"time"
+)
+
+// Number of messages queued for each connection before it is considered stuck and dropped
+const serverConnQueueLen = 256
+
+// Scrollback is replayed in chunks, since clients such as ttyc limit the size of incoming messages
+const scrollbackChunkSize = 8192
+
+// ServerHandler receives the messages sent by the clients connected to a Server
+type ServerHandler interface {
+	HandleInput(data []byte)
+	HandleResize(cols int, rows int)
+	HandleBreak()
+	HandleDetectBaudrate()
+}
+
+type serverConn struct {
+	queue    chan []byte
+	cancel   context.CancelFunc
+	readOnly bool
+}
+
+type Server struct {
+	handler    ServerHandler
+	header     string
+	lock       sync.Mutex
+	conns      map[*serverConn]interface{}
+	scrollback *utils.RingBuffer
+	closed     bool
+}
+
+// ServerEndpoint serves the /token and /ws endpoints of a Server. Clients connected to read-only endpoints receive
+// the output but can't send any messages.
+type ServerEndpoint struct {
+	server   *Server
+	readOnly bool
+	token    string
+	mux      *http.ServeMux
+}
+
+// NewServer creates a ttyd protocol server that replays the last scrollbackSize bytes of output to new clients.
+// serverHeader is sent in the HTTP Server header; if it contains "Wi-Se", ttyc clients will enable Wi-Se features.
+func NewServer(handler ServerHandler, serverHeader string, scrollbackSize int) *Server {
+	return &Server{
+		handler:    handler,
+		header:     serverHeader,
+		conns:      map[*serverConn]interface{}{},
+		scrollback: utils.NewRingBuffer(scrollbackSize),
+	}
+}
+
+// NewEndpoint creates an HTTP handler for the server with its own authentication token
+func (s *Server) NewEndpoint(readOnly bool) *ServerEndpoint {
+	tokenBytes := make([]byte, 18)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		panic("rand.Read() failed")
+	}
+
+	e := &ServerEndpoint{
+		server:   s,
+		readOnly: readOnly,
+		token:    base64.URLEncoding.EncodeToString(tokenBytes),
+		mux:      http.NewServeMux(),
+	}
+	e.mux.HandleFunc("/token", e.serveToken)
+	e.mux.HandleFunc("/ws", e.serveWs)
+	return e
+}
+
+// Handle registers an additional HTTP handler, i.e. for the Wi-Se /stty and /stats endpoints
+func (e *ServerEndpoint) Handle(pattern string, handler http.Handler) {
+	e.mux.Handle(pattern, handler)
+}
+
+func (e *ServerEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if e.server.header != "" {
+		w.Header().Set("Server", e.server.header)
+	}
+	e.mux.ServeHTTP(w, r)
+}
+
+func (e *ServerEndpoint) serveToken(w http.ResponseWriter, _ *http.Request) {
+	message, _ := json.Marshal(&ttyc.TokenDTO{Token: e.token})
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(message)
+}
+
+func (e *ServerEndpoint) serveWs(w http.ResponseWriter, r *http.Request) {
+	s := e.server
+	wsConn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		Subprotocols:       []string{"tty"},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		ttyc.Trace()
+		return
+	}
+	defer wsConn.Close(websocket.StatusInternalError, "")
+	wsConn.SetReadLimit(1 << 20)
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	authCtx, authCancel := context.WithTimeout(ctx, 10*time.Second)
+	_, message, err := wsConn.Read(authCtx)
+	authCancel()
+	if err != nil {
+		ttyc.Trace()
+		return
+	}
+	authDTO := AuthDTO{}
+	if err = json.Unmarshal(message, &authDTO); err != nil || authDTO.AuthToken != e.token {
+		_ = wsConn.Close(websocket.StatusPolicyViolation, "invalid token")
+		return
+	}
+
+	conn := &serverConn{cancel: cancel, readOnly: e.readOnly}
+	if !s.addConn(conn) {
+		_ = wsConn.Close(websocket.StatusGoingAway, "server is shutting down")
+		return
+	}
+	defer s.removeConn(conn)
+
+	go s.writeLoop(ctx, wsConn, conn)
+	s.readLoop(ctx, wsConn, conn)
+	_ = wsConn.Close(websocket.StatusNormalClosure, "")
+}
+
+func (s *Server) readLoop(ctx context.Context, wsConn *websocket.Conn, conn *serverConn) {
+	for {
+		_, data, err := wsConn.Read(ctx)
+		if err != nil {
+			return
+		}
+		if len(data) == 0 || conn.readOnly {
+			continue
+		}
+		switch data[0] {
+		case MsgInput:
+			if len(data) > 1 {
+				s.handler.HandleInput(data[1:])
+			}
+		case MsgResizeTerminal:
+			dto := ResizeTerminalDTO{}
+			if err := json.Unmarshal(data[1:], &dto); err == nil && dto.Columns > 0 && dto.Rows > 0 {
+				s.handler.HandleResize(dto.Columns, dto.Rows)
+			}
+		case MsgBreak:
+			s.handler.HandleBreak()
+		case MsgDetectBaudrate:
+			s.handler.HandleDetectBaudrate()
+		}
+		// Pause and resume are not supported, output is dropped by the server for clients that can't keep up
+	}
+}
+
+func (s *Server) writeLoop(ctx context.Context, wsConn *websocket.Conn, conn *serverConn) {
+	defer conn.cancel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case message, ok := <-conn.queue:
+			if !ok {
+				return
+			}
+			writeCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			err := wsConn.Write(writeCtx, websocket.MessageBinary, message)
+			cancel()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) addConn(conn *serverConn) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return false
+	}
+	// Replay the scrollback before adding the connection so the client sees each byte exactly once
+	scrollback := s.scrollback.Bytes()
+	conn.queue = make(chan []byte, serverConnQueueLen+len(scrollback)/scrollbackChunkSize+1)
+	for len(scrollback) > 0 {
+		chunkLen := len(scrollback)
+		if chunkLen > scrollbackChunkSize {
+			chunkLen = scrollbackChunkSize
+		}
+		conn.queue <- append([]byte{MsgOutput}, scrollback[:chunkLen]...)
+		scrollback = scrollback[chunkLen:]
+	}
+	s.conns[conn] = nil
+	return true
+}
+
+func (s *Server) removeConn(conn *serverConn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.conns[conn]; ok {
+		delete(s.conns, conn)
+		close(conn.queue)
+	}
+}
+
+// Clients returns the number of clients currently connected
+func (s *Server) Clients() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.conns)
+}
+
+func (s *Server) broadcastLocked(message []byte) {
+	for conn := range s.conns {
+		select {
+		case conn.queue <- message:
+		default:
+			// Client is stuck, drop it instead of stalling everyone else
+			delete(s.conns, conn)
+			close(conn.queue)
+			conn.cancel()
+		}
+	}
+}
+
+// Output sends terminal output to all clients and appends it to the scrollback
+func (s *Server) Output(data []byte) {
+	message := append([]byte{MsgOutput}, data...)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, _ = s.scrollback.Write(data)
+	s.broadcastLocked(message)
+}
+
+// DetectedBaudrate forwards a baud rate detection result to all clients
+func (s *Server) DetectedBaudrate(result [2]int64) {
+	message := []byte(fmt.Sprintf("%c%d,%d", MsgDetectBaudrate, result[0], result[1]))
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.broadcastLocked(message)
+}
+
+// Close disconnects all clients. The server refuses new WebSocket connections afterwards.
+func (s *Server) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	for conn := range s.conns {
+		delete(s.conns, conn)
+		close(conn.queue)
+		conn.cancel()
+	}
+}